@@ -1,5 +1,12 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
 // type Agent struct {
 // 	llm    Agent    // the name of the model to use
 // 	role   string // the role that this agent has in the workflow
@@ -7,3 +14,232 @@ package main
 // 	memory string // storing information that the agent is to use as part of its recursive calls
 // 	cont   bool   // used to determine if the agent is to continue invoking itself or to stop
 // }
+
+const DEFAULT_MAX_TOKENS int = 2048
+const DEFAULT_MAX_STEPS int = 10
+const DEFAULT_MAX_PARALLEL_TOOLS int = 4
+
+/*
+Possible values for the Status of a RunResult
+*/
+const (
+	RUN_STATUS_COMPLETED = "completed"         // the agent ended its turn without requesting another heartbeat
+	RUN_STATUS_MAX_STEPS = "max_steps_reached" // the agent was still requesting heartbeats when the step ceiling was hit
+	RUN_STATUS_ERROR     = "error"             // a request to the model failed
+	RUN_STATUS_CANCELLED = "cancelled"         // the context of the run was cancelled or its deadline passed
+)
+
+/*
+Options that control the agent loop
+*/
+type RunOptions struct {
+	MaxSteps    int     // the maximum number of requests to make to the model in a single run
+	MaxTokens   int     // the maximum number of tokens for the model to generate per request
+	Temperature float32 // temperature value (0 - 1) used for each request
+	// the maximum number of tool calls from a single response to execute concurrently; 1 runs them one at a time
+	MaxParallelTools int
+	// the maximum amount of time to wait for each request to the model; 0 means no limit
+	RequestTimeout time.Duration
+	// the maximum amount of time that each tool call may take, unless the Tool sets its own Timeout; 0 means no limit
+	ToolTimeout time.Duration
+	/*
+		Optional callback for streaming.
+		When set, each request is streamed and every piece of the response is passed to OnStream as it is generated.
+	*/
+	OnStream StreamHandler
+}
+
+/*
+Returns the RunOptions used when no options are provided to Run
+*/
+func DefaultRunOptions() RunOptions {
+	return RunOptions{
+		MaxSteps:         DEFAULT_MAX_STEPS,
+		MaxTokens:        DEFAULT_MAX_TOKENS,
+		Temperature:      0,
+		MaxParallelTools: DEFAULT_MAX_PARALLEL_TOOLS,
+	}
+}
+
+/*
+The outcome of a single iteration of the agent loop
+*/
+type StepResult struct {
+	Response   *AgentResponse
+	StatusCode int
+	ToolCalls  int  // the number of tool_use blocks that were executed during this step
+	Continue   bool // whether the agent should be invoked again
+}
+
+/*
+The outcome of running the agent loop until it terminates
+*/
+type RunResult struct {
+	Status     string          // one of the RUN_STATUS_* constants
+	Steps      int             // the number of requests made to the model
+	StopReason string          // the stop_reason of the last response received
+	Responses  []AgentResponse // every response received during the run, in order
+}
+
+/*
+Returns the response received on the final step of the run, or nil if no response was received
+*/
+func (result RunResult) LastResponse() *AgentResponse {
+	if len(result.Responses) == 0 {
+		return nil
+	}
+	return &result.Responses[len(result.Responses)-1]
+}
+
+/*
+Runs a single iteration of the agent loop.
+Sends the current chat history to the model, adds the response to the chat history and executes every tool_use block in the response.
+The Continue field of the result is set when the model stopped to use a tool or when one of the tools requested a heartbeat.
+If the context is cancelled while tools are running, the unfinished tools are reported as errors so that every tool_use in the chat history has a tool_result.
+*/
+func (llm *Agent) Step(ctx context.Context, options RunOptions) (*StepResult, error) {
+	// A heartbeat only applies to the step in which it was requested
+	llm.HeartbeatState = false
+
+	// picking up blocks that were added to or removed from core memory since the last step
+	llm.refreshMemoryToolSchemas()
+	llm.updateMemoryStatistics(llm.now())
+	if err := llm.manageContextWindow(ctx, options); err != nil {
+		return &StepResult{}, err
+	}
+	request := *llm.NewAgentRequest(options.MaxTokens, options.Temperature)
+
+	requestCtx := ctx
+	if options.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, options.RequestTimeout)
+		defer cancel()
+	}
+
+	handler := options.OnStream
+	if llm.OnEvent != nil {
+		handler = llm.monologueStreamHandler(handler)
+	}
+
+	var response *AgentResponse
+	var statusCode int
+	var err error
+	if handler != nil {
+		response, statusCode, err = llm.callStream(requestCtx, request, handler)
+	} else {
+		response, statusCode, err = llm.call(requestCtx, request)
+	}
+	if err != nil {
+		return &StepResult{StatusCode: statusCode}, err
+	}
+	if statusCode != http.StatusOK {
+		return &StepResult{StatusCode: statusCode}, fmt.Errorf("request failed with status code %d", statusCode)
+	}
+
+	llm.addResponseToChatHistory(*response)
+
+	toolUses := make([]Content, 0)
+	for _, content := range response.Content {
+		// only looking for tool_use Content blocks
+		if content.Type == "tool_use" {
+			toolUses = append(toolUses, content)
+		}
+	}
+	toolCalls := len(toolUses)
+	results, heartbeat := llm.executeToolCalls(ctx, toolUses, options)
+	llm.addToolResultsToChatHistory(results)
+	llm.HeartbeatState = heartbeat
+
+	if llm.HeartbeatState {
+		llm.emit(AgentEvent{Type: AGENT_EVENT_HEARTBEAT})
+	}
+	cont := (response.StopReason == "tool_use" || llm.HeartbeatState) && ctx.Err() == nil
+	if cont && toolCalls == 0 {
+		// The next request must not end on an assistant message
+		llm.addHeartbeatToChatHistory()
+	}
+
+	return &StepResult{
+		Response:   response,
+		StatusCode: statusCode,
+		ToolCalls:  toolCalls,
+		Continue:   cont,
+	}, nil
+}
+
+/*
+Runs the agent loop until the agent stops requesting heartbeats or the MaxSteps ceiling is reached.
+Uses DefaultRunOptions when no options are provided.
+Cancelling the context aborts the run; any request in flight is abandoned and the chat history is left ending on a complete turn.
+The RunResult is always returned, including when an error occurs, so that the responses received before the failure can be inspected.
+*/
+func (llm *Agent) Run(ctx context.Context, options ...RunOptions) (*RunResult, error) {
+	llm.emit(AgentEvent{Type: AGENT_EVENT_RUN_START})
+	result, err := llm.run(ctx, options...)
+
+	event := AgentEvent{Type: AGENT_EVENT_RUN_END, Status: result.Status, Steps: result.Steps}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	llm.emit(event)
+	return result, err
+}
+
+func (llm *Agent) run(ctx context.Context, options ...RunOptions) (*RunResult, error) {
+	opts := DefaultRunOptions()
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if opts.MaxSteps <= 0 {
+		opts.MaxSteps = DEFAULT_MAX_STEPS
+	}
+	if opts.MaxTokens <= 0 {
+		opts.MaxTokens = DEFAULT_MAX_TOKENS
+	}
+	if opts.MaxParallelTools <= 0 {
+		opts.MaxParallelTools = DEFAULT_MAX_PARALLEL_TOOLS
+	}
+
+	result := &RunResult{Responses: make([]AgentResponse, 0)}
+	for result.Steps < opts.MaxSteps {
+		if err := ctx.Err(); err != nil {
+			result.Status = RUN_STATUS_CANCELLED
+			return result, err
+		}
+
+		step, err := llm.Step(ctx, opts)
+		result.Steps++
+		if err != nil {
+			result.Status = RUN_STATUS_ERROR
+			if ctx.Err() != nil {
+				result.Status = RUN_STATUS_CANCELLED
+			}
+			return result, err
+		}
+
+		result.Responses = append(result.Responses, *step.Response)
+		result.StopReason = step.Response.StopReason
+		if err := ctx.Err(); err != nil {
+			result.Status = RUN_STATUS_CANCELLED
+			return result, err
+		}
+
+		if !step.Continue {
+			result.Status = RUN_STATUS_COMPLETED
+			return result, nil
+		}
+	}
+
+	result.Status = RUN_STATUS_MAX_STEPS
+	return result, nil
+}
+
+/*
+Adds a heartbeat message to the chat history so that the agent can be invoked again without any new user input
+*/
+func (llm *Agent) addHeartbeatToChatHistory() {
+	llm.addMessageToChatHistory(Message{Role: "user",
+		Content: []Content{
+			{Type: "text", Text: "[heartbeat] Your previous function call requested a heartbeat. Continue your execution."},
+		}})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+A Provider that returns scripted responses, for tests.
+Once the scripted responses run out, it ends the turn with a plain text reply.
+*/
+type fakeProvider struct {
+	mu        sync.Mutex
+	responses []AgentResponse
+	err       error // returned by every request instead of a response, when set
+	requests  []AgentRequest
+}
+
+func (provider *fakeProvider) Complete(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.requests = append(provider.requests, reqData)
+	if provider.err != nil {
+		return nil, -1, provider.err
+	}
+	if len(provider.responses) == 0 {
+		return &AgentResponse{Role: "assistant", StopReason: "end_turn", Content: []Content{{Type: "text", Text: "Done."}}}, 200, nil
+	}
+	response := provider.responses[0]
+	provider.responses = provider.responses[1:]
+	return &response, 200, nil
+}
+
+func (provider *fakeProvider) Stream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error) {
+	return provider.Complete(ctx, reqData)
+}
+
+func (provider *fakeProvider) CountTokens(ctx context.Context, reqData AgentRequest) (int, error) {
+	return estimateTokens(reqData), nil
+}
+
+/*
+Returns a response that calls a single tool
+*/
+func toolUseResponse(id string, name string, input map[string]any) AgentResponse {
+	return AgentResponse{Role: "assistant", StopReason: "tool_use", Content: []Content{{Type: "tool_use", ID: id, Name: name, Input: input}}}
+}
+
+/*
+Returns an Agent served by the provider, whose messages to the user are collected in the returned slice
+*/
+func newTestAgent(provider *fakeProvider) (*Agent, *[]AgentMessage) {
+	agent := NewAgentWithProvider("test-model", "A helpful assistant.", "tester", provider)
+	messages := make([]AgentMessage, 0)
+	agent.Output = SinkFunc(func(ctx context.Context, message AgentMessage) error {
+		messages = append(messages, message)
+		return nil
+	})
+	return agent, &messages
+}
+
+func TestRunTermination(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []AgentResponse
+		err       error
+		maxSteps  int
+		status    string
+		steps     int
+	}{
+		{
+			name:   "ends the turn without tools",
+			status: RUN_STATUS_COMPLETED,
+			steps:  1,
+		},
+		{
+			name:      "continues after a tool call",
+			responses: []AgentResponse{toolUseResponse("call_1", "sendMessage", map[string]any{"message": "Hi!"})},
+			status:    RUN_STATUS_COMPLETED,
+			steps:     2,
+		},
+		{
+			name: "continues after memory tools",
+			responses: []AgentResponse{
+				toolUseResponse("call_1", "archivalMemoryInsert", map[string]any{"content": "The user likes tea.", "requestHeartbeat": true}),
+				toolUseResponse("call_2", "archivalMemorySearch", map[string]any{"query": "tea", "requestHeartbeat": true}),
+			},
+			status: RUN_STATUS_COMPLETED,
+			steps:  3,
+		},
+		{
+			name: "stops at the step ceiling",
+			responses: []AgentResponse{
+				toolUseResponse("call_1", "sendMessage", map[string]any{"message": "One"}),
+				toolUseResponse("call_2", "sendMessage", map[string]any{"message": "Two"}),
+				toolUseResponse("call_3", "sendMessage", map[string]any{"message": "Three"}),
+			},
+			maxSteps: 2,
+			status:   RUN_STATUS_MAX_STEPS,
+			steps:    2,
+		},
+		{
+			name:   "stops when a request fails",
+			err:    errors.New("connection refused"),
+			status: RUN_STATUS_ERROR,
+			steps:  1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &fakeProvider{responses: test.responses, err: test.err}
+			agent, _ := newTestAgent(provider)
+			agent.AddUserMessage("Hello")
+
+			options := DefaultRunOptions()
+			if test.maxSteps > 0 {
+				options.MaxSteps = test.maxSteps
+			}
+			result, err := agent.Run(context.Background(), options)
+			if (err != nil) != (test.err != nil) {
+				t.Fatalf("Run returned error %v, want %v", err, test.err)
+			}
+			if result.Status != test.status || result.Steps != test.steps {
+				t.Errorf("Run = %s after %d steps, want %s after %d steps", result.Status, result.Steps, test.status, test.steps)
+			}
+			if last := agent.ChatHistory[len(agent.ChatHistory)-1]; test.err == nil && last.Role != "assistant" && result.Status == RUN_STATUS_COMPLETED {
+				t.Errorf("the chat history of a completed run ends on a %s message", last.Role)
+			}
+		})
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.AddUserMessage("Hello")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := agent.Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned error %v, want %v", err, context.Canceled)
+	}
+	if result.Status != RUN_STATUS_CANCELLED || result.Steps != 0 {
+		t.Errorf("Run = %s after %d steps, want %s after 0 steps", result.Status, result.Steps, RUN_STATUS_CANCELLED)
+	}
+}
+
+func TestStepDeliversMessages(t *testing.T) {
+	provider := &fakeProvider{responses: []AgentResponse{toolUseResponse("call_1", "sendMessage", map[string]any{"message": "Hi there!"})}}
+	agent, messages := newTestAgent(provider)
+	agent.AddUserMessage("Hello")
+
+	step, err := agent.Step(context.Background(), DefaultRunOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step.ToolCalls != 1 || !step.Continue {
+		t.Errorf("Step = %d tool calls, continue %v; want 1 tool call, continue true", step.ToolCalls, step.Continue)
+	}
+	if len(*messages) != 1 || (*messages)[0].Text != "Hi there!" || (*messages)[0].ToolUseID != "call_1" {
+		t.Errorf("delivered messages = %+v, want a single message \"Hi there!\" from call_1", *messages)
+	}
+}
+
+/*
+A Provider whose requests only return once their context is done
+*/
+type hangingProvider struct {
+	fakeProvider
+}
+
+func (provider *hangingProvider) Complete(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error) {
+	<-ctx.Done()
+	return nil, -1, ctx.Err()
+}
+
+func (provider *hangingProvider) Stream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error) {
+	return provider.Complete(ctx, reqData)
+}
+
+func TestRunAbandonsRequests(t *testing.T) {
+	tests := []struct {
+		name           string
+		runTimeout     time.Duration
+		requestTimeout time.Duration
+		status         string
+	}{
+		{name: "request timeout", requestTimeout: 10 * time.Millisecond, status: RUN_STATUS_ERROR},
+		{name: "run deadline", runTimeout: 10 * time.Millisecond, status: RUN_STATUS_CANCELLED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := NewAgentWithProvider("test-model", "A helpful assistant.", "tester", &hangingProvider{})
+			agent.AddUserMessage("Hello")
+
+			ctx := context.Background()
+			if test.runTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.runTimeout)
+				defer cancel()
+			}
+			options := DefaultRunOptions()
+			options.RequestTimeout = test.requestTimeout
+
+			result, err := agent.Run(ctx, options)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Run returned error %v, want %v", err, context.DeadlineExceeded)
+			}
+			if result.Status != test.status || result.Steps != 1 {
+				t.Errorf("Run = %s after %d steps, want %s after 1 step", result.Status, result.Steps, test.status)
+			}
+			if len(agent.ChatHistory) != 1 {
+				t.Errorf("the abandoned request left %d messages in the chat history, want only the user's", len(agent.ChatHistory))
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Provider for the Anthropic Messages API
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const ANTHROPIC_BASE_URL string = "https://api.anthropic.com"
+const ANTHROPIC_VERSION string = "2023-06-01"
+
+type AnthropicProvider struct {
+	ApiKey  string
+	BaseURL string // defaults to ANTHROPIC_BASE_URL
+	Version string // value of the anthropic-version header, defaults to ANTHROPIC_VERSION
+	// The client used to send requests; defaults to http.DefaultClient. Use the client's Timeout for a hard limit on every request.
+	HTTPClient *http.Client
+	// How failed requests are retried; the zero value disables retries
+	RetryPolicy RetryPolicy
+	// Limits the rate at which requests are sent; nil disables client-side rate limiting
+	RateLimiter *RateLimiter
+}
+
+/*
+Creates a Provider that sends requests to the Anthropic API using the given API key.
+Failed requests are retried with the DefaultRetryPolicy, and requests are rate limited by the limiter shared by every Provider using the same key.
+*/
+func NewAnthropicProvider(apiKey string) *AnthropicProvider {
+	return &AnthropicProvider{
+		ApiKey:      apiKey,
+		BaseURL:     ANTHROPIC_BASE_URL,
+		Version:     ANTHROPIC_VERSION,
+		RetryPolicy: DefaultRetryPolicy(),
+		RateLimiter: SharedRateLimiter(apiKey, DEFAULT_REQUESTS_PER_MINUTE, DEFAULT_REQUEST_BURST),
+	}
+}
+
+/*
+Sends a request with the given body to the given path of the Anthropic API, retrying according to the provider's RetryPolicy.
+Returns the response if it was successful; otherwise the error is an *APIError when the API responded with an error.
+*/
+func (provider AnthropicProvider) send(ctx context.Context, path string, body any, stream bool) (*http.Response, error) {
+	// Extracting the request data
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request: %w", err)
+	}
+
+	baseURL := provider.BaseURL
+	if baseURL == "" {
+		baseURL = ANTHROPIC_BASE_URL
+	}
+	version := provider.Version
+	if version == "" {
+		version = ANTHROPIC_VERSION
+	}
+	url := strings.TrimSuffix(baseURL, "/") + path
+
+	return sendWithRetry(ctx, provider.HTTPClient, provider.RetryPolicy, provider.RateLimiter, func() (*http.Request, error) {
+		// Creating the request
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+
+		// Setting request headers
+		req.Header.Set("x-api-key", provider.ApiKey)
+		req.Header.Set("anthropic-version", version)
+		req.Header.Set("content-type", "application/json")
+		if stream {
+			req.Header.Set("accept", "text/event-stream")
+		}
+		return req, nil
+	})
+}
+
+func (provider AnthropicProvider) Complete(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error) {
+	reqData.Stream = false
+
+	// Sending the request
+	res, err := provider.send(ctx, "/v1/messages", reqData, false)
+	if err != nil {
+		return nil, statusCodeOf(err), err
+	}
+
+	// Closing the response body once the function is finished executing
+	defer res.Body.Close()
+
+	// Reading the response data
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error reading response: %w", err)
+	}
+
+	// Storing the response into the Response struct
+	var apiResp AgentResponse
+	err = json.Unmarshal(resBody, &apiResp)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error parsing response: %w", err)
+	}
+
+	return &apiResp, res.StatusCode, nil
+}
+
+func (provider AnthropicProvider) Stream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error) {
+	reqData.Stream = true
+
+	res, err := provider.send(ctx, "/v1/messages", reqData, true)
+	if err != nil {
+		return nil, statusCodeOf(err), err
+	}
+	defer res.Body.Close()
+
+	acc := newStreamAccumulator(handler)
+	err = readServerSentEvents(res.Body, func(event string, data string) error {
+		if event == "ping" {
+			return nil
+		}
+		return acc.applyMessagesEvent(data)
+	})
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error reading stream: %w", err)
+	}
+
+	response, err := acc.finish()
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error reading stream: %w", err)
+	}
+	return response, res.StatusCode, nil
+}
+
+/*
+Counts the input tokens of a request using the token counting endpoint of the Messages API
+*/
+func (provider AnthropicProvider) CountTokens(ctx context.Context, reqData AgentRequest) (int, error) {
+	body := struct {
+		Model      string            `json:"model"`
+		Messages   []Message         `json:"messages"`
+		System     []Content         `json:"system,omitempty"`
+		Tools      []Tool            `json:"tools,omitempty"`
+		ToolChoice map[string]string `json:"tool_choice,omitempty"`
+	}{reqData.Model, reqData.Messages, reqData.System, reqData.Tools, reqData.ToolChoice}
+
+	res, err := provider.send(ctx, "/v1/messages/count_tokens", body, false)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var count struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(resBody, &count); err != nil {
+		return 0, err
+	}
+	return count.InputTokens, nil
+}
+
+/*
+The data payload of a streamed Messages API event.
+Only the fields relevant to the event type are populated.
+*/
+type messagesStreamEvent struct {
+	Type         string         `json:"type"`
+	Message      *AgentResponse `json:"message,omitempty"`
+	Index        int            `json:"index"`
+	ContentBlock *Content       `json:"content_block,omitempty"`
+	Delta        struct {
+		Type         string `json:"type"`
+		Text         string `json:"text"`
+		PartialJSON  string `json:"partial_json"`
+		StopReason   string `json:"stop_reason"`
+		StopSequence any    `json:"stop_sequence"`
+	} `json:"delta"`
+	Usage map[string]int `json:"usage,omitempty"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+/*
+Applies a single streamed Messages API event to the accumulator
+*/
+func (acc *streamAccumulator) applyMessagesEvent(data string) error {
+	var event messagesStreamEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return fmt.Errorf("error parsing stream event: %w", err)
+	}
+
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			acc.response.ID = event.Message.ID
+			acc.response.Model = event.Message.Model
+			acc.response.Role = event.Message.Role
+			for k, v := range event.Message.Usage {
+				acc.response.Usage[k] = v
+			}
+		}
+	case "content_block_start":
+		if event.ContentBlock != nil {
+			block := *event.ContentBlock
+			// the input is streamed separately as input_json_delta events
+			block.Input = nil
+			acc.startBlock(event.Index, block)
+		}
+	case "content_block_delta":
+		switch event.Delta.Type {
+		case "text_delta":
+			acc.appendText(event.Index, event.Delta.Text)
+		case "input_json_delta":
+			acc.appendInputJSON(event.Index, event.Delta.PartialJSON)
+		}
+	case "content_block_stop":
+		return acc.stopBlock(event.Index)
+	case "message_delta":
+		acc.response.StopReason = event.Delta.StopReason
+		acc.response.StopSequence = event.Delta.StopSequence
+		for k, v := range event.Usage {
+			acc.response.Usage[k] = v
+		}
+	case "message_stop":
+		acc.complete = true
+	case "error":
+		// errors that occur after the stream has started are reported as events, e.g. when the API becomes overloaded
+		if event.Error != nil {
+			return &APIError{StatusCode: http.StatusOK, Type: event.Error.Type, Message: event.Error.Message}
+		}
+		return fmt.Errorf("stream error: %s", data)
+	}
+	return nil
+}
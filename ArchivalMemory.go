@@ -0,0 +1,551 @@
+/*
+Archival memory: general purpose storage held out of context, retrieved through keyword search ranked with BM25, optionally combined with semantic search
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Number of results returned per page by the archival memory search tool
+const ARCHIVAL_PAGE_SIZE int = 5
+
+/*
+BM25 ranking parameters.
+BM25_K1 controls how quickly repeated occurrences of a term stop increasing the score; BM25_B controls how strongly scores are normalized by passage length.
+*/
+const BM25_K1 float64 = 1.2
+const BM25_B float64 = 0.75
+
+/*
+Hybrid search parameters.
+DEFAULT_SEMANTIC_WEIGHT is the share of a result's score that comes from vector similarity, the rest coming from BM25;
+passages less similar to the query than DEFAULT_MIN_SIMILARITY are only returned when they match a keyword.
+*/
+const DEFAULT_SEMANTIC_WEIGHT float64 = 0.5
+const DEFAULT_MIN_SIMILARITY float64 = 0.1
+
+/*
+A single piece of information stored in archival memory
+*/
+type Passage struct {
+	ID        int       `json:"id"`
+	Text      string    `json:"text"`
+	Tags      []string  `json:"tags,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+/*
+A Passage returned by a search, along with its relevance to the query
+*/
+type ArchivalResult struct {
+	Passage
+	Score float64 `json:"score"`
+}
+
+/*
+General purpose out of context information storage.
+Passages are kept in an inverted index and retrieved with BM25 ranked keyword search, which works fully offline.
+When an Embedder is configured, passages are also embedded into a VectorIndex and searches rank passages by a mix of BM25 and semantic similarity.
+*/
+type ArchivalMemory struct {
+	/*
+		Between 0 and 1; the share of a result's score that comes from semantic similarity when an Embedder is configured.
+		0 ranks by keywords only, 1 ranks by meaning only.
+	*/
+	SemanticWeight float64
+	/*
+		The cosine similarity a passage must have with the query to be returned without matching any keyword.
+		The right value depends on the Embedder, since some models give unrelated texts higher similarities than others.
+	*/
+	MinSimilarity float64
+
+	mu       sync.RWMutex
+	passages []Passage
+	/*
+		Inverted index of the passages.
+		Maps each term to the passages containing it, and the number of times the term occurs in each of those passages.
+	*/
+	index       map[string]map[int]int
+	lengths     map[int]int // the number of terms in each passage, keyed by passage ID
+	totalLength int
+
+	embedder Embedder // nil when only keyword search is used
+	vectors  *VectorIndex
+}
+
+func NewArchivalMemory() *ArchivalMemory {
+	return &ArchivalMemory{
+		passages: make([]Passage, 0),
+		index:    make(map[string]map[int]int),
+		lengths:  make(map[int]int),
+	}
+}
+
+/*
+Creates an ArchivalMemory that uses the embedder for hybrid keyword and semantic search
+*/
+func NewArchivalMemoryWithEmbedder(embedder Embedder) *ArchivalMemory {
+	archival := NewArchivalMemory()
+	archival.SemanticWeight = DEFAULT_SEMANTIC_WEIGHT
+	archival.MinSimilarity = DEFAULT_MIN_SIMILARITY
+	archival.embedder = embedder
+	archival.vectors = NewVectorIndex()
+	return archival
+}
+
+/*
+Words that are too common to be useful search terms
+*/
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true, "by": true,
+	"for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true, "not": true, "of": true,
+	"on": true, "or": true, "such": true, "that": true, "the": true, "their": true, "then": true, "there": true,
+	"these": true, "they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+/*
+Splits text into lowercase search terms, dropping punctuation and stop words
+*/
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if !stopWords[word] {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+/*
+Embeds the texts with the Embedder, making sure that it returned a vector for each of them
+*/
+func (archival *ArchivalMemory) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, err := archival.embedder.Embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("embedder returned %d vectors for %d texts", len(vectors), len(texts))
+	}
+	return vectors, nil
+}
+
+/*
+Stores a passage in archival memory and adds it to the index.
+If an Embedder is configured, the passage is embedded first; nothing is stored if that fails.
+*/
+func (archival *ArchivalMemory) Insert(ctx context.Context, text string, tags []string, timestamp time.Time) (Passage, error) {
+	// embedding before taking the lock, since it may involve a request to an API
+	var vector []float32
+	if archival.embedder != nil {
+		vectors, err := archival.embed(ctx, []string{text})
+		if err != nil {
+			return Passage{}, fmt.Errorf("error embedding passage: %w", err)
+		}
+		vector = vectors[0]
+	}
+
+	archival.mu.Lock()
+	defer archival.mu.Unlock()
+
+	passage := Passage{
+		ID:        len(archival.passages) + 1,
+		Text:      text,
+		Tags:      normalizeTags(tags),
+		Timestamp: timestamp,
+	}
+	archival.passages = append(archival.passages, passage)
+	archival.indexPassage(passage)
+	if vector != nil {
+		archival.vectors.Add(passage.ID, vector)
+	}
+	return passage, nil
+}
+
+/*
+Adds the terms of a passage to the inverted index.
+Must be called with the lock held.
+*/
+func (archival *ArchivalMemory) indexPassage(passage Passage) {
+	terms := tokenize(passage.Text)
+	for _, term := range terms {
+		postings, ok := archival.index[term]
+		if !ok {
+			postings = make(map[int]int)
+			archival.index[term] = postings
+		}
+		postings[passage.ID]++
+	}
+	archival.lengths[passage.ID] = len(terms)
+	archival.totalLength += len(terms)
+}
+
+/*
+Lowercases and trims tags, removing empty and duplicate tags
+*/
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+/*
+Whether the passage has every one of the given tags
+*/
+func (passage Passage) hasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, passageTag := range passage.Tags {
+			if passageTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Returns the number of passages stored in archival memory
+*/
+func (archival *ArchivalMemory) Len() int {
+	archival.mu.RLock()
+	defer archival.mu.RUnlock()
+	return len(archival.passages)
+}
+
+/*
+Returns a copy of every passage stored in archival memory, oldest first
+*/
+func (archival *ArchivalMemory) Passages() []Passage {
+	archival.mu.RLock()
+	defer archival.mu.RUnlock()
+	return append([]Passage(nil), archival.passages...)
+}
+
+/*
+The number of passages that have a given tag
+*/
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+/*
+Summary of the contents of archival memory
+*/
+type ArchivalStats struct {
+	Passages int        // the number of passages stored
+	Tags     []TagCount // every tag used, most common first
+	First    time.Time  // when the oldest passage was inserted
+	Last     time.Time  // when the newest passage was inserted
+}
+
+/*
+Returns a summary of the contents of archival memory
+*/
+func (archival *ArchivalMemory) Stats() ArchivalStats {
+	archival.mu.RLock()
+	defer archival.mu.RUnlock()
+
+	stats := ArchivalStats{Passages: len(archival.passages), Tags: make([]TagCount, 0)}
+	counts := make(map[string]int)
+	for _, passage := range archival.passages {
+		for _, tag := range passage.Tags {
+			counts[tag]++
+		}
+	}
+	for tag, count := range counts {
+		stats.Tags = append(stats.Tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(stats.Tags, func(i, j int) bool {
+		if stats.Tags[i].Count != stats.Tags[j].Count {
+			return stats.Tags[i].Count > stats.Tags[j].Count
+		}
+		return stats.Tags[i].Tag < stats.Tags[j].Tag
+	})
+
+	if len(archival.passages) > 0 {
+		stats.First = archival.passages[0].Timestamp
+		stats.Last = archival.passages[len(archival.passages)-1].Timestamp
+	}
+	return stats
+}
+
+/*
+Returns every passage along with its embedding, oldest first, so that archival memory can be saved
+*/
+func (archival *ArchivalMemory) records() []ArchivalRecord {
+	archival.mu.RLock()
+	defer archival.mu.RUnlock()
+
+	records := make([]ArchivalRecord, len(archival.passages))
+	for i, passage := range archival.passages {
+		records[i].Passage = passage
+		if archival.vectors != nil {
+			records[i].Vector, _ = archival.vectors.Get(passage.ID)
+		}
+	}
+	return records
+}
+
+/*
+Loads saved passages into an empty archival memory, rebuilding the index.
+When an Embedder is configured, the saved embeddings are reused and passages saved without one are embedded.
+*/
+func (archival *ArchivalMemory) restore(ctx context.Context, records []ArchivalRecord) error {
+	vectors := make([][]float32, len(records))
+	if archival.embedder != nil {
+		missing := make([]string, 0)
+		missingIndexes := make([]int, 0)
+		for i, record := range records {
+			if record.Vector != nil {
+				vectors[i] = record.Vector
+			} else {
+				missing = append(missing, record.Text)
+				missingIndexes = append(missingIndexes, i)
+			}
+		}
+		if len(missing) > 0 {
+			embedded, err := archival.embed(ctx, missing)
+			if err != nil {
+				return fmt.Errorf("error embedding passages: %w", err)
+			}
+			for i, index := range missingIndexes {
+				vectors[index] = embedded[i]
+			}
+		}
+	}
+
+	archival.mu.Lock()
+	defer archival.mu.Unlock()
+	if len(archival.passages) > 0 {
+		return fmt.Errorf("archival memory already contains passages")
+	}
+
+	for i, record := range records {
+		// passage IDs are their position in archival memory, starting at 1
+		if record.ID != i+1 {
+			return fmt.Errorf("passage %d is out of order; expected passage %d", record.ID, i+1)
+		}
+		archival.passages = append(archival.passages, record.Passage)
+		archival.indexPassage(record.Passage)
+		if archival.embedder != nil {
+			archival.vectors.Add(record.ID, vectors[i])
+		}
+	}
+	return nil
+}
+
+/*
+Scores every passage containing at least one term of the query using BM25.
+Must be called with the lock held.
+*/
+func (archival *ArchivalMemory) bm25Scores(query string) map[int]float64 {
+	scores := make(map[int]float64)
+	numPassages := float64(len(archival.passages))
+	if numPassages == 0 {
+		return scores
+	}
+	averageLength := float64(archival.totalLength) / numPassages
+
+	for _, term := range tokenize(query) {
+		postings, ok := archival.index[term]
+		if !ok {
+			continue
+		}
+		documentFrequency := float64(len(postings))
+		idf := math.Log(1 + (numPassages-documentFrequency+0.5)/(documentFrequency+0.5))
+
+		for id, termFrequency := range postings {
+			frequency := float64(termFrequency)
+			lengthNorm := 1 - BM25_B + BM25_B*float64(archival.lengths[id])/averageLength
+			scores[id] += idf * frequency * (BM25_K1 + 1) / (frequency + BM25_K1*lengthNorm)
+		}
+	}
+	return scores
+}
+
+/*
+Combines BM25 scores with the similarity of each passage to the query vector.
+BM25 scores are divided by the highest score so that both kinds of score fall between 0 and 1 before they are weighted.
+Must be called with the lock held.
+*/
+func (archival *ArchivalMemory) hybridScores(keywordScores map[int]float64, queryVector []float32) map[int]float64 {
+	weight := min(max(archival.SemanticWeight, 0), 1)
+
+	maxKeywordScore := 0.0
+	for _, score := range keywordScores {
+		maxKeywordScore = max(maxKeywordScore, score)
+	}
+
+	scores := make(map[int]float64, len(keywordScores))
+	for id, score := range keywordScores {
+		scores[id] = (1 - weight) * score / maxKeywordScore
+	}
+	for _, match := range archival.vectors.Search(queryVector, archival.MinSimilarity) {
+		scores[match.ID] += weight * match.Similarity
+	}
+	return scores
+}
+
+/*
+Searches archival memory for passages relevant to the query, optionally only considering passages that have every one of the given tags.
+Returns the given page (starting at 0) of the results, most relevant first, along with the total number of results.
+*/
+func (archival *ArchivalMemory) Search(ctx context.Context, query string, tags []string, page int) ([]ArchivalResult, int, error) {
+	var queryVector []float32
+	if archival.embedder != nil {
+		vectors, err := archival.embed(ctx, []string{query})
+		if err != nil {
+			return nil, 0, fmt.Errorf("error embedding query: %w", err)
+		}
+		queryVector = vectors[0]
+	}
+
+	archival.mu.RLock()
+	defer archival.mu.RUnlock()
+
+	scores := archival.bm25Scores(query)
+	if queryVector != nil {
+		scores = archival.hybridScores(scores, queryVector)
+	}
+
+	tags = normalizeTags(tags)
+	results := make([]ArchivalResult, 0)
+	for id, score := range scores {
+		passage := archival.passages[id-1]
+		if passage.hasTags(tags) {
+			results = append(results, ArchivalResult{Passage: passage, Score: score})
+		}
+	}
+
+	sortResults(results)
+	return paginate(results, page, ARCHIVAL_PAGE_SIZE), len(results), nil
+}
+
+/*
+Sorts results by descending score, breaking ties by showing the newest passage first
+*/
+func sortResults(results []ArchivalResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID > results[j].ID
+	})
+}
+
+/*
+Formats a page of archival memory search results for the Agent
+*/
+func formatArchivalResults(results []ArchivalResult, total int, page int) string {
+	if total == 0 {
+		return "No results found."
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("No results on page %d; there are %d results across %d pages (pages start at 0).", page, total, pageCount(total, ARCHIVAL_PAGE_SIZE))
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("Showing %d of %d results (page %d; there are %d pages, starting at page 0):\n", len(results), total, page, pageCount(total, ARCHIVAL_PAGE_SIZE)))
+	for _, result := range results {
+		builder.WriteString(fmt.Sprintf("[passage %d, %s", result.ID, result.Timestamp.Format(time.RFC3339)))
+		if len(result.Tags) > 0 {
+			builder.WriteString(fmt.Sprintf(", tags: %s", strings.Join(result.Tags, ", ")))
+		}
+		builder.WriteString(fmt.Sprintf(", relevance: %.2f] %s\n", result.Score, result.Text))
+	}
+	return builder.String()
+}
+
+/* Archival memory tools */
+
+func (llm *Agent) archivalSearch(ctx context.Context, query string, tags []string, page int, requestHeartbeat bool) (string, error) {
+	requestHeartbeatIf(ctx, requestHeartbeat)
+	if llm.ArchivalMemory == nil {
+		return formatArchivalResults(nil, 0, page), nil
+	}
+
+	results, total, err := llm.ArchivalMemory.Search(ctx, query, tags, page)
+	if err != nil {
+		return "", err
+	}
+	return formatArchivalResults(results, total, page), nil
+}
+
+func (llm *Agent) archivalInsert(ctx context.Context, newContent string, tags []string, requestHeartbeat bool) (string, error) {
+	requestHeartbeatIf(ctx, requestHeartbeat)
+	if strings.TrimSpace(newContent) == "" {
+		return "", fmt.Errorf("cannot insert an empty passage into archival memory")
+	}
+	if llm.ArchivalMemory == nil {
+		llm.ArchivalMemory = NewArchivalMemory()
+	}
+
+	passage, err := llm.ArchivalMemory.Insert(ctx, newContent, tags, llm.now())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Inserted passage %d into archival memory.", passage.ID), nil
+}
+
+type archivalMemoryInsertInput struct {
+	Content          string   `json:"content" description:"The text to store in archival memory. Write it so that it can be understood on its own, without the surrounding conversation, since it will be retrieved by searching for keywords."`
+	Tags             []string `json:"tags,omitempty" description:"Optional labels used to categorize the passage (e.g. \"recipe\", \"work\"), which can be used to filter searches."`
+	RequestHeartbeat bool     `json:"requestHeartbeat" description:"Set to 'true' to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to 'false' to end your execution now."`
+}
+
+func (llm *Agent) createArchivalMemoryInsertTool() *Tool {
+	tool := NewTool("archivalMemoryInsert",
+		"Add a passage to your archival memory, which has unlimited size but is not visible in your context window. "+
+			"Use this to store reflections, insights, documents or any other information that is worth keeping but does not fit in your core memory. "+
+			"The passage can later be retrieved with archivalMemorySearch.",
+		func(ctx context.Context, input archivalMemoryInsertInput) (string, error) {
+			return llm.archivalInsert(ctx, input.Content, input.Tags, input.RequestHeartbeat)
+		})
+	tool.Sequential = true
+	return tool
+}
+
+type archivalMemorySearchInput struct {
+	Query            string   `json:"query" description:"What to search for. Passages are ranked by how relevant they are to the query."`
+	Tags             []string `json:"tags,omitempty" description:"Optional labels; when provided, only passages that have all of these tags are returned."`
+	Page             int      `json:"page,omitempty" default:"0" description:"The page of results to return, starting at 0. Use this to see more results when a search returns more than one page."`
+	RequestHeartbeat bool     `json:"requestHeartbeat" description:"Set to 'true' to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to 'false' to end your execution now."`
+}
+
+func (llm *Agent) createArchivalMemorySearchTool() *Tool {
+	return NewTool("archivalMemorySearch",
+		"Search your archival memory for passages relevant to a query. "+
+			"Archival memory is not visible in your context window, so you must search it to see what it contains. "+
+			"Use this when you need information that you may have stored in the past but is not in your core memory. "+
+			fmt.Sprintf("Results are returned most relevant first, %d per page, with the ID, time of insertion and tags of each passage.", ARCHIVAL_PAGE_SIZE),
+		func(ctx context.Context, input archivalMemorySearchInput) (string, error) {
+			return llm.archivalSearch(ctx, input.Query, input.Tags, input.Page, input.RequestHeartbeat)
+		})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"The user's cat is named Miso.", []string{"user", "s", "cat", "named", "miso"}},
+		{"Flight LH-454 at 9:30", []string{"flight", "lh", "454", "9", "30"}},
+		{"the and of", []string{}},
+	}
+	for _, test := range tests {
+		if got := tokenize(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestArchivalSearchRanking(t *testing.T) {
+	ctx := context.Background()
+	archival := NewArchivalMemory()
+	passages := []struct {
+		text string
+		tags []string
+	}{
+		{"The user has a cat named Miso.", []string{"pets"}},
+		{"The user is allergic to cats and dogs, but keeps a cat anyway. The cat is called Miso and the cat likes tuna.", []string{"pets", "health"}},
+		{"The user's favorite drink is green tea.", []string{"food"}},
+		{"The user drinks tea every morning before work, usually green tea with honey, while reading the news and planning the day.", []string{"food"}},
+		{"The user works as a nurse.", nil},
+	}
+	for _, passage := range passages {
+		if _, err := archival.Insert(ctx, passage.text, passage.tags, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		tags  []string
+		want  []int // the IDs of the first results, most relevant first
+		total int
+	}{
+		{"term frequency raises the score", "cat", nil, []int{2, 1}, 2},
+		{"shorter passages rank higher for equal frequency", "green tea", nil, []int{3, 4}, 2},
+		{"rare terms weigh more than common ones", "user nurse", nil, []int{5}, 5},
+		{"stop words and punctuation are ignored", "the... NURSE!", nil, []int{5}, 1},
+		{"tags filter the results", "cat tea", []string{"food"}, []int{3, 4}, 2},
+		{"no matching terms", "spaceship", nil, []int{}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, total, err := archival.Search(ctx, test.query, test.tags, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int, 0, len(results))
+			for _, result := range results {
+				ids = append(ids, result.ID)
+			}
+			if total != test.total || len(ids) < len(test.want) || !reflect.DeepEqual(ids[:len(test.want)], test.want) {
+				t.Errorf("Search(%q) = %v (%d in total), want %v first (%d in total)", test.query, ids, total, test.want, test.total)
+			}
+		})
+	}
+}
+
+func TestBM25Scores(t *testing.T) {
+	archival := NewArchivalMemory()
+	for _, text := range []string{"apple banana", "apple cherry", "durian"} {
+		if _, err := archival.Insert(context.Background(), text, nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scores := archival.bm25Scores("apple banana")
+	if len(scores) != 2 {
+		t.Fatalf("bm25Scores returned scores for %d passages, want 2", len(scores))
+	}
+	if scores[1] <= scores[2] {
+		t.Errorf("the passage matching both terms scored %f, not more than the passage matching one (%f)", scores[1], scores[2])
+	}
+	// "banana" appears in one passage out of three, "apple" in two, so banana has the higher inverse document frequency
+	if banana, apple := scores[1]-scores[2], scores[2]; banana <= apple {
+		t.Errorf("the rarer term contributed %f, not more than the common term (%f)", banana, apple)
+	}
+}
+
+/*
+An Embedder that returns a fixed number of vectors, whatever it is asked to embed
+*/
+type countEmbedder struct {
+	vectors int
+}
+
+func (embedder countEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, embedder.vectors)
+	for i := range vectors {
+		vectors[i] = []float32{1, 0}
+	}
+	return vectors, nil
+}
+
+func TestArchivalEmbedderVectorCount(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		vectors int
+		wantErr bool
+	}{
+		{"one vector per text", 1, false},
+		{"no vectors", 0, true},
+		{"too many vectors", 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archival := NewArchivalMemoryWithEmbedder(countEmbedder{vectors: test.vectors})
+			_, err := archival.Insert(ctx, "The user has a cat.", nil, time.Now())
+			if (err != nil) != test.wantErr {
+				t.Errorf("Insert returned error %v, want an error: %v", err, test.wantErr)
+			}
+			_, _, err = archival.Search(ctx, "cat", nil, 0)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Search returned error %v, want an error: %v", err, test.wantErr)
+			}
+		})
+	}
+
+	archival := NewArchivalMemoryWithEmbedder(countEmbedder{vectors: 1})
+	records := []ArchivalRecord{{Passage: Passage{ID: 1, Text: "one"}}, {Passage: Passage{ID: 2, Text: "two"}}}
+	if err := archival.restore(ctx, records); err == nil {
+		t.Errorf("restore succeeded although the embedder returned 1 vector for 2 passages")
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Command line interface: the subcommands of the goldeneye binary and the options they share
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Model used by agents created from the command line when --model is not given
+const DEFAULT_CLI_MODEL string = "claude-3-5-haiku-latest"
+
+// Persona given to agents created from the command line when --persona is not given
+const DEFAULT_CLI_PERSONA string = "My name is Sam. I am curious, warm and direct, and I enjoy getting to know the people I talk to."
+
+// How long the serve command waits for requests in progress to finish when it is stopped
+const SERVER_SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
+
+/*
+A subcommand of the goldeneye binary
+*/
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands = []command{
+	{"chat", "Chat with an agent in the terminal", runChatCommand},
+	{"serve", "Serve agents over a REST API", runServeCommand},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: goldeneye <command> [options]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run \"goldeneye <command> -h\" for the options of a command.")
+}
+
+/*
+Options for finding, creating and serving agents, shared by the subcommands
+*/
+type agentOptions struct {
+	store    string // a directory of JSON files, or a SQLite database if the path ends in .db, .sqlite or .sqlite3
+	model    string
+	persona  string
+	provider string // "anthropic" or "openai"
+	baseURL  string // the base URL of an OpenAI-compatible API
+}
+
+func (options *agentOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.store, "store", defaultStorePath(),
+		"where agents are saved: a directory of JSON files, or a SQLite database if the path ends in .db, .sqlite or .sqlite3")
+	flags.StringVar(&options.model, "model", DEFAULT_CLI_MODEL, "the model used by new agents")
+	flags.StringVar(&options.persona, "persona", DEFAULT_CLI_PERSONA, "the persona of new agents")
+	flags.StringVar(&options.provider, "provider", "anthropic",
+		"the API that serves the agents: \"anthropic\" (uses ANTHROPIC_API_KEY) or \"openai\" (uses OPENAI_API_KEY, if set)")
+	flags.StringVar(&options.baseURL, "base-url", OPENAI_BASE_URL, "the base URL of the API when --provider is \"openai\"")
+}
+
+/*
+Returns $GOLDENEYE_STORE, or ~/.goldeneye/agents when it is not set
+*/
+func defaultStorePath() string {
+	if path, ok := os.LookupEnv("GOLDENEYE_STORE"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goldeneye", "agents")
+	}
+	return filepath.Join(home, ".goldeneye", "agents")
+}
+
+func (options agentOptions) openStore() (AgentStore, error) {
+	switch strings.ToLower(filepath.Ext(options.store)) {
+	case ".db", ".sqlite", ".sqlite3":
+		if err := os.MkdirAll(filepath.Dir(options.store), 0o755); err != nil {
+			return nil, fmt.Errorf("error creating agent store directory: %w", err)
+		}
+		return NewSQLiteStore(options.store)
+	default:
+		return NewJSONFileStore(options.store)
+	}
+}
+
+/*
+Returns the options used to restore saved agents, and to create the Provider of new ones
+*/
+func (options agentOptions) restoreOptions() (RestoreOptions, error) {
+	switch options.provider {
+	case "anthropic":
+		apiKey, ok := os.LookupEnv("ANTHROPIC_API_KEY")
+		if !ok {
+			return RestoreOptions{}, fmt.Errorf("the ANTHROPIC_API_KEY environment variable is not set")
+		}
+		return RestoreOptions{Provider: NewAnthropicProvider(apiKey), ApiKey: apiKey}, nil
+	case "openai":
+		return RestoreOptions{Provider: NewOpenAIProvider(options.baseURL, os.Getenv("OPENAI_API_KEY"))}, nil
+	default:
+		return RestoreOptions{}, fmt.Errorf("unknown provider %q; expected \"anthropic\" or \"openai\"", options.provider)
+	}
+}
+
+/*
+Loads the agent with the given name or ID from the store, or creates (and saves) a new agent with that name if there is none.
+Returns whether the agent was created.
+*/
+func (options agentOptions) loadOrCreateAgent(ctx context.Context, store AgentStore, name string) (*Agent, bool, error) {
+	restoreOptions, err := options.restoreOptions()
+	if err != nil {
+		return nil, false, err
+	}
+
+	agent, err := LoadAgent(ctx, store, name, restoreOptions)
+	if err == nil {
+		return agent, false, nil
+	}
+	if !errors.Is(err, ErrAgentNotFound) {
+		return nil, false, err
+	}
+
+	agent = NewAgentWithProvider(options.model, options.persona, name, restoreOptions.Provider)
+	agent.ApiKey = restoreOptions.ApiKey
+	if err := agent.Save(ctx, store); err != nil {
+		return nil, false, fmt.Errorf("error saving new agent %q: %w", name, err)
+	}
+	return agent, true, nil
+}
+
+func runServeCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var options agentOptions
+	options.register(flags)
+	addr := flags.String("addr", ":8080", "the address to listen on")
+	maxSteps := flags.Int("max-steps", DEFAULT_MAX_STEPS, "the maximum number of requests to the model per message")
+	heartbeat := flags.String("heartbeat", "",
+		"wake every agent on a schedule, given as an interval (e.g. \"1h\") or a cron expression (e.g. \"0 9 * * *\")")
+	quietHours := flags.String("quiet-hours", "", "a daily period in which agents are not woken, e.g. \"22:00-07:00\"")
+	heartbeatRuns := flags.Int("heartbeat-max-runs", 0, "the maximum number of heartbeats per agent per day (0 for no limit)")
+	heartbeatSteps := flags.Int("heartbeat-max-steps", 0, "the maximum number of requests to the model per agent per day in heartbeats (0 for no limit)")
+	messaging := flags.Bool("agent-messaging", false, "let the agents send messages to each other")
+	flags.Parse(args)
+
+	store, err := options.openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	restoreOptions, err := options.restoreOptions()
+	if err != nil {
+		return err
+	}
+	runOptions := DefaultRunOptions()
+	runOptions.MaxSteps = *maxSteps
+	serverOptions := ServerOptions{
+		Restore:    restoreOptions,
+		Model:      options.model,
+		Persona:    options.persona,
+		RunOptions: runOptions,
+	}
+	if *heartbeat != "" {
+		schedule, err := ParseSchedule(*heartbeat)
+		if err != nil {
+			return err
+		}
+		if schedule.Next(time.Now()).IsZero() {
+			return fmt.Errorf("the heartbeat schedule %q never wakes the agents", *heartbeat)
+		}
+		serverOptions.Scheduler = NewScheduler(nil)
+		serverOptions.Heartbeat = HeartbeatOptions{
+			Schedule:    schedule,
+			Budget:      HeartbeatBudget{MaxRuns: *heartbeatRuns, MaxSteps: *heartbeatSteps},
+			RunOptions:  runOptions,
+			OnHeartbeat: logHeartbeat,
+		}
+		if *quietHours != "" {
+			if serverOptions.Heartbeat.QuietHours, err = ParseQuietHours(*quietHours); err != nil {
+				return err
+			}
+		}
+	}
+	if *messaging {
+		serverOptions.Agents = NewAgentRegistry()
+		serverOptions.Agents.RunOptions = runOptions
+	}
+	server := NewServer(store, serverOptions)
+
+	httpServer := &http.Server{Addr: *addr, Handler: server.Handler()}
+	httpServer.RegisterOnShutdown(server.Close)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if serverOptions.Scheduler != nil {
+		if err := server.LoadAll(ctx); err != nil {
+			return err
+		}
+		go serverOptions.Scheduler.Run(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SERVER_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving agents from %s on %s\n", options.store, *addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func logHeartbeat(report HeartbeatReport) {
+	switch {
+	case report.Skipped != "":
+		log.Printf("heartbeat for agent %s skipped (%s)", report.AgentID, report.Skipped)
+	case report.Err != nil:
+		log.Printf("heartbeat for agent %s failed: %v", report.AgentID, report.Err)
+	default:
+		log.Printf("heartbeat for agent %s finished after %d steps (%s)", report.AgentID, report.Result.Steps, report.Result.Status)
+	}
+}
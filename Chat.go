@@ -0,0 +1,319 @@
+/*
+The chat command: an interactive conversation with an agent in the terminal
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Tool inputs and results longer than this are shortened when shown in verbose mode
+const CHAT_PREVIEW_LENGTH int = 300
+
+const CHAT_HELP string = `Commands:
+  /memory [label]  show core memory, or a single block of it
+  /tools           list the agent's tools
+  /reset           clear the conversation (memory is kept)
+  /save            save the agent
+  /verbose         toggle showing inner monologue and tool calls
+  /help            show this help
+  /quit            save the agent and exit`
+
+/*
+An interactive chat with a single agent
+*/
+type chatSession struct {
+	agent   *Agent
+	store   AgentStore
+	out     io.Writer
+	options RunOptions
+	verbose bool // whether to show the agent's inner monologue and tool calls, rather than only what it sends with sendMessage
+}
+
+func runChatCommand(args []string) error {
+	flags := flag.NewFlagSet("chat", flag.ExitOnError)
+	var options agentOptions
+	options.register(flags)
+	name := flags.String("agent", "assistant", "the name or ID of the agent to chat with; a new agent is created if none is saved under that name")
+	verbose := flags.Bool("verbose", false, "show the agent's inner monologue and tool calls")
+	maxSteps := flags.Int("max-steps", DEFAULT_MAX_STEPS, "the maximum number of requests to the model per message")
+	flags.Parse(args)
+
+	store, err := options.openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	agent, created, err := options.loadOrCreateAgent(context.Background(), store, *name)
+	if err != nil {
+		return err
+	}
+
+	runOptions := DefaultRunOptions()
+	runOptions.MaxSteps = *maxSteps
+	session := &chatSession{agent: agent, store: store, out: os.Stdout, options: runOptions, verbose: *verbose}
+	agent.Output = &WriterSink{Writer: session.out}
+
+	if created {
+		fmt.Fprintf(session.out, "Created agent %q (%s).\n", agent.Name, agent.Model)
+	} else {
+		fmt.Fprintf(session.out, "Loaded agent %q (%s), %d messages in its history.\n", agent.Name, agent.Model, agent.RecallMemory.Len())
+	}
+	fmt.Fprintln(session.out, "Type a message to chat, or /help for commands. Press Ctrl+D to exit.")
+
+	return session.loop(newLineReader(os.Stdin, os.Stdout, "> "))
+}
+
+/*
+Reads lines and handles them until the input ends or the user quits, then saves the agent
+*/
+func (session *chatSession) loop(reader lineReader) error {
+	defer reader.Close()
+	for {
+		line, err := reader.ReadLine()
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(session.out)
+			return session.save()
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case line == "/quit" || line == "/exit":
+			return session.save()
+		case strings.HasPrefix(line, "/"):
+			session.handleCommand(line)
+		default:
+			session.send(line)
+		}
+	}
+}
+
+func (session *chatSession) save() error {
+	if err := session.agent.Save(context.Background(), session.store); err != nil {
+		return fmt.Errorf("error saving agent %q: %w", session.agent.Name, err)
+	}
+	return nil
+}
+
+func (session *chatSession) handleCommand(line string) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/help":
+		fmt.Fprintln(session.out, CHAT_HELP)
+	case "/memory":
+		session.showMemory(fields[1:])
+	case "/tools":
+		for _, tool := range session.agent.Tools {
+			description, _, _ := strings.Cut(tool.Description, "\n")
+			fmt.Fprintf(session.out, "  %-24s %s\n", tool.Name, description)
+		}
+	case "/reset":
+		session.agent.ChatHistory = make([]Message, 0)
+		session.agent.contextWarningGiven = false
+		fmt.Fprintln(session.out, "Conversation cleared. Core, recall and archival memory are unchanged.")
+	case "/save":
+		if err := session.save(); err != nil {
+			fmt.Fprintf(session.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(session.out, "Saved agent %q.\n", session.agent.Name)
+	case "/verbose":
+		session.verbose = !session.verbose
+		fmt.Fprintf(session.out, "Verbose mode %s.\n", map[bool]string{true: "on", false: "off"}[session.verbose])
+	default:
+		fmt.Fprintf(session.out, "Unknown command %s.\n%s\n", fields[0], CHAT_HELP)
+	}
+}
+
+func (session *chatSession) showMemory(labels []string) {
+	coreMemory := session.agent.CoreMemory
+	if len(labels) == 0 {
+		labels = coreMemory.labels(false)
+	}
+	for _, label := range labels {
+		block, ok := coreMemory.Blocks[label]
+		if !ok {
+			fmt.Fprintln(session.out, coreMemory.unknownSectionError(label))
+			continue
+		}
+		header := fmt.Sprintf("%s (%d characters", label, utf8.RuneCountInString(block.data))
+		if block.size > 0 {
+			header += fmt.Sprintf(" of %d", block.size)
+		}
+		if block.readOnly {
+			header += ", read-only"
+		}
+		fmt.Fprintf(session.out, "== %s) ==\n%s\n\n", header, block.data)
+	}
+}
+
+/*
+Sends the user's message to the agent and shows the agent's replies.
+Ctrl+C cancels the run without leaving the chat.
+*/
+func (session *chatSession) send(text string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	session.agent.OnEvent = nil
+	if session.verbose {
+		session.agent.OnEvent = session.showEvent
+	}
+
+	result, err := session.agent.HandleEvent(ctx, UserMessage{Text: text}, session.options)
+	if !session.hasSendMessage() {
+		session.showText(result)
+	}
+
+	switch {
+	case result.Status == RUN_STATUS_CANCELLED:
+		fmt.Fprintln(session.out, "(cancelled)")
+	case err != nil:
+		fmt.Fprintf(session.out, "Error: %v\n", err)
+	case result.Status == RUN_STATUS_MAX_STEPS:
+		fmt.Fprintf(session.out, "(stopped after %d steps)\n", result.Steps)
+	}
+}
+
+/*
+Shows what the agent does as it happens, in verbose mode: its inner monologue, tool calls and memory edits.
+Messages sent with sendMessage are shown by the agent's Output instead.
+*/
+func (session *chatSession) showEvent(event AgentEvent) {
+	switch {
+	case event.Type == AGENT_EVENT_MONOLOGUE && session.hasSendMessage():
+		fmt.Fprintf(session.out, "  (thinking) %s\n", strings.TrimSpace(event.Text))
+	case event.Type == AGENT_EVENT_TOOL_USE_START && event.ToolName != "sendMessage":
+		input, _ := json.Marshal(event.Input)
+		fmt.Fprintf(session.out, "  (tool) %s %s\n", event.ToolName, truncate(string(input), CHAT_PREVIEW_LENGTH))
+	case event.Type == AGENT_EVENT_TOOL_USE_END && event.ToolName != "sendMessage":
+		label := "result"
+		if event.IsError {
+			label = "error"
+		}
+		fmt.Fprintf(session.out, "  (%s) %s\n", label, truncate(event.Result, CHAT_PREVIEW_LENGTH))
+	case event.Type == AGENT_EVENT_MEMORY_EDIT:
+		fmt.Fprintf(session.out, "  (memory) %s block %q, now at version %d\n", event.MemoryEdit.Operation, event.MemoryEdit.Block, event.MemoryEdit.Version)
+	case event.Type == AGENT_EVENT_HEARTBEAT:
+		fmt.Fprintln(session.out, "  (heartbeat)")
+	}
+}
+
+/*
+Shows the text of the responses from a run as messages from the agent.
+Used for agents that were saved without a sendMessage tool, which can only reply with text.
+*/
+func (session *chatSession) showText(result *RunResult) {
+	for _, response := range result.Responses {
+		for _, content := range response.Content {
+			if content.Type == "text" {
+				fmt.Fprintf(session.out, "%s: %s\n", session.agent.Name, strings.TrimSpace(content.Text))
+			}
+		}
+	}
+}
+
+func (session *chatSession) hasSendMessage() bool {
+	_, ok := session.agent.toolMap()["sendMessage"]
+	return ok
+}
+
+/*
+Collapses the whitespace in the text and shortens it to at most length characters, followed by "..." if it was cut
+*/
+func truncate(text string, length int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length]) + "..."
+}
+
+/*
+A source of lines of user input
+*/
+type lineReader interface {
+	// Returns the next line, or io.EOF when the input ends
+	ReadLine() (string, error)
+	Close() error
+}
+
+/*
+Returns a lineReader with line editing and history when the input is a terminal, or one that reads plain lines otherwise
+*/
+func newLineReader(in *os.File, out *os.File, prompt string) lineReader {
+	if !term.IsTerminal(int(in.Fd())) {
+		return &plainLineReader{scanner: bufio.NewScanner(in)}
+	}
+	return &terminalLineReader{
+		fd: int(in.Fd()),
+		terminal: term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{in, out}, prompt),
+	}
+}
+
+type plainLineReader struct {
+	scanner *bufio.Scanner
+}
+
+func (reader *plainLineReader) ReadLine() (string, error) {
+	if !reader.scanner.Scan() {
+		if err := reader.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return reader.scanner.Text(), nil
+}
+
+func (reader *plainLineReader) Close() error {
+	return nil
+}
+
+/*
+Reads lines from a terminal with line editing and history (up and down arrows).
+The terminal is only in raw mode while a line is being read, so that output and Ctrl+C behave normally while the agent runs.
+*/
+type terminalLineReader struct {
+	fd       int
+	terminal *term.Terminal
+}
+
+func (reader *terminalLineReader) ReadLine() (string, error) {
+	state, err := term.MakeRaw(reader.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(reader.fd, state)
+
+	if width, height, err := term.GetSize(reader.fd); err == nil {
+		reader.terminal.SetSize(width, height)
+	}
+	return reader.terminal.ReadLine()
+}
+
+func (reader *terminalLineReader) Close() error {
+	return nil
+}
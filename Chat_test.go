@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestChatSession(t *testing.T) {
+	store, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := NewAgentWithProvider("test-model", "A helpful assistant.", "tester", &fakeProvider{responses: []AgentResponse{
+		toolUseResponse("call_1", "sendMessage", map[string]any{"message": "Hi there!"}),
+	}})
+	var out strings.Builder
+	agent.Output = &WriterSink{Writer: &out}
+	session := &chatSession{agent: agent, store: store, out: &out, options: DefaultRunOptions()}
+
+	input := "Hello\n\n/memory Diary\n/verbose\n/nope\n/reset\n/quit\nnot sent\n"
+	if err := session.loop(&plainLineReader{scanner: bufio.NewScanner(strings.NewReader(input))}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"tester: Hi there!\n",
+		`section "Diary" does not exist in core memory`,
+		"Verbose mode on.\n",
+		"Unknown command /nope.\n",
+		"Conversation cleared.",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the output does not contain %q:\n%s", want, out.String())
+		}
+	}
+	if len(agent.ChatHistory) != 0 || agent.RecallMemory.Len() != 4 {
+		t.Errorf("after /reset the chat history has %d messages and recall memory %d, want 0 and 4", len(agent.ChatHistory), agent.RecallMemory.Len())
+	}
+
+	// quitting saves the agent
+	state, err := store.Load(context.Background(), "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.RecallMemory) != 4 {
+		t.Errorf("the saved agent has %d messages in recall memory, want 4", len(state.RecallMemory))
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text   string
+		length int
+		want   string
+	}{
+		{"short", 10, "short"},
+		{"exactly ten", 11, "exactly ten"},
+		{"a  longer\ttext\nwith whitespace", 8, "a longer..."},
+		{"héllo wörld", 5, "héllo..."},
+		{"日本語のテキスト", 3, "日本語..."},
+	}
+	for _, test := range tests {
+		if got := truncate(test.text, test.length); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.text, test.length, got, test.want)
+		}
+	}
+}
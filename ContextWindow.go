@@ -0,0 +1,295 @@
+/*
+Context window management: keeping the chat history within the model's context window by warning the Agent as it fills up,
+then removing the oldest messages and replacing them with a summary written by the model.
+Removed messages remain available in recall memory.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Context window used for models that are not listed in modelContextWindows
+const DEFAULT_CONTEXT_WINDOW int = 8192
+
+/*
+Default thresholds, as fractions of the context window.
+A warning is given to the Agent once the context reaches DEFAULT_WARNING_THRESHOLD; once it reaches DEFAULT_FLUSH_THRESHOLD,
+the oldest messages are summarized and removed until the context is back under DEFAULT_FLUSH_TARGET.
+*/
+const DEFAULT_WARNING_THRESHOLD float64 = 0.75
+const DEFAULT_FLUSH_THRESHOLD float64 = 0.9
+const DEFAULT_FLUSH_TARGET float64 = 0.5
+
+// The maximum number of tokens the model may generate when summarizing the removed messages
+const DEFAULT_SUMMARY_MAX_TOKENS int = 1024
+
+/*
+Context window sizes (in tokens) of known models, matched by prefix.
+More specific prefixes are listed before the prefixes that contain them.
+*/
+var modelContextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"claude-", 200000},
+	{"gpt-4.1", 1047576},
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo", 16385},
+	{"o1", 200000},
+	{"o3", 200000},
+	{"o4", 200000},
+	{"llama3.1", 131072},
+	{"llama3.2", 131072},
+	{"llama3", 8192},
+	{"mistral", 32768},
+	{"qwen2.5", 32768},
+}
+
+/*
+Returns the context window size of the model, or DEFAULT_CONTEXT_WINDOW if the model is not known
+*/
+func contextWindowSize(model string) int {
+	model = strings.ToLower(model)
+	for _, window := range modelContextWindows {
+		if strings.HasPrefix(model, window.prefix) {
+			return window.tokens
+		}
+	}
+	return DEFAULT_CONTEXT_WINDOW
+}
+
+/*
+Controls how an Agent's context window is managed.
+The zero value uses the context window of the Agent's model and the DEFAULT_* thresholds.
+The options are saved along with the Agent.
+*/
+type ContextWindowOptions struct {
+	Size             int     `json:"size,omitempty"`             // the context window in tokens; 0 looks up the size for the Agent's model
+	WarningThreshold float64 `json:"warningThreshold,omitempty"` // the fraction of the context window at which the Agent is warned to save its memories
+	FlushThreshold   float64 `json:"flushThreshold,omitempty"`   // the fraction of the context window at which the oldest messages are summarized and removed
+	FlushTarget      float64 `json:"flushTarget,omitempty"`      // the fraction of the context window to bring the context down to when flushing
+	SummaryMaxTokens int     `json:"summaryMaxTokens,omitempty"` // the maximum number of tokens for the model to generate when writing the summary
+	/*
+		Counts tokens with the Provider's CountTokens instead of estimating them locally.
+		Exact, but costs an extra request to the API per step for Providers that count tokens remotely.
+	*/
+	ExactTokenCount bool `json:"exactTokenCount,omitempty"`
+	Disabled        bool `json:"disabled,omitempty"` // turns context window management off entirely
+}
+
+/*
+Returns the options with defaults filled in for the unset fields
+*/
+func (options ContextWindowOptions) withDefaults(model string) ContextWindowOptions {
+	if options.Size <= 0 {
+		options.Size = contextWindowSize(model)
+	}
+	if options.WarningThreshold <= 0 {
+		options.WarningThreshold = DEFAULT_WARNING_THRESHOLD
+	}
+	if options.FlushThreshold <= 0 {
+		options.FlushThreshold = DEFAULT_FLUSH_THRESHOLD
+	}
+	if options.FlushTarget <= 0 {
+		options.FlushTarget = DEFAULT_FLUSH_TARGET
+	}
+	if options.SummaryMaxTokens <= 0 {
+		options.SummaryMaxTokens = DEFAULT_SUMMARY_MAX_TOKENS
+	}
+	return options
+}
+
+/*
+Returns the number of tokens that the next request would use, including the tokens reserved for the response
+*/
+func (llm *Agent) ContextTokens(ctx context.Context, options RunOptions) (int, error) {
+	return llm.countTokens(ctx, *llm.NewAgentRequest(options.MaxTokens, options.Temperature), options.MaxTokens)
+}
+
+func (llm *Agent) countTokens(ctx context.Context, request AgentRequest, maxTokens int) (int, error) {
+	if !llm.ContextWindow.ExactTokenCount {
+		return estimateTokens(request) + maxTokens, nil
+	}
+	tokens, err := llm.provider().CountTokens(ctx, request)
+	if err != nil {
+		return 0, fmt.Errorf("error counting tokens: %w", err)
+	}
+	return tokens + maxTokens, nil
+}
+
+/*
+Checks how full the context window is before a request is made.
+Warns the Agent once the warning threshold is reached, and summarizes and removes the oldest messages once the flush threshold is reached.
+*/
+func (llm *Agent) manageContextWindow(ctx context.Context, options RunOptions) error {
+	windowOptions := llm.ContextWindow.withDefaults(llm.Model)
+	if windowOptions.Disabled {
+		return nil
+	}
+
+	tokens, err := llm.ContextTokens(ctx, options)
+	if err != nil {
+		return err
+	}
+	usage := float64(tokens) / float64(windowOptions.Size)
+
+	if usage >= windowOptions.FlushThreshold {
+		target := int(windowOptions.FlushTarget * float64(windowOptions.Size))
+		return llm.flushMemory(ctx, options, tokens, target)
+	}
+	if usage >= windowOptions.WarningThreshold && !llm.contextWarningGiven {
+		llm.addContextWarningToChatHistory(usage)
+		llm.contextWarningGiven = true
+	}
+	return nil
+}
+
+/*
+Tells the Agent that its context window is filling up, so that it can save anything important before older messages are removed
+*/
+func (llm *Agent) addContextWarningToChatHistory(usage float64) {
+	llm.addUserContentToChatHistory(Content{Type: "text", Text: fmt.Sprintf(
+		"[system] Memory pressure warning: the conversation is using %.0f%% of your context window. "+
+			"Older messages will soon be removed from your context and replaced by a summary. "+
+			"Save any important information that is not yet in your core memory (coreMemoryAppend, coreMemoryReplace) or archival memory (archivalMemoryInsert) now.",
+		usage*100)})
+}
+
+/*
+Removes the oldest messages from the chat history and replaces them with a summary written by the model (recursive summarization).
+Messages are removed until the context is estimated to fit within the target number of tokens, or as many as possible otherwise.
+The chat history is only ever cut right before an assistant message, so that every tool_result stays with its tool_use
+and the summary (a user message) is followed by an assistant message.
+*/
+func (llm *Agent) flushMemory(ctx context.Context, options RunOptions, tokens int, target int) error {
+	// tokens may be an exact count, so the estimates of the removed messages are scaled to it to keep both in the same measure
+	scale := 1.0
+	if estimated := estimateTokens(*llm.NewAgentRequest(options.MaxTokens, options.Temperature)); estimated > 0 {
+		scale = float64(tokens-options.MaxTokens) / float64(estimated)
+	}
+
+	cut := -1
+	for i := 1; i < len(llm.ChatHistory); i++ {
+		if llm.ChatHistory[i].Role != "assistant" {
+			continue
+		}
+		// the last user message must stay, since it is the one the Agent is responding to
+		if i == len(llm.ChatHistory)-1 {
+			break
+		}
+		cut = i
+
+		removed := 0
+		for _, message := range llm.ChatHistory[:i] {
+			removed += messageTokens(message)
+		}
+		// the summary takes up some of the space that is freed
+		if tokens-int(float64(removed)*scale)+llm.ContextWindow.withDefaults(llm.Model).SummaryMaxTokens <= target {
+			break
+		}
+	}
+	if cut < 0 {
+		return fmt.Errorf("context window is full, but the chat history has no messages that can be removed")
+	}
+
+	summary, err := llm.summarizeMessages(ctx, options, llm.ChatHistory[:cut])
+	if err != nil {
+		return fmt.Errorf("error summarizing messages to free up the context window: %w", err)
+	}
+
+	summaryMessage := Message{Role: "user", Content: []Content{{Type: "text", Text: fmt.Sprintf(
+		"[summary] %d earlier messages were removed from your context window to free up space. "+
+			"They can still be found with conversationSearch. Summary of the removed messages:\n%s",
+		cut, summary)}}}
+	llm.recallOutOfContext = llm.evictedRecallEntries(llm.ChatHistory[:cut])
+	llm.ChatHistory = append([]Message{summaryMessage}, llm.ChatHistory[cut:]...)
+	llm.contextWarningGiven = false
+	return nil
+}
+
+/*
+Returns the number of recall memory entries that are out of context once the messages are removed from the start of the chat history.
+Recall memory stores the messages in order, but content merged into the last user message is stored as an entry of its own,
+so the entries are matched to the removed messages by their number of content blocks.
+*/
+func (llm *Agent) evictedRecallEntries(removed []Message) int {
+	if llm.RecallMemory == nil {
+		return 0
+	}
+	contents := 0
+	for _, message := range removed {
+		// summaries of earlier removals are not stored in recall memory
+		if isSummaryMessage(message) {
+			continue
+		}
+		contents += len(message.Content)
+	}
+
+	entries := llm.RecallMemory.Entries()
+	evicted := min(llm.recallOutOfContext, len(entries))
+	for contents > 0 && evicted < len(entries) {
+		contents -= len(entries[evicted].Message.Content)
+		evicted++
+	}
+	return evicted
+}
+
+/*
+Returns whether the message is the summary that replaces the messages removed from the chat history
+*/
+func isSummaryMessage(message Message) bool {
+	return len(message.Content) > 0 && strings.HasPrefix(message.Content[0].Text, "[summary]")
+}
+
+/*
+Estimates the number of tokens used by a single message
+*/
+func messageTokens(message Message) int {
+	chars := 0
+	for _, content := range message.Content {
+		chars += contentLength(content)
+	}
+	return (chars + 3) / 4
+}
+
+/*
+Asks the model to summarize the messages
+*/
+func (llm *Agent) summarizeMessages(ctx context.Context, options RunOptions, messages []Message) (string, error) {
+	var transcript strings.Builder
+	for _, message := range messages {
+		transcript.WriteString(fmt.Sprintf("%s: %s\n\n", message.Role, messageText(message)))
+	}
+
+	request := AgentRequest{
+		Model:     llm.Model,
+		MaxTokens: llm.ContextWindow.withDefaults(llm.Model).SummaryMaxTokens,
+		System:    []Content{{Type: "text", Text: SUMMARY_PROMPT}},
+		Messages: []Message{{Role: "user", Content: []Content{{Type: "text", Text: fmt.Sprintf(
+			"Summarize the following conversation history:\n\n%s", transcript.String())}}}},
+		Temperature: options.Temperature,
+	}
+
+	requestCtx := ctx
+	if options.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(ctx, options.RequestTimeout)
+		defer cancel()
+	}
+	response, _, err := llm.call(requestCtx, request)
+	if err != nil {
+		return "", err
+	}
+
+	summary := strings.TrimSpace(response.getOutput())
+	if summary == "" {
+		return "", fmt.Errorf("the model returned an empty summary")
+	}
+	return summary, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestContextWarning(t *testing.T) {
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.AddUserMessage("Hello")
+	recalled := agent.RecallMemory.Len()
+
+	agent.addContextWarningToChatHistory(0.8)
+	if len(agent.ChatHistory) != 1 || len(agent.ChatHistory[0].Content) != 2 {
+		t.Fatalf("the warning was not added to the last user message: %+v", agent.ChatHistory)
+	}
+	if !strings.Contains(agent.ChatHistory[0].Content[1].Text, "80% of your context window") {
+		t.Errorf("the warning is %q", agent.ChatHistory[0].Content[1].Text)
+	}
+	if agent.RecallMemory.Len() != recalled+1 {
+		t.Errorf("the warning was not stored in recall memory")
+	}
+}
+
+func TestManageContextWindow(t *testing.T) {
+	long := strings.Repeat("word ", 1000) // about 1250 estimated tokens
+	tests := []struct {
+		name    string
+		usage   float64 // how full the context window is, which sets its size
+		exact   bool
+		flushed bool
+		warned  bool
+	}{
+		{name: "plenty of room", usage: 0.5},
+		{name: "warning", usage: 0.8, warned: true},
+		{name: "flush", usage: 0.95, flushed: true},
+		{name: "flush with exact counts", usage: 0.95, exact: true, flushed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent, _ := newTestAgent(&fakeProvider{})
+			for i := 0; i < 8; i++ {
+				agent.AddUserMessage(long)
+				agent.addResponseToChatHistory(AgentResponse{Role: "assistant", Content: []Content{{Type: "text", Text: long}}})
+			}
+			agent.AddUserMessage("And now?")
+			before := len(agent.ChatHistory)
+
+			options := DefaultRunOptions()
+			options.MaxTokens = 200
+			tokens, err := agent.ContextTokens(context.Background(), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := int(float64(tokens) / test.usage)
+			agent.ContextWindow = ContextWindowOptions{Size: size, ExactTokenCount: test.exact, SummaryMaxTokens: 100}
+			if err := agent.manageContextWindow(context.Background(), options); err != nil {
+				t.Fatal(err)
+			}
+
+			flushed := strings.HasPrefix(agent.ChatHistory[0].Content[0].Text, "[summary]")
+			if flushed != test.flushed {
+				t.Fatalf("flushed = %v, want %v", flushed, test.flushed)
+			}
+			if flushed {
+				if len(agent.ChatHistory) >= before || agent.ChatHistory[1].Role != "assistant" {
+					t.Errorf("the flushed chat history has %d messages, starting with %s after the summary", len(agent.ChatHistory), agent.ChatHistory[1].Role)
+				}
+				tokens, err := agent.ContextTokens(context.Background(), options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tokens > size/2 {
+					t.Errorf("the context still uses %d of %d tokens after the flush", tokens, size)
+				}
+			}
+			if agent.contextWarningGiven != test.warned {
+				t.Errorf("warned = %v, want %v", agent.contextWarningGiven, test.warned)
+			}
+		})
+	}
+}
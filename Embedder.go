@@ -0,0 +1,289 @@
+/*
+Embedders turn text into vectors, which archival memory uses to retrieve passages by meaning rather than by keywords
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Converts text into embedding vectors, such that texts with similar meanings have similar vectors
+*/
+type Embedder interface {
+	// Returns one vector per text, in the same order as the texts
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+const DEFAULT_HASH_EMBEDDER_DIMENSIONS int = 256
+
+/*
+A deterministic Embedder that runs fully offline.
+Each text is split into words and character n-grams, which are hashed into the dimensions of the vector (the "hashing trick").
+Texts that share words or parts of words get similar vectors, so this captures spelling variations (e.g. "recipe" and "recipes") but not synonyms.
+Useful for tests and for running without access to an embedding model.
+*/
+type HashEmbedder struct {
+	Dimensions int // the length of the vectors; defaults to DEFAULT_HASH_EMBEDDER_DIMENSIONS
+	NGramSize  int // the length of the character n-grams; defaults to 3
+}
+
+func NewHashEmbedder(dimensions int) *HashEmbedder {
+	return &HashEmbedder{Dimensions: dimensions, NGramSize: 3}
+}
+
+func (embedder HashEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = embedder.embedText(text)
+	}
+	return vectors, nil
+}
+
+func (embedder HashEmbedder) embedText(text string) []float32 {
+	dimensions := embedder.Dimensions
+	if dimensions <= 0 {
+		dimensions = DEFAULT_HASH_EMBEDDER_DIMENSIONS
+	}
+	size := embedder.NGramSize
+	if size <= 0 {
+		size = 3
+	}
+
+	vector := make([]float32, dimensions)
+	for _, term := range tokenize(text) {
+		// whole words carry more meaning than the n-grams within them
+		addHashedFeature(vector, "w:"+term, 2)
+
+		padded := []rune(" " + term + " ")
+		for start := 0; start+size <= len(padded); start++ {
+			addHashedFeature(vector, "n:"+string(padded[start:start+size]), 1)
+		}
+	}
+	normalizeVector(vector)
+	return vector
+}
+
+/*
+Adds a feature to the vector, using its hash to choose both the dimension and the sign.
+The random sign keeps features that collide in the same dimension from always adding up.
+*/
+func addHashedFeature(vector []float32, feature string, weight float32) {
+	hash := fnv.New64a()
+	hash.Write([]byte(feature))
+	sum := hash.Sum64()
+
+	index := sum % uint64(len(vector))
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[index] += weight
+}
+
+/*
+Scales the vector to a length of 1, so that the dot product of two vectors is their cosine similarity
+*/
+func normalizeVector(vector []float32) {
+	var sumOfSquares float64
+	for _, value := range vector {
+		sumOfSquares += float64(value) * float64(value)
+	}
+	if sumOfSquares == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sumOfSquares))
+	for i := range vector {
+		vector[i] /= norm
+	}
+}
+
+/*
+Embedder for OpenAI-compatible embeddings APIs.
+Besides OpenAI itself, this covers local model servers that expose the same API, such as Ollama, vLLM and llama.cpp.
+*/
+type HTTPEmbedder struct {
+	/*
+		The base URL of the API, including the version prefix.
+		E.g. "https://api.openai.com/v1" or "http://localhost:11434/v1" (Ollama)
+	*/
+	BaseURL string
+	// The embedding model to use, e.g. "text-embedding-3-small" or "nomic-embed-text"
+	Model string
+	// Sent as a bearer token; local servers usually do not require one
+	ApiKey string
+	// The client used to send requests; defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// How failed requests are retried; the zero value disables retries
+	RetryPolicy RetryPolicy
+	// Limits the rate at which requests are sent; nil disables client-side rate limiting
+	RateLimiter *RateLimiter
+}
+
+/*
+Creates an Embedder that sends requests to the embeddings API at the given base URL.
+The apiKey argument is optional.
+Failed requests are retried with the DefaultRetryPolicy.
+*/
+func NewHTTPEmbedder(baseURL string, model string, apiKey ...string) *HTTPEmbedder {
+	embedder := &HTTPEmbedder{BaseURL: baseURL, Model: model, RetryPolicy: DefaultRetryPolicy()}
+	if len(apiKey) > 0 {
+		embedder.ApiKey = apiKey[0]
+	}
+	return embedder
+}
+
+type embeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func (embedder HTTPEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+
+	reqBody, err := json.Marshal(embeddingsRequest{Model: embedder.Model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := embedder.BaseURL
+	if baseURL == "" {
+		baseURL = OPENAI_BASE_URL
+	}
+	url := strings.TrimSuffix(baseURL, "/") + "/embeddings"
+
+	res, err := sendWithRetry(ctx, embedder.HTTPClient, embedder.RetryPolicy, embedder.RateLimiter, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("content-type", "application/json")
+		if embedder.ApiKey != "" {
+			req.Header.Set("authorization", "Bearer "+embedder.ApiKey)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response embeddingsResponse
+	if err := json.Unmarshal(resBody, &response); err != nil {
+		return nil, fmt.Errorf("error parsing the embeddings response: %w", err)
+	}
+
+	// the API may return the embeddings in any order
+	vectors := make([][]float32, len(texts))
+	for _, data := range response.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, fmt.Errorf("embeddings response contains an out of range index %d", data.Index)
+		}
+		vectors[data.Index] = data.Embedding
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, fmt.Errorf("embeddings response is missing the embedding for input %d", i)
+		}
+		normalizeVector(vector)
+	}
+	return vectors, nil
+}
+
+/*
+A similarity score for a single vector in a VectorIndex
+*/
+type VectorMatch struct {
+	ID         int
+	Similarity float64
+}
+
+/*
+In-process flat vector index.
+Compares the query against every stored vector, which is exact and fast enough for the size of an agent's archival memory.
+Vectors are expected to be normalized, so that cosine similarity is their dot product.
+*/
+type VectorIndex struct {
+	mu      sync.RWMutex
+	vectors map[int][]float32
+}
+
+func NewVectorIndex() *VectorIndex {
+	return &VectorIndex{vectors: make(map[int][]float32)}
+}
+
+func (index *VectorIndex) Add(id int, vector []float32) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.vectors[id] = vector
+}
+
+func (index *VectorIndex) Get(id int) ([]float32, bool) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	vector, ok := index.vectors[id]
+	return vector, ok
+}
+
+func (index *VectorIndex) Len() int {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return len(index.vectors)
+}
+
+/*
+Returns every vector with a cosine similarity to the query of at least minSimilarity, most similar first
+*/
+func (index *VectorIndex) Search(query []float32, minSimilarity float64) []VectorMatch {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	matches := make([]VectorMatch, 0)
+	for id, vector := range index.vectors {
+		similarity := dotProduct(query, vector)
+		if similarity >= minSimilarity {
+			matches = append(matches, VectorMatch{ID: id, Similarity: similarity})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Similarity != matches[j].Similarity {
+			return matches[i].Similarity > matches[j].Similarity
+		}
+		return matches[i].ID > matches[j].ID
+	})
+	return matches
+}
+
+/*
+Returns the dot product of two vectors, ignoring any dimensions that only one of them has
+*/
+func dotProduct(a []float32, b []float32) float64 {
+	var sum float64
+	for i := range min(len(a), len(b)) {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashEmbedder(t *testing.T) {
+	embedder := NewHashEmbedder(0)
+	vectors, err := embedder.Embed(context.Background(), []string{"pasta recipe", "pasta recipes", "airplane engine", "pasta recipe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != 4 || len(vectors[0]) != DEFAULT_HASH_EMBEDDER_DIMENSIONS {
+		t.Fatalf("Embed returned %d vectors of length %d, want 4 of length %d", len(vectors), len(vectors[0]), DEFAULT_HASH_EMBEDDER_DIMENSIONS)
+	}
+	if length := math.Sqrt(dotProduct(vectors[0], vectors[0])); math.Abs(length-1) > 1e-6 {
+		t.Errorf("the vectors have length %f, want 1", length)
+	}
+	if !reflect.DeepEqual(vectors[0], vectors[3]) {
+		t.Error("the same text was embedded as different vectors")
+	}
+	if similar, unrelated := dotProduct(vectors[0], vectors[1]), dotProduct(vectors[0], vectors[2]); similar <= unrelated {
+		t.Errorf("\"pasta recipe\" is no closer to \"pasta recipes\" (%f) than to \"airplane engine\" (%f)", similar, unrelated)
+	}
+}
+
+func TestHTTPEmbedder(t *testing.T) {
+	var request embeddingsRequest
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			http.NotFound(w, r)
+			return
+		}
+		authorization = r.Header.Get("authorization")
+		json.NewDecoder(r.Body).Decode(&request)
+		// the embeddings are returned out of order and unnormalized
+		w.Write([]byte(`{"data": [{"index": 1, "embedding": [0, 2]}, {"index": 0, "embedding": [3, 4]}]}`))
+	}))
+	defer server.Close()
+
+	embedder := NewHTTPEmbedder(server.URL+"/v1/", "nomic-embed-text", "secret")
+	vectors, err := embedder.Embed(context.Background(), []string{"first", "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]float32{{0.6, 0.8}, {0, 1}}; !reflect.DeepEqual(vectors, want) {
+		t.Errorf("Embed = %v, want %v", vectors, want)
+	}
+	if request.Model != "nomic-embed-text" || !reflect.DeepEqual(request.Input, []string{"first", "second"}) || authorization != "Bearer secret" {
+		t.Errorf("the server received %+v with authorization %q", request, authorization)
+	}
+
+	vectors, err = embedder.Embed(context.Background(), []string{"first", "second", "third"})
+	if err == nil || !strings.Contains(err.Error(), "missing the embedding for input 2") {
+		t.Errorf("Embed returned %v, %v for a response missing an embedding", vectors, err)
+	}
+}
+
+func TestVectorIndexSearch(t *testing.T) {
+	index := NewVectorIndex()
+	index.Add(1, []float32{1, 0})
+	index.Add(2, []float32{0.6, 0.8})
+	index.Add(3, []float32{0, 1})
+	index.Add(4, []float32{1, 0})
+
+	want := []VectorMatch{{ID: 4, Similarity: 1}, {ID: 1, Similarity: 1}, {ID: 2, Similarity: float64(float32(0.6))}}
+	if got := index.Search([]float32{1, 0}, 0.5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Search = %v, want %v", got, want)
+	}
+}
+
+/*
+An Embedder that embeds each known text as a fixed vector, and every other text as the zero vector
+*/
+type mapEmbedder map[string][]float32
+
+func (embedder mapEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = embedder[text]
+		if vectors[i] == nil {
+			vectors[i] = []float32{0, 0, 0}
+		}
+	}
+	return vectors, nil
+}
+
+func TestArchivalHybridSearch(t *testing.T) {
+	ctx := context.Background()
+	archival := NewArchivalMemoryWithEmbedder(mapEmbedder{
+		"The user owns a kitten.":                 {1, 0, 0},
+		"The user's cat food is in the cupboard.": {0, 0, 1},
+		"The user flies to Lisbon on Friday.":     {0, 1, 0},
+		"pet":                                     {1, 0, 0},
+		"cat":                                     {0.8, 0, 0.6},
+	})
+	for _, text := range []string{"The user owns a kitten.", "The user's cat food is in the cupboard.", "The user flies to Lisbon on Friday."} {
+		if _, err := archival.Insert(ctx, text, nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		// no passage contains the word, but the kitten passage has the same meaning
+		{"pet", []int{1}},
+		// the keyword match ranks above a passage that is only similar in meaning
+		{"cat", []int{2, 1}},
+		{"spaceship", []int{}},
+	}
+	for _, test := range tests {
+		results, _, err := archival.Search(ctx, test.query, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, 0, len(results))
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("Search(%q) = %v, want %v", test.query, ids, test.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Agent events: a structured record of what an Agent does as it happens (its inner monologue, tool calls, memory edits, messages and runs),
+for front ends that show the Agent's activity live
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Possible values for the Type of an AgentEvent
+*/
+const (
+	AGENT_EVENT_RUN_START       = "run_start"       // the agent loop started
+	AGENT_EVENT_MONOLOGUE_DELTA = "monologue_delta" // a piece of inner monologue was generated; Text holds the new text
+	AGENT_EVENT_MONOLOGUE       = "monologue"       // a block of inner monologue is complete; Text holds the whole block
+	AGENT_EVENT_TOOL_USE_START  = "tool_use_start"  // a tool call started; Input holds its arguments
+	AGENT_EVENT_TOOL_USE_END    = "tool_use_end"    // a tool call finished; Result holds its result
+	AGENT_EVENT_MEMORY_EDIT     = "memory_edit"     // a block of core memory was edited
+	AGENT_EVENT_MESSAGE         = "message"         // the Agent sent a message to the user with sendMessage
+	AGENT_EVENT_HEARTBEAT       = "heartbeat"       // a tool requested a heartbeat, so the Agent will be run again
+	AGENT_EVENT_RUN_END         = "run_end"         // the agent loop finished; Status, Steps and Error describe the outcome
+)
+
+/*
+Something that an Agent did.
+Only the fields that apply to the event's Type are set.
+*/
+type AgentEvent struct {
+	ID         int64          `json:"id,omitempty"` // assigned by the EventLog the event is published to
+	Type       string         `json:"type"`
+	AgentID    string         `json:"agentId"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Text       string         `json:"text,omitempty"`
+	ToolUseID  string         `json:"toolUseId,omitempty"`
+	ToolName   string         `json:"toolName,omitempty"`
+	Input      map[string]any `json:"input,omitempty"`
+	Result     string         `json:"result,omitempty"`
+	IsError    bool           `json:"isError,omitempty"`
+	MemoryEdit *MemoryEdit    `json:"memoryEdit,omitempty"`
+	Message    *AgentMessage  `json:"message,omitempty"`
+	Status     string         `json:"status,omitempty"` // one of the RUN_STATUS_* constants
+	Steps      int            `json:"steps,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+/*
+Passes an event to the Agent's OnEvent hook, if it has one
+*/
+func (llm *Agent) emit(event AgentEvent) {
+	if llm.OnEvent == nil {
+		return
+	}
+	event.AgentID = llm.ID
+	event.Timestamp = llm.now()
+	llm.OnEvent(event)
+}
+
+func (llm *Agent) emitMemoryEdit(edit MemoryEdit) {
+	llm.emit(AgentEvent{Type: AGENT_EVENT_MEMORY_EDIT, MemoryEdit: &edit})
+}
+
+/*
+Returns a StreamHandler that turns the text of a streamed response into monologue events before passing each piece on to the given handler
+*/
+func (llm *Agent) monologueStreamHandler(next StreamHandler) StreamHandler {
+	return func(event StreamEvent) {
+		switch {
+		case event.Type == STREAM_EVENT_TEXT:
+			llm.emit(AgentEvent{Type: AGENT_EVENT_MONOLOGUE_DELTA, Text: event.Text})
+		case event.Type == STREAM_EVENT_BLOCK_STOP && event.Block != nil && event.Block.Type == "text":
+			llm.emit(AgentEvent{Type: AGENT_EVENT_MONOLOGUE, Text: event.Block.Text})
+		}
+		if next != nil {
+			next(event)
+		}
+	}
+}
+
+// Number of events kept by an EventLog created with a size of 0
+const DEFAULT_EVENT_LOG_SIZE int = 1000
+
+/*
+Keeps the most recent events of an Agent in a ring buffer, so that clients can catch up on the events they missed.
+Each event is given an ID one higher than the previous one, which clients use as a cursor.
+*/
+type EventLog struct {
+	mu      sync.Mutex
+	events  []AgentEvent // ring buffer of the most recent events
+	start   int          // index of the oldest event in the buffer
+	count   int
+	lastID  int64
+	changed chan struct{} // closed and replaced whenever an event is published
+}
+
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = DEFAULT_EVENT_LOG_SIZE
+	}
+	return &EventLog{events: make([]AgentEvent, size), changed: make(chan struct{})}
+}
+
+/*
+Adds an event to the log, assigning it the next ID. Safe to use as an Agent's OnEvent hook.
+*/
+func (log *EventLog) Publish(event AgentEvent) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	log.lastID++
+	event.ID = log.lastID
+	if log.count < len(log.events) {
+		log.events[(log.start+log.count)%len(log.events)] = event
+		log.count++
+	} else {
+		// overwriting the oldest event
+		log.events[log.start] = event
+		log.start = (log.start + 1) % len(log.events)
+	}
+
+	close(log.changed)
+	log.changed = make(chan struct{})
+}
+
+/*
+Returns the events published after the event with the given ID, oldest first, along with the number of those events that are no longer kept.
+A cursor ahead of the newest event (e.g. from before the log was recreated) is treated as 0.
+*/
+func (log *EventLog) Since(cursor int64) ([]AgentEvent, int) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if cursor < 0 || cursor > log.lastID {
+		cursor = 0
+	}
+	oldestID := log.lastID - int64(log.count) + 1
+	missed := 0
+	if cursor+1 < oldestID {
+		missed = int(oldestID - cursor - 1)
+		cursor = oldestID - 1
+	}
+
+	events := make([]AgentEvent, 0, log.lastID-cursor)
+	for i := int(cursor - oldestID + 1); i < log.count; i++ {
+		events = append(events, log.events[(log.start+i)%len(log.events)])
+	}
+	return events, missed
+}
+
+/*
+Returns the cursor from which every event that is still kept will be returned by Since
+*/
+func (log *EventLog) OldestCursor() int64 {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.lastID - int64(log.count)
+}
+
+/*
+Returns a channel that is closed when the next event is published.
+Get the channel before calling Since, so that no event published in between is missed.
+*/
+func (log *EventLog) Changed() <-chan struct{} {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.changed
+}
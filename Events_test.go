@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestEventLogSince(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		published int
+		cursor    int64
+		want      []int64 // the IDs of the returned events
+		missed    int
+	}{
+		{name: "empty log", size: 3, published: 0, cursor: 0, want: []int64{}},
+		{name: "from the start", size: 3, published: 2, cursor: 0, want: []int64{1, 2}},
+		{name: "after a cursor", size: 5, published: 4, cursor: 2, want: []int64{3, 4}},
+		{name: "caught up", size: 3, published: 3, cursor: 3, want: []int64{}},
+		{name: "full ring", size: 3, published: 3, cursor: 0, want: []int64{1, 2, 3}},
+		{name: "wrapped, cursor still kept", size: 3, published: 7, cursor: 5, want: []int64{6, 7}},
+		{name: "wrapped, cursor just before the oldest", size: 3, published: 7, cursor: 4, want: []int64{5, 6, 7}},
+		{name: "wrapped, events missed", size: 3, published: 7, cursor: 1, want: []int64{5, 6, 7}, missed: 3},
+		{name: "wrapped, from the start", size: 3, published: 7, cursor: 0, want: []int64{5, 6, 7}, missed: 4},
+		{name: "cursor ahead of the log", size: 3, published: 2, cursor: 10, want: []int64{1, 2}},
+		{name: "negative cursor", size: 3, published: 2, cursor: -1, want: []int64{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := NewEventLog(test.size)
+			for i := 0; i < test.published; i++ {
+				log.Publish(AgentEvent{Type: AGENT_EVENT_HEARTBEAT})
+			}
+
+			events, missed := log.Since(test.cursor)
+			ids := make([]int64, 0, len(events))
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			if !reflect.DeepEqual(ids, test.want) || missed != test.missed {
+				t.Errorf("Since(%d) = %v with %d missed, want %v with %d missed", test.cursor, ids, missed, test.want, test.missed)
+			}
+		})
+	}
+}
+
+func TestEventLogOldestCursor(t *testing.T) {
+	log := NewEventLog(3)
+	for i := 0; i < 5; i++ {
+		log.Publish(AgentEvent{Type: AGENT_EVENT_HEARTBEAT})
+	}
+	cursor := log.OldestCursor()
+	if cursor != 2 {
+		t.Fatalf("OldestCursor = %d, want 2", cursor)
+	}
+	if events, missed := log.Since(cursor); len(events) != 3 || missed != 0 {
+		t.Errorf("Since(OldestCursor) returned %d events with %d missed, want 3 with none missed", len(events), missed)
+	}
+}
+
+func TestEventLogChanged(t *testing.T) {
+	log := NewEventLog(3)
+	changed := log.Changed()
+	select {
+	case <-changed:
+		t.Fatal("Changed was closed before an event was published")
+	default:
+	}
+
+	log.Publish(AgentEvent{Type: AGENT_EVENT_HEARTBEAT})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Changed was not closed when an event was published")
+	}
+	if log.Changed() == changed {
+		t.Error("Changed returned the closed channel after the event was published")
+	}
+}
+
+func TestAgentEvents(t *testing.T) {
+	agent, _ := newTestAgent(&fakeProvider{responses: []AgentResponse{
+		toolUseResponse("call_1", "coreMemoryAppend", map[string]any{"section": "User", "newContent": "Likes tea.", "requestHeartbeat": true}),
+		toolUseResponse("call_2", "sendMessage", map[string]any{"message": "Noted!"}),
+	}})
+	var mu sync.Mutex
+	events := make([]AgentEvent, 0)
+	agent.OnEvent = func(event AgentEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	agent.AddUserMessage("I like tea.")
+	if _, err := agent.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	want := []string{
+		AGENT_EVENT_RUN_START,
+		AGENT_EVENT_TOOL_USE_START, AGENT_EVENT_MEMORY_EDIT, AGENT_EVENT_TOOL_USE_END, AGENT_EVENT_HEARTBEAT,
+		AGENT_EVENT_TOOL_USE_START, AGENT_EVENT_MESSAGE, AGENT_EVENT_TOOL_USE_END,
+		AGENT_EVENT_RUN_END,
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("the agent emitted %v, want %v", types, want)
+	}
+	if edit := events[2].MemoryEdit; edit == nil || edit.Block != "User" || edit.ToolUseID != "call_1" {
+		t.Errorf("the memory edit event is %+v", events[2])
+	}
+	if message := events[6].Message; message == nil || message.Text != "Noted!" {
+		t.Errorf("the message event is %+v", events[6])
+	}
+	if end := events[len(events)-1]; end.Status != RUN_STATUS_COMPLETED || end.Steps != 3 {
+		t.Errorf("the run_end event is %+v, want a completed run of 3 steps", end)
+	}
+}
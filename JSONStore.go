@@ -0,0 +1,233 @@
+/*
+AgentStore that keeps each Agent in its own JSON file
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Stores each Agent as <ID>.json in a directory.
+The files are human readable, which makes this store convenient for development and for inspecting an Agent's memory.
+*/
+type JSONFileStore struct {
+	Dir   string
+	mu    sync.Mutex
+	names map[string]string // the ID of every Agent by name; read from the directory on first use and kept up to date by Save and Delete
+}
+
+/*
+Creates a JSONFileStore in the given directory, creating the directory if needed
+*/
+func NewJSONFileStore(dir string) (*JSONFileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating agent store directory: %w", err)
+	}
+	return &JSONFileStore{Dir: dir}, nil
+}
+
+func (store *JSONFileStore) path(id string) string {
+	return filepath.Join(store.Dir, id+".json")
+}
+
+func (store *JSONFileStore) Save(ctx context.Context, state AgentState) error {
+	if state.ID == "" {
+		return fmt.Errorf("cannot save agent %q without an ID", state.Name)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	names, err := store.nameIndex()
+	if err != nil {
+		return err
+	}
+	if existingID, ok := names[state.Name]; ok && existingID != state.ID {
+		return fmt.Errorf("an agent named %q already exists with ID %s", state.Name, existingID)
+	}
+	now := time.Now()
+	state.CreatedAt = now
+	existing, err := store.read(store.path(state.ID))
+	if err == nil {
+		state.CreatedAt = existing.CreatedAt
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	state.UpdatedAt = now
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// writing to a temporary file first, so that a crash cannot leave a partially written agent behind
+	temp, err := os.CreateTemp(store.Dir, state.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), store.path(state.ID)); err != nil {
+		return err
+	}
+
+	if existing != nil && existing.Name != state.Name {
+		delete(names, existing.Name)
+	}
+	names[state.Name] = state.ID
+	return nil
+}
+
+func (store *JSONFileStore) Load(ctx context.Context, idOrName string) (*AgentState, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.find(idOrName)
+}
+
+func (store *JSONFileStore) List(ctx context.Context) ([]AgentSummary, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	states, err := store.readAll()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]AgentSummary, 0, len(states))
+	for _, state := range states {
+		summaries = append(summaries, state.summary())
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	return summaries, nil
+}
+
+func (store *JSONFileStore) Delete(ctx context.Context, idOrName string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	state, err := store.find(idOrName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(store.path(state.ID)); err != nil {
+		return err
+	}
+	if store.names != nil {
+		delete(store.names, state.Name)
+	}
+	return nil
+}
+
+func (store *JSONFileStore) Close() error {
+	return nil
+}
+
+/*
+Returns the Agent with the given ID, or else the Agent with the given name.
+Must be called with the lock held.
+*/
+func (store *JSONFileStore) find(idOrName string) (*AgentState, error) {
+	if !strings.ContainsAny(idOrName, `/\`) {
+		state, err := store.read(store.path(idOrName))
+		if err == nil {
+			return state, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	names, err := store.nameIndex()
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := names[idOrName]; ok {
+		state, err := store.read(store.path(id))
+		if err == nil {
+			return state, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrAgentNotFound, idOrName)
+}
+
+/*
+Returns the ID of every Agent by name, reading only the names from the files the first time it is called.
+Must be called with the lock held.
+*/
+func (store *JSONFileStore) nameIndex() (map[string]string, error) {
+	if store.names != nil {
+		return store.names, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(store.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var header struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(data, &header); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		names[header.Name] = header.ID
+	}
+	store.names = names
+	return names, nil
+}
+
+func (store *JSONFileStore) read(path string) (*AgentState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state AgentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+/*
+Reads every Agent in the store.
+Must be called with the lock held.
+*/
+func (store *JSONFileStore) readAll() ([]*AgentState, error) {
+	paths, err := filepath.Glob(filepath.Join(store.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*AgentState, 0, len(paths))
+	for _, path := range paths {
+		state, err := store.read(path)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
@@ -2,18 +2,14 @@
 Go implementation of Claude logic from Anthropic API
 */
 
-//TODO: ability to expose agents via  REST API to create agents as a service
-
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 type Agent struct {
@@ -25,13 +21,30 @@ type Agent struct {
 	// - claude-3-sonnet-20240229
 	// - claude-3-haiku-20240307
 	Model          string
+	ID             string // uniquely identifies the Agent in an AgentStore
 	Name           string
 	ApiKey         string
-	System         []Content
+	Provider       Provider  // the LLM API used to serve requests; defaults to the Anthropic API
+	System         []Content // the Agent's instructions; the contents of core memory are added after them on every request
 	ChatHistory    []Message
 	Tools          []Tool
 	CoreMemory     CoreMemory
+	RecallMemory   *RecallMemory // every message that has been added to the ChatHistory
+	ArchivalMemory *ArchivalMemory
+	Output         OutputSink // where the messages sent with sendMessage are delivered; defaults to standard output
+	/*
+		Optional hook that receives an AgentEvent for everything the Agent does, as it happens.
+		Setting it makes every request stream, so that the inner monologue is reported as it is generated.
+		Tools may run concurrently, so the hook must be safe to call from several goroutines at once.
+	*/
+	OnEvent func(event AgentEvent)
+	// Whether the tools of the last step requested a heartbeat; set by Step from the requests that each tool call returns
 	HeartbeatState bool
+	ContextWindow  ContextWindowOptions // how the chat history is kept within the model's context window
+	Clock          Clock                // the source of the times the Agent records and is told about; defaults to the system clock
+
+	contextWarningGiven bool // whether the Agent was warned that its context window is filling up since the last flush
+	recallOutOfContext  int  // the number of recall memory entries whose messages have been removed from the chat history
 }
 
 /*
@@ -53,22 +66,40 @@ func NewAgent(model string, persona string, name string, apiKey ...string) (*Age
 		key = apiKey[0]
 	}
 
+	agent := NewAgentWithProvider(model, persona, name, NewAnthropicProvider(key))
+	agent.ApiKey = key
+
+	return agent, true
+}
+
+/*
+Creates a new Agent that is served by the given Provider.
+Use this to run an Agent against an API other than Anthropic's, e.g. an OpenAIProvider pointed at a local model server.
+*/
+func NewAgentWithProvider(model string, persona string, name string, provider Provider) *Agent {
 	agent := &Agent{
 		Model:          model,
-		ApiKey:         key,
+		ID:             newAgentID(),
 		Name:           name,
+		Provider:       provider,
 		System:         []Content{{Type: "text", Text: SYSTEM_PROMPT}},
 		ChatHistory:    make([]Message, 0),
 		CoreMemory:     *NewCoreMemoryUnit(persona),
+		RecallMemory:   NewRecallMemory(),
+		ArchivalMemory: NewArchivalMemory(),
 		HeartbeatState: false,
 	}
-
-	// providing the Agent system prompt as well as core memory data
-	agent.System = append(agent.System, Content{Type: "text", Text: agent.CoreMemory.toString()})
+	agent.CoreMemory.onEdit = agent.emitMemoryEdit
+	agent.CoreMemory.clock = func() time.Time { return agent.now() }
+	agent.Tools = append(agent.Tools, *agent.createSendMessageTool())
 	// providing necessary tools for memory management
 	agent.Tools = append(agent.Tools, *agent.createCoreMemoryAppendTool(), *agent.createCoreMemoryReplaceTool())
+	agent.Tools = append(agent.Tools, *agent.createConversationSearchTool(), *agent.createConversationSearchDateTool())
+	agent.Tools = append(agent.Tools, *agent.createArchivalMemoryInsertTool(), *agent.createArchivalMemorySearchTool())
+	agent.addStatisticsBlock()
+	agent.refreshMemoryToolSchemas()
 
-	return agent, true
+	return agent
 }
 
 type AgentRequest struct {
@@ -90,6 +121,8 @@ type AgentRequest struct {
 	System []Content `json:"system,omitempty"`
 	// Temperature value (0 - 1)
 	Temperature float32 `json:"temperature,omitempty"`
+	// Set to true to receive the response incrementally as server-sent events
+	Stream bool `json:"stream,omitempty"`
 }
 
 // Defines the structure of a single message (i.e. either system or user prompt)
@@ -161,6 +194,11 @@ type Content struct {
 		Use this key when passing the result from the tool call back to the Agent
 	*/
 	Content string `json:"content,omitempty"`
+	/*
+		Set to true on a 'tool_result' when the tool call failed; Content then describes the error.
+		Only applies when passing the result from a tool call back to the Agent
+	*/
+	IsError bool `json:"is_error,omitempty"`
 }
 
 // type ResponseMessage struct {
@@ -206,28 +244,20 @@ func (response AgentResponse) getOutput() string {
 }
 
 /*
-Create a request for the Agent (custom messages parameter)
+Create a request for the Agent (custom messages parameter).
+The system prompt is compiled from the current state of core memory, so that the model always sees the latest edits.
 */
 func (llm Agent) NewAgentRequest(maxTokens int, temperature float32) *AgentRequest {
 	return &AgentRequest{
 		Model:       llm.Model,
 		MaxTokens:   maxTokens,
 		Tools:       llm.Tools,
-		System:      llm.System,
+		System:      llm.compileSystemPrompt(),
 		Messages:    llm.ChatHistory,
 		Temperature: temperature,
 	}
 }
 
-/*
-Used to send a message back to the user
-*/
-func (llm *Agent) sendMessage(message string) string {
-	fmt.Printf("Message from Agent:\n%s\n", message)
-	llm.HeartbeatState = false
-	return message
-}
-
 /*
 Create a request that takes in a user prompt
 */
@@ -264,65 +294,38 @@ Create a request that involves a user prompt as well as a partially filled respo
 Function for calling an Agent via a prompt.
 Returns the Response, the status code of the request, and error, if applicable
 */
-func (llm Agent) call(reqData AgentRequest) (*AgentResponse, int, error) {
-	// Extracting the request data
-	reqBody, err := json.Marshal(reqData)
-	if err != nil {
-		fmt.Printf("Error marshaling request data: %v\n", err)
-		return nil, -1, err
-	}
-
-	// Creating the request
-	url := "https://api.anthropic.com/v1/messages"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
-
-	if err != nil {
-		fmt.Printf("Error creating request:%v\n", err)
-		return nil, -1, err
-	}
-
-	// Setting request headers
-	fmt.Println("Setting request headers")
-	req.Header.Set("x-api-key", llm.ApiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-	req.Header.Set("content-type", "application/json")
-
-	fmt.Println("Making request")
-
-	// Sending the response
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("Error sending request %v\n", err)
-		return nil, res.StatusCode, err
-	}
-
-	// Closing the response body once the function is finished executing
-	defer res.Body.Close()
+func (llm Agent) call(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error) {
+	return llm.provider().Complete(ctx, reqData)
+}
 
-	fmt.Println("Reading response data")
-	// Reading the response data
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		fmt.Printf("Error reading response %v\n", err)
-		return nil, res.StatusCode, err
-	}
+/*
+Function for calling an Agent via a prompt, streaming the response as it is generated.
+Each piece of the response is passed to the handler as it arrives; the complete response is returned once the stream ends, in the same form as the response from call.
+Returns the Response, the status code of the request, and error, if applicable
+*/
+func (llm Agent) callStream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error) {
+	return llm.provider().Stream(ctx, reqData, handler)
+}
 
-	if res.StatusCode != http.StatusOK {
-		fmt.Printf("Request failed with status code %d: %s\n", res.StatusCode, string(resBody))
+/*
+Returns the Provider used to serve this Agent's requests.
+Agents created without a Provider use the Anthropic API with the Agent's API key.
+*/
+func (llm Agent) provider() Provider {
+	if llm.Provider == nil {
+		return NewAnthropicProvider(llm.ApiKey)
 	}
+	return llm.Provider
+}
 
-	fmt.Println("Storing response")
-	// Storing the response into the Response struct
-	var apiResp AgentResponse
-	err = json.Unmarshal(resBody, &apiResp)
-	if err != nil {
-		fmt.Printf("Error parsing the response: %v\n", err)
-		return nil, res.StatusCode, err
+/*
+Returns the current time according to the Agent's Clock
+*/
+func (llm Agent) now() time.Time {
+	if llm.Clock == nil {
+		return time.Now()
 	}
-
-	return &apiResp, res.StatusCode, nil
-
+	return llm.Clock.Now()
 }
 
 /*
@@ -335,7 +338,7 @@ func (llm *Agent) addResponseToChatHistory(response AgentResponse) {
 	messageToAppend := Message{Role: "assistant", Content: []Content{}}
 	messageToAppend.Content = append(messageToAppend.Content, response.Content...)
 
-	llm.ChatHistory = append(llm.ChatHistory, messageToAppend)
+	llm.addMessageToChatHistory(messageToAppend)
 }
 
 // func getWeather(args ...interface{}) interface{} {
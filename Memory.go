@@ -1,28 +1,72 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-// TODO: ability to add custom memory blocks into core memory (aside from just human and agent) and corresponding tools for those memory blocks
+// Number of characters allotted to the default User and Agent blocks of core memory
+const DEFAULT_BLOCK_SIZE int = 2000
+
 type MemoryBlock struct {
 	sectionName string
-	//size        int           // number of characters allotted for a given block of memory
-	data string // the text data stored in the given block of memory
+	size        int    // number of characters allotted for a given block of memory; 0 means no limit
+	data        string // the text data stored in the given block of memory
+	readOnly    bool   // whether the Agent is prevented from editing the block with its memory tools
+	description string // explains to the Agent what the block is for
+	lastEdited  time.Time
+}
+
+/*
+Defines a block of core memory
+*/
+type MemoryBlockConfig struct {
+	Label       string // the name of the block, which the Agent uses to refer to it, e.g. "Project"
+	Description string // explains to the Agent what the block is for, e.g. "Details of the project the user is working on"
+	Limit       int    // the maximum number of characters the block may hold; 0 means no limit
+	ReadOnly    bool   // prevents the Agent from editing the block, so that only the program can change it
+	Value       string // the initial contents of the block
+}
+
+/* Accessors for the contents and settings of a memory block */
+
+func (memoryBlock MemoryBlock) Value() string         { return memoryBlock.data }
+func (memoryBlock MemoryBlock) Limit() int            { return memoryBlock.size }
+func (memoryBlock MemoryBlock) ReadOnly() bool        { return memoryBlock.readOnly }
+func (memoryBlock MemoryBlock) Description() string   { return memoryBlock.description }
+func (memoryBlock MemoryBlock) LastEdited() time.Time { return memoryBlock.lastEdited }
+
+/*
+Replaces the contents of the block and records when it was edited
+*/
+func (memoryBlock *MemoryBlock) setData(data string, now time.Time) {
+	memoryBlock.data = data
+	memoryBlock.lastEdited = now
 }
 
 // TODO: replace w/ ElasticSearch?
 type CoreMemory struct {
 	Blocks map[string]*MemoryBlock
+	edits  []MemoryEdit          // every recorded edit to the blocks, oldest first
+	onEdit func(edit MemoryEdit) // called with every recorded edit
+	clock  func() time.Time      // the Agent's clock, used to time edits that are not made by its tools; defaults to time.Now
 	// UserMemory/*map[string]string*/ MemoryBlock
 	// AgentMemory/*map[string]string*/ MemoryBlock
 }
 
 func NewCoreMemoryUnit(persona string) *CoreMemory {
+	now := time.Now()
 	coreMemory := CoreMemory{Blocks: map[string]*MemoryBlock{
-		"User":  {sectionName: "user" /*size: 2000,*/, data: ""},
-		"Agent": {sectionName: "agent" /*size: 2000,*/, data: persona}},
+		"User": {sectionName: "human", size: DEFAULT_BLOCK_SIZE, data: "", lastEdited: now,
+			description: "Information about the user you are talking with, such as their name, preferences and circumstances."},
+		"Agent": {sectionName: "persona", size: DEFAULT_BLOCK_SIZE, data: persona, lastEdited: now,
+			description: "Your persona: who you are and how you behave and speak."}},
 	}
 
 	// coreMemory.UserMemory.toString = func() string {
@@ -37,233 +81,372 @@ func NewCoreMemoryUnit(persona string) *CoreMemory {
 }
 
 /*
-Conversation history -- stored out of context
+Serializes the memory block, e.g. when it is returned to the Agent as the output of a memory tool
 */
-type RecallMemory struct {
+func (memoryBlock MemoryBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		SectionName string `json:"sectionName"`
+		Data        string `json:"data"`
+		Limit       int    `json:"limit,omitempty"`
+		ReadOnly    bool   `json:"readOnly,omitempty"`
+	}{memoryBlock.sectionName, memoryBlock.data, memoryBlock.size, memoryBlock.readOnly})
 }
 
 /*
-General purpose out of context information storage
-Retrieve via RAG (semantic search/tf-idf)
+Returns the labels of the blocks in core memory, in the order in which they are shown to the Agent:
+the Agent block first, then the User block, then any other blocks sorted by label.
+If editableOnly is set, read-only blocks are left out.
 */
-type ArchivalMemory struct {
+func (coreMemory CoreMemory) labels(editableOnly bool) []string {
+	labels := make([]string, 0, len(coreMemory.Blocks))
+	for label, block := range coreMemory.Blocks {
+		if !editableOnly || !block.readOnly {
+			labels = append(labels, label)
+		}
+	}
+
+	rank := func(label string) int {
+		switch label {
+		case "Agent":
+			return 0
+		case "User":
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if rank(labels[i]) != rank(labels[j]) {
+			return rank(labels[i]) < rank(labels[j])
+		}
+		return labels[i] < labels[j]
+	})
+	return labels
 }
 
 /*
-Converts the data stored across all of Core Memory into a string that can be used in the Agent's context window.
+Returns the current time according to the Agent's clock
 */
-func (coreMemory CoreMemory) toString() string {
-	var builder strings.Builder
-
-	for section, block := range coreMemory.Blocks {
-		builder.WriteString(fmt.Sprintf("%s:\n%s\n", section, block.data))
+func (coreMemory CoreMemory) now() time.Time {
+	if coreMemory.clock == nil {
+		return time.Now()
 	}
-	return builder.String()
+	return coreMemory.clock()
 }
 
-// func (memoryBlock *MemoryBlock) coreMemorySave(agentMem bool, section string, memory string) (result struct {
-// 	sec string
-// 	mem string
-// }) {
-// 	if agentMem {
-// 		memoryBlock.AgentMemory += "\n"
-// 		memoryBlock.AgentMemory += memory
-// 		result.sec = section
-// 		result.mem = memory
-// 		return
-// 	}
-// 	memoryBlock.UserMemory += "\n"
-// 	memoryBlock.UserMemory += memory
-// 	result.sec = section
-// 	result.mem = memory
-// 	return
-// }
+/*
+Returns the error reported to the Agent when it tries to edit a section of core memory that does not exist
+*/
+func (coreMemory CoreMemory) unknownSectionError(section string) error {
+	sections := make([]string, 0, len(coreMemory.Blocks))
+	for _, label := range coreMemory.labels(true) {
+		sections = append(sections, fmt.Sprintf("\"%s\"", label))
+	}
+	return fmt.Errorf("section \"%s\" does not exist in core memory; valid sections are %s", section, strings.Join(sections, ", "))
+}
 
 /*
-Stores a memory (either User or Agent memory) in the memory block.
-Ex. memoryBlock = memoryBlock.coreMemorySave(false, "name", "Bob")
-TODO: should this return the entire core memory, or just the updated block of memory?
+Returns the block that the Agent wants to edit, or an error to report to the Agent if the block does not exist or is read-only
 */
-func (llm *Agent) coreMemoryAppend(section string, newContent string, requestHeartbeat bool) *CoreMemory {
-	llm.HeartbeatState = requestHeartbeat
-	memoryBlock, ok := llm.CoreMemory.Blocks[section]
+func (coreMemory CoreMemory) editableBlock(section string) (*MemoryBlock, error) {
+	memoryBlock, ok := coreMemory.Blocks[section]
 	if !ok {
-		return nil
+		return nil, coreMemory.unknownSectionError(section)
 	}
-
-	memoryBlock.data += fmt.Sprintf("\n%s", newContent)
-	return &llm.CoreMemory
+	if memoryBlock.readOnly {
+		return nil, fmt.Errorf("section \"%s\" of core memory is read-only and cannot be edited", section)
+	}
+	return memoryBlock, nil
 }
 
 /*
-Helper function defined to be used as a Tool for an agent
+Returns an error if the data does not fit in the block
 */
-func (llm *Agent) coreMemoryAppendVariadic(args ...any) any {
-	if len(args) == 0 {
-		return "Error: No parameters provided"
+func (memoryBlock MemoryBlock) checkLimit(section string, data string) error {
+	length := utf8.RuneCountInString(data)
+	if memoryBlock.size <= 0 || length <= memoryBlock.size {
+		return nil
 	}
+	return fmt.Errorf("section \"%s\" of core memory is limited to %d characters; it currently uses %d, and this edit would bring it to %d. "+
+		"Use coreMemoryReplace to condense or remove outdated information in the section first, "+
+		"or store the details in archival memory with archivalMemoryInsert and keep only a short summary in core memory",
+		section, memoryBlock.size, utf8.RuneCountInString(memoryBlock.data), length)
+}
 
-	section, ok := args[0].(string)
-
-	if !ok {
-		return "Error: Invalid section string"
+/*
+Adds a new block to core memory
+*/
+func (coreMemory *CoreMemory) AddBlock(config MemoryBlockConfig) error {
+	if strings.TrimSpace(config.Label) == "" {
+		return fmt.Errorf("memory block must have a label")
+	}
+	if _, ok := coreMemory.Blocks[config.Label]; ok {
+		return fmt.Errorf("section \"%s\" already exists in core memory", config.Label)
 	}
 
-	newContent, ok := args[1].(string)
+	memoryBlock := &MemoryBlock{
+		sectionName: strings.ToLower(config.Label),
+		size:        config.Limit,
+		data:        config.Value,
+		readOnly:    config.ReadOnly,
+		description: config.Description,
+		lastEdited:  coreMemory.now(),
+	}
+	if err := memoryBlock.checkLimit(config.Label, config.Value); err != nil {
+		return err
+	}
+	if coreMemory.Blocks == nil {
+		coreMemory.Blocks = make(map[string]*MemoryBlock)
+	}
+	coreMemory.Blocks[config.Label] = memoryBlock
+	return nil
+}
 
+/*
+Removes a block from core memory. Its edit log ends with the removal, so that a block added later with the same label starts a new history.
+*/
+func (coreMemory *CoreMemory) RemoveBlock(label string) error {
+	memoryBlock, ok := coreMemory.Blocks[label]
 	if !ok {
-		return "Error: Invalid newContent string"
+		return fmt.Errorf("section \"%s\" does not exist in core memory", label)
 	}
+	delete(coreMemory.Blocks, label)
+	coreMemory.recordRemoval(label, memoryBlock.data, coreMemory.now())
+	return nil
+}
 
-	requestHeartbeat, ok := args[2].(bool)
-
+/*
+Replaces the contents of a block, including read-only blocks.
+Intended for the program rather than the Agent, e.g. to keep a read-only block up to date. The block's limit still applies, and the edit is recorded in the edit log.
+*/
+func (coreMemory *CoreMemory) SetBlockValue(label string, value string) error {
+	memoryBlock, ok := coreMemory.Blocks[label]
 	if !ok {
-		return "Error: Invalid requestHeartbeat flag"
+		return fmt.Errorf("section \"%s\" does not exist in core memory", label)
 	}
-
-	return llm.coreMemoryAppend(section, newContent, requestHeartbeat)
+	if err := memoryBlock.checkLimit(label, value); err != nil {
+		return err
+	}
+	coreMemory.recordEdit(context.Background(), label, MEMORY_EDIT_SET, value, coreMemory.now())
+	return nil
 }
 
-func (llm Agent) createCoreMemoryAppendTool() *Tool {
-	return &Tool{
-		Name:        "coreMemoryAppend",
-		Description: "Save important information about you (the agent) or the human you are chatting with, inside of your core memory.",
-		InputSchema: InputSchema{
-			Type: "object",
-			Properties: map[string]Property{
-				"section": {
-					Type:        "string",
-					Description: "Represents the section of core memory to append to. This could be \"User\" (to store information about the user you are talking with), \"Agent\" (to store information about yourself, the agent), or some other user-defined portion of your core memory.",
-				},
-				"newContent": {
-					Type:        "string",
-					Description: "The text information to store in your core memory that you will be able to refer to in the future.",
-				},
-				"requestHeartbeat": {
-					Type:        "boolean",
-					Description: "Set to `true` to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to `false` to end your execution now.",
-				},
-			},
-			Required: []string{"section", "newContent", "requestHeartbeat"},
-		},
-		// Wrapper function
-		Function: llm.coreMemoryAppendVariadic,
-		// Function: func(agentMema any, memorya any) any {
-		// 	//args := params.(map[string]any)
-		// 	agentMem := params["agentMem"].(bool)
-		// 	memory := params["memory"].(string)
-		// 	return memoryBlock.coreMemorySave(agentMem, memory)
-		// },
+/*
+Adds a new block to the Agent's core memory and lists it in the schemas of the core memory tools
+*/
+func (llm *Agent) AddMemoryBlock(config MemoryBlockConfig) error {
+	if err := llm.CoreMemory.AddBlock(config); err != nil {
+		return err
 	}
+	llm.refreshMemoryToolSchemas()
+	return nil
 }
 
-/* Core Memory Replace */
-
-func (llm *Agent) coreMemoryReplace(section string, oldContent string, newContent string, requestHeartbeat bool) *CoreMemory {
-	llm.HeartbeatState = requestHeartbeat
-	memoryBlock, ok := llm.CoreMemory.Blocks[section]
-	if !ok {
-		return nil
+/*
+Removes a block from the Agent's core memory and from the schemas of the core memory tools
+*/
+func (llm *Agent) RemoveMemoryBlock(label string) error {
+	if err := llm.CoreMemory.RemoveBlock(label); err != nil {
+		return err
 	}
-
-	memoryBlock.data = strings.ReplaceAll(memoryBlock.data, oldContent, newContent)
-
-	return &llm.CoreMemory
+	llm.refreshMemoryToolSchemas()
+	return nil
 }
 
 /*
-Helper function defined to be used as a Tool for an agent
+Updates the "section" parameter of the core memory tools to enumerate the blocks that the Agent can currently edit
 */
-func (llm *Agent) coreMemoryReplaceVariadic(args ...any) any {
-	if len(args) == 0 {
-		return "Error: No parameters provided"
+func (llm *Agent) refreshMemoryToolSchemas() {
+	labels := llm.CoreMemory.labels(true)
+	for i := range llm.Tools {
+		tool := &llm.Tools[i]
+		if tool.Name != "coreMemoryAppend" && tool.Name != "coreMemoryReplace" {
+			continue
+		}
+		if property, ok := tool.InputSchema.Properties["section"]; ok {
+			property.Enum = labels
+			tool.InputSchema.Properties["section"] = property
+		}
 	}
+}
 
-	section, ok := args[0].(string)
+/*
+Converts the data stored across all of Core Memory into a string that can be used in the Agent's context window.
+Each block is wrapped in an XML-style tag named after its section (e.g. <persona> and <human>), along with its label, character usage and the time it was last edited.
+*/
+func (coreMemory CoreMemory) toString() string {
+	var builder strings.Builder
 
-	if !ok {
-		return "Error: Invalid section flag"
+	builder.WriteString("<core_memory>\n")
+	for _, label := range coreMemory.labels(false) {
+		block := coreMemory.Blocks[label]
+		tag := xmlTagName(block.sectionName, label)
+
+		characters := fmt.Sprintf("%d", utf8.RuneCountInString(block.data))
+		if block.size > 0 {
+			characters += fmt.Sprintf("/%d", block.size)
+		}
+		builder.WriteString(fmt.Sprintf("<%s label=\"%s\" characters=\"%s\"", tag, label, characters))
+		if !block.lastEdited.IsZero() {
+			builder.WriteString(fmt.Sprintf(" last_edited=\"%s\"", block.lastEdited.Format(time.RFC3339)))
+		}
+		if block.readOnly {
+			builder.WriteString(" read_only=\"true\"")
+		}
+		builder.WriteString(">\n")
+
+		if block.description != "" {
+			builder.WriteString(fmt.Sprintf("<description>%s</description>\n", block.description))
+		}
+		if data := strings.TrimSpace(block.data); data != "" {
+			builder.WriteString(data + "\n")
+		}
+		builder.WriteString(fmt.Sprintf("</%s>\n", tag))
 	}
+	builder.WriteString("</core_memory>")
+	return builder.String()
+}
 
-	oldContent, ok := args[1].(string)
-
-	if !ok {
-		return "Error: Invalid oldContent string"
+/*
+Converts a section name into a valid XML tag name, falling back to the label when the section name has no usable characters
+*/
+func xmlTagName(sectionName string, label string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, strings.TrimSpace(sectionName))
+	name = strings.Trim(name, "_")
+	if name == "" && label != sectionName {
+		return xmlTagName(label, label)
+	}
+	if name == "" || !unicode.IsLetter([]rune(name)[0]) {
+		name = "block_" + name
 	}
+	return name
+}
 
-	newContent, ok := args[2].(string)
+/*
+Returns the system prompt to send with the next request: the Agent's instructions followed by the current contents of core memory
+*/
+func (llm Agent) compileSystemPrompt() []Content {
+	system := make([]Content, 0, len(llm.System)+1)
+	system = append(system, llm.System...)
+	return append(system, Content{Type: "text", Text: llm.CoreMemory.toString()})
+}
 
-	if !ok {
-		return "Error: Invalid newContent string"
-	}
+// func (memoryBlock *MemoryBlock) coreMemorySave(agentMem bool, section string, memory string) (result struct {
+// 	sec string
+// 	mem string
+// }) {
+// 	if agentMem {
+// 		memoryBlock.AgentMemory += "\n"
+// 		memoryBlock.AgentMemory += memory
+// 		result.sec = section
+// 		result.mem = memory
+// 		return
+// 	}
+// 	memoryBlock.UserMemory += "\n"
+// 	memoryBlock.UserMemory += memory
+// 	result.sec = section
+// 	result.mem = memory
+// 	return
+// }
 
-	requestHeartbeat, ok := args[3].(bool)
+/*
+Stores a memory (either User or Agent memory) in the memory block.
+Ex. memoryBlock = memoryBlock.coreMemorySave(false, "name", "Bob")
+TODO: should this return the entire core memory, or just the updated block of memory?
+*/
+func (llm *Agent) coreMemoryAppend(ctx context.Context, section string, newContent string, requestHeartbeat bool) (*CoreMemory, error) {
+	requestHeartbeatIf(ctx, requestHeartbeat)
+	memoryBlock, err := llm.CoreMemory.editableBlock(section)
+	if err != nil {
+		return nil, err
+	}
 
-	if !ok {
-		return "Error: Invalid requestHeartbeat flag"
+	data := newContent
+	if memoryBlock.data != "" {
+		data = memoryBlock.data + "\n" + newContent
 	}
+	if err := memoryBlock.checkLimit(section, data); err != nil {
+		return nil, err
+	}
+	llm.CoreMemory.recordEdit(ctx, section, MEMORY_EDIT_APPEND, data, llm.now())
+	return &llm.CoreMemory, nil
+}
 
-	return llm.coreMemoryReplace(section, oldContent, newContent, requestHeartbeat)
+type coreMemoryAppendInput struct {
+	Section          string `json:"section" description:"Represents the section of core memory to append to. This could be \"User\" (to store information about the user you are talking with), \"Agent\" (to store information about yourself, the agent), or some other user-defined portion of your core memory. Each section has a character limit; if an edit would exceed it, the edit fails."`
+	NewContent       string `json:"newContent" description:"The text information to store in your core memory that you will be able to refer to in the future."`
+	RequestHeartbeat bool   `json:"requestHeartbeat" description:"Set to 'true' to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to 'false' to end your execution now."`
 }
 
-func (llm Agent) createCoreMemoryReplaceTool() *Tool {
-	return &Tool{
-		Name:        "coreMemoryReplace",
-		Description: "Takes a piece of existing information about you (the agent) or the human you are chatting with, and replaces this information with a new piece of information.",
-		//Description: "Save important information about you (the agent) or the human you are chatting with.",
-		InputSchema: InputSchema{
-			Type: "object",
-			Properties: map[string]Property{
-				"section": {
-					Type:        "string",
-					Description: "The section of core memory to update. This could be \"User\" (to update information about the user you are talking with), \"Agent\" (to update information about yourself, the agent), or some other user-defined portion of your core memory.",
-				},
-				"oldContent": {
-					Type:        "string",
-					Description: "The text information in your core memory that is now outdated and is to be replaced.",
-				},
-				"newContent": {
-					Type:        "string",
-					Description: "The new text information to store in your core memory to replace an existing piece of information.",
-				},
-				"requestHeartbeat": {
-					Type:        "boolean",
-					Description: "Set to `true` to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to `false` to end your execution now.",
-				},
-			},
-			Required: []string{"section", "oldContent", "newContent", "requestHeartbeat"},
-		},
-		// Wrapper function
-		Function: llm.coreMemoryAppendVariadic,
-		// Function: func(agentMema any, memorya any) any {
-		// 	//args := params.(map[string]any)
-		// 	agentMem := params["agentMem"].(bool)
-		// 	memory := params["memory"].(string)
-		// 	return memoryBlock.coreMemorySave(agentMem, memory)
-		// },
-	}
+func (llm *Agent) createCoreMemoryAppendTool() *Tool {
+	tool := NewTool("coreMemoryAppend",
+		"Save important information about you (the agent) or the human you are chatting with, inside of your core memory.",
+		func(ctx context.Context, input coreMemoryAppendInput) (*CoreMemory, error) {
+			return llm.coreMemoryAppend(ctx, input.Section, input.NewContent, input.RequestHeartbeat)
+		})
+	// edits to core memory must be applied in the order in which they were requested
+	tool.Sequential = true
+	return tool
 }
 
-func (llm *Agent) conversationSearch(requestHeartbeat bool) {
-	llm.HeartbeatState = requestHeartbeat
+/* Core Memory Replace */
 
-}
+func (llm *Agent) coreMemoryReplace(ctx context.Context, section string, oldContent string, newContent string, requestHeartbeat bool) (*CoreMemory, error) {
+	requestHeartbeatIf(ctx, requestHeartbeat)
+	memoryBlock, err := llm.CoreMemory.editableBlock(section)
+	if err != nil {
+		return nil, err
+	}
+
+	// the text to replace must identify exactly one place in the section, so that the edit does what the Agent intended
+	if oldContent == "" {
+		return nil, fmt.Errorf("oldContent must not be empty; to add information to section \"%s\", use coreMemoryAppend", section)
+	}
+	switch count := strings.Count(memoryBlock.data, oldContent); count {
+	case 0:
+		return nil, fmt.Errorf("oldContent was not found in section \"%s\"; it must match the existing text exactly, including case and punctuation. "+
+			"The section currently contains:\n%s", section, memoryBlock.data)
+	case 1:
+	default:
+		return nil, fmt.Errorf("oldContent appears %d times in section \"%s\"; include more of the surrounding text so that it matches exactly one place", count, section)
+	}
 
-func (llm *Agent) archivalSearch(query string, requestHeartbeat bool) /*[]string*/ {
-	llm.HeartbeatState = requestHeartbeat
+	data := strings.Replace(memoryBlock.data, oldContent, newContent, 1)
+	if err := memoryBlock.checkLimit(section, data); err != nil {
+		return nil, err
+	}
+	llm.CoreMemory.recordEdit(ctx, section, MEMORY_EDIT_REPLACE, data, llm.now())
 
+	return &llm.CoreMemory, nil
 }
 
-func (llm *Agent) archivalInsert(newContent string, requestHeartbeat bool) {
-	llm.HeartbeatState = requestHeartbeat
+type coreMemoryReplaceInput struct {
+	Section          string `json:"section" description:"The section of core memory to update. This could be \"User\" (to update information about the user you are talking with), \"Agent\" (to update information about yourself, the agent), or some other user-defined portion of your core memory."`
+	OldContent       string `json:"oldContent" description:"The text information in your core memory that is now outdated and is to be replaced. Must match the existing text exactly and appear only once in the section."`
+	NewContent       string `json:"newContent" description:"The new text information to store in your core memory to replace an existing piece of information."`
+	RequestHeartbeat bool   `json:"requestHeartbeat" description:"Set to 'true' to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to 'false' to end your execution now."`
+}
 
+func (llm *Agent) createCoreMemoryReplaceTool() *Tool {
+	tool := NewTool("coreMemoryReplace",
+		"Takes a piece of existing information about you (the agent) or the human you are chatting with, and replaces this information with a new piece of information.",
+		func(ctx context.Context, input coreMemoryReplaceInput) (*CoreMemory, error) {
+			return llm.coreMemoryReplace(ctx, input.Section, input.OldContent, input.NewContent, input.RequestHeartbeat)
+		})
+	// edits to core memory must be applied in the order in which they were requested
+	tool.Sequential = true
+	return tool
 }
 
 /*
 Pauses the agent loop
 */
-func (llm *Agent) pauseHeartbeats() bool {
-	llm.HeartbeatState = false
+func (llm *Agent) pauseHeartbeats(ctx context.Context) bool {
+	setHeartbeatRequest(ctx, HEARTBEAT_PAUSED)
 	return true
 }
 
@@ -277,22 +460,13 @@ func (llm *Agent) createPauseHeartbeatsTool() *Tool {
 			Properties: map[string]Property{},
 			Required:   []string{},
 		},
-		Function: func(args ...any) any {
-			return llm.pauseHeartbeats()
+		Function: func(ctx context.Context, args ...any) (any, error) {
+			return llm.pauseHeartbeats(ctx), nil
 		},
+		Sequential: true,
 	}
 }
 
-/* Functions to clear space in the context window */
-
-// func (llm Agent) recursiveSummarization() {
-
-// }
-
-// func (llm *Agent) flushMemory() {
-
-// }
-
 // func (llm *Agent) addMemoryUpdateToChatHistory(content Content, memoryBlock MemoryBlock) {
 // 	llm.Messages = append(llm.Messages,
 // 		Message{Role: "user",
@@ -0,0 +1,223 @@
+/*
+Versioned core memory: every edit to a block of core memory is recorded, so that changes can be audited, compared and rolled back
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Possible values for the Operation of a MemoryEdit
+*/
+const (
+	MEMORY_EDIT_APPEND   = "append"   // the Agent appended to the block with coreMemoryAppend
+	MEMORY_EDIT_REPLACE  = "replace"  // the Agent replaced part of the block with coreMemoryReplace
+	MEMORY_EDIT_SET      = "set"      // the program replaced the contents of the block with SetBlockValue
+	MEMORY_EDIT_ROLLBACK = "rollback" // the block was rolled back to an earlier version
+	MEMORY_EDIT_REMOVE   = "remove"   // the block was removed with RemoveBlock; a block added later with the same label starts again at version 0
+)
+
+/*
+A single recorded edit to a block of core memory
+*/
+type MemoryEdit struct {
+	Block     string    `json:"block"`   // the label of the edited block
+	Version   int       `json:"version"` // the version of the block created by this edit; the first edit to a block creates version 1, and removing it resets it to 0
+	Operation string    `json:"operation"`
+	Before    string    `json:"before"`
+	After     string    `json:"after"`
+	ToolUseID string    `json:"toolUseId,omitempty"` // the tool_use that made the edit, if it was made by the Agent
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type toolUseIDKey struct{}
+
+/*
+Returns a copy of the context that carries the ID of the tool_use being executed
+*/
+func contextWithToolUseID(ctx context.Context, toolUseID string) context.Context {
+	return context.WithValue(ctx, toolUseIDKey{}, toolUseID)
+}
+
+/*
+Returns the ID of the tool_use being executed, or "" when the context does not belong to a tool call
+*/
+func ToolUseIDFromContext(ctx context.Context) string {
+	toolUseID, _ := ctx.Value(toolUseIDKey{}).(string)
+	return toolUseID
+}
+
+/*
+Records an edit to a block, made at the given time, and applies it.
+Must be given the block's contents after the edit; edits that change nothing are not recorded.
+*/
+func (coreMemory *CoreMemory) recordEdit(ctx context.Context, label string, operation string, after string, now time.Time) {
+	memoryBlock := coreMemory.Blocks[label]
+	if memoryBlock.data == after {
+		return
+	}
+
+	edit := MemoryEdit{
+		Block:     label,
+		Version:   coreMemory.BlockVersion(label) + 1,
+		Operation: operation,
+		Before:    memoryBlock.data,
+		After:     after,
+		ToolUseID: ToolUseIDFromContext(ctx),
+		Timestamp: now,
+	}
+	coreMemory.edits = append(coreMemory.edits, edit)
+	memoryBlock.setData(after, now)
+	if coreMemory.onEdit != nil {
+		coreMemory.onEdit(edit)
+	}
+}
+
+/*
+Records that a block was removed, so that the edits made to it do not carry over to a block that is later added with the same label
+*/
+func (coreMemory *CoreMemory) recordRemoval(label string, before string, now time.Time) {
+	edit := MemoryEdit{Block: label, Version: 0, Operation: MEMORY_EDIT_REMOVE, Before: before, Timestamp: now}
+	coreMemory.edits = append(coreMemory.edits, edit)
+	if coreMemory.onEdit != nil {
+		coreMemory.onEdit(edit)
+	}
+}
+
+/*
+Returns the recorded edits to the block with the given label since it was last added, oldest first.
+An empty label returns the edits to every block, including the removals of blocks.
+*/
+func (coreMemory CoreMemory) EditLog(label string) []MemoryEdit {
+	edits := make([]MemoryEdit, 0)
+	for _, edit := range coreMemory.edits {
+		if label == "" {
+			edits = append(edits, edit)
+		} else if edit.Block == label && edit.Operation == MEMORY_EDIT_REMOVE {
+			edits = edits[:0]
+		} else if edit.Block == label {
+			edits = append(edits, edit)
+		}
+	}
+	return edits
+}
+
+/*
+Returns the current version of the block, i.e. the number of recorded edits to it since it was added.
+Version 0 is the block's contents before its first recorded edit.
+*/
+func (coreMemory CoreMemory) BlockVersion(label string) int {
+	version := 0
+	for _, edit := range coreMemory.edits {
+		if edit.Block == label {
+			version = edit.Version
+		}
+	}
+	return version
+}
+
+/*
+Returns the contents of the block at the given version
+*/
+func (coreMemory CoreMemory) BlockAtVersion(label string, version int) (string, error) {
+	memoryBlock, ok := coreMemory.Blocks[label]
+	if !ok {
+		return "", fmt.Errorf("section \"%s\" does not exist in core memory", label)
+	}
+
+	current := coreMemory.BlockVersion(label)
+	if version < 0 || version > current {
+		return "", fmt.Errorf("section \"%s\" has no version %d; its versions range from 0 to %d", label, version, current)
+	}
+	if version == current {
+		return memoryBlock.data, nil
+	}
+
+	for _, edit := range coreMemory.EditLog(label) {
+		if version == 0 {
+			return edit.Before, nil
+		}
+		if edit.Version == version {
+			return edit.After, nil
+		}
+	}
+	return memoryBlock.data, nil
+}
+
+/*
+Returns a line-by-line diff between two versions of a block.
+Lines only in the from version are prefixed with "- ", lines only in the to version with "+ ", and unchanged lines with "  ".
+*/
+func (coreMemory CoreMemory) DiffBlockVersions(label string, from int, to int) (string, error) {
+	before, err := coreMemory.BlockAtVersion(label, from)
+	if err != nil {
+		return "", err
+	}
+	after, err := coreMemory.BlockAtVersion(label, to)
+	if err != nil {
+		return "", err
+	}
+	return diffLines(before, after), nil
+}
+
+/*
+Restores the block to the contents it had at an earlier version.
+The rollback is itself recorded as a new version, so it can be undone.
+*/
+func (coreMemory *CoreMemory) RollbackBlock(label string, version int) error {
+	data, err := coreMemory.BlockAtVersion(label, version)
+	if err != nil {
+		return err
+	}
+	if err := coreMemory.Blocks[label].checkLimit(label, data); err != nil {
+		return err
+	}
+	coreMemory.recordEdit(context.Background(), label, MEMORY_EDIT_ROLLBACK, data, coreMemory.now())
+	return nil
+}
+
+/*
+Computes a line-based diff using the longest common subsequence of the lines
+*/
+func diffLines(before string, after string) string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var builder strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			builder.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			builder.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			builder.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockVersions(t *testing.T) {
+	agent := newMemoryTestAgent(t, "v0")
+	for _, value := range []string{"v1", "v2", "v2", "v3"} {
+		if err := agent.CoreMemory.SetBlockValue("Notes", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// setting the same value twice is not an edit
+	if version := agent.CoreMemory.BlockVersion("Notes"); version != 3 {
+		t.Fatalf("BlockVersion = %d, want 3", version)
+	}
+	tests := []struct {
+		version int
+		want    string
+		wantErr bool
+	}{
+		{version: 0, want: "v0"},
+		{version: 1, want: "v1"},
+		{version: 3, want: "v3"},
+		{version: 4, wantErr: true},
+		{version: -1, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := agent.CoreMemory.BlockAtVersion("Notes", test.version)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("BlockAtVersion(%d) = %q, %v; want %q, error: %v", test.version, got, err, test.want, test.wantErr)
+		}
+	}
+
+	if err := agent.CoreMemory.RollbackBlock("Notes", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := agent.CoreMemory.Blocks["Notes"].Value(); got != "v1" {
+		t.Errorf("after rolling back to version 1 the block contains %q, want \"v1\"", got)
+	}
+	edits := agent.CoreMemory.EditLog("Notes")
+	if last := edits[len(edits)-1]; last.Operation != MEMORY_EDIT_ROLLBACK || last.Version != 4 || last.Before != "v3" {
+		t.Errorf("the rollback was recorded as %+v, want version 4 replacing \"v3\"", last)
+	}
+}
+
+func TestRemovedBlockHistory(t *testing.T) {
+	agent := newMemoryTestAgent(t, "old")
+	if err := agent.CoreMemory.SetBlockValue("Notes", "older"); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.CoreMemory.RemoveBlock("Notes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.AddMemoryBlock(MemoryBlockConfig{Label: "Notes", Limit: 20, Value: "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if version := agent.CoreMemory.BlockVersion("Notes"); version != 0 {
+		t.Errorf("the re-added block is at version %d, want 0", version)
+	}
+	if edits := agent.CoreMemory.EditLog("Notes"); len(edits) != 0 {
+		t.Errorf("the re-added block has the edits %+v of the removed block", edits)
+	}
+	if _, err := agent.CoreMemory.BlockAtVersion("Notes", 1); err == nil {
+		t.Errorf("the re-added block has a version 1 before it was edited")
+	}
+
+	if err := agent.CoreMemory.SetBlockValue("Notes", "newer"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := agent.CoreMemory.BlockAtVersion("Notes", 0); err != nil || got != "new" {
+		t.Errorf("BlockAtVersion(0) = %q, %v; want \"new\"", got, err)
+	}
+	// the full log keeps the history of the removed block, so that it is still saved
+	if edits := agent.CoreMemory.EditLog(""); len(edits) != 3 || edits[1].Operation != MEMORY_EDIT_REMOVE {
+		t.Errorf("EditLog(\"\") = %+v, want the edit, the removal and the new edit", edits)
+	}
+}
+
+func TestMemoryEditsUseAgentClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.Clock = clock
+
+	edit := func(name string, recorded bool, do func() error) {
+		t.Helper()
+		clock.Advance(time.Minute)
+		before := len(agent.CoreMemory.EditLog(""))
+		if err := do(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		edits := agent.CoreMemory.EditLog("")
+		if recorded != (len(edits) > before) {
+			t.Fatalf("%s recorded %d edits, want an edit: %v", name, len(edits)-before, recorded)
+		}
+		if recorded && !edits[len(edits)-1].Timestamp.Equal(clock.Now()) {
+			t.Errorf("%s was recorded at %v, want %v", name, edits[len(edits)-1].Timestamp, clock.Now())
+		}
+		if block, ok := agent.CoreMemory.Blocks["Notes"]; ok && !block.LastEdited().Equal(clock.Now()) {
+			t.Errorf("after %s the block was last edited at %v, want %v", name, block.LastEdited(), clock.Now())
+		}
+	}
+	edit("AddMemoryBlock", false, func() error {
+		return agent.AddMemoryBlock(MemoryBlockConfig{Label: "Notes", Limit: 20, Value: "v0"})
+	})
+	edit("SetBlockValue", true, func() error { return agent.CoreMemory.SetBlockValue("Notes", "v1") })
+	edit("RollbackBlock", true, func() error { return agent.CoreMemory.RollbackBlock("Notes", 0) })
+	edit("RemoveMemoryBlock", true, func() error { return agent.RemoveMemoryBlock("Notes") })
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		after  string
+		want   string
+	}{
+		{"unchanged", "a\nb", "a\nb", "  a\n  b\n"},
+		{"added line", "a\nb", "a\nx\nb", "  a\n+ x\n  b\n"},
+		{"removed line", "a\nb\nc", "a\nc", "  a\n- b\n  c\n"},
+		{"changed line", "a\nb", "a\nc", "  a\n- b\n+ c\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := diffLines(test.before, test.after); got != test.want {
+				t.Errorf("diffLines(%q, %q) =\n%s\nwant\n%s", test.before, test.after, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryEditsRecordToolUse(t *testing.T) {
+	agent := NewAgentWithProvider("test-model", "A helpful assistant.", "tester", &fakeProvider{responses: []AgentResponse{
+		toolUseResponse("toolu_7", "coreMemoryAppend", map[string]any{"section": "User", "newContent": "Likes tea.", "requestHeartbeat": false}),
+	}})
+	agent.AddUserMessage("I like tea.")
+	if _, err := agent.Step(context.Background(), DefaultRunOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.CoreMemory.SetBlockValue("User", "Likes coffee."); err != nil {
+		t.Fatal(err)
+	}
+
+	edits := agent.CoreMemory.EditLog("User")
+	if len(edits) != 2 {
+		t.Fatalf("EditLog = %+v, want 2 edits", edits)
+	}
+	if edit := edits[0]; edit.Operation != MEMORY_EDIT_APPEND || edit.ToolUseID != "toolu_7" || edit.Version != 1 {
+		t.Errorf("the Agent's edit was recorded as %+v", edit)
+	}
+	if edit := edits[1]; edit.Operation != MEMORY_EDIT_SET || edit.ToolUseID != "" || edit.Version != 2 {
+		t.Errorf("the program's edit was recorded as %+v", edit)
+	}
+
+	diff, err := agent.CoreMemory.DiffBlockVersions("User", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "- Likes tea.\n+ Likes coffee.\n"; !strings.Contains(diff, want) {
+		t.Errorf("DiffBlockVersions(1, 2) =\n%s\nwant it to contain\n%s", diff, want)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+/*
+Returns an Agent with a "Notes" block holding the given value, limited to 20 characters, and a read-only "Rules" block
+*/
+func newMemoryTestAgent(t *testing.T, notes string) *Agent {
+	agent, _ := newTestAgent(&fakeProvider{})
+	if err := agent.AddMemoryBlock(MemoryBlockConfig{Label: "Notes", Limit: 20, Value: notes}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.AddMemoryBlock(MemoryBlockConfig{Label: "Rules", Value: "Be kind.", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	return agent
+}
+
+func TestCoreMemoryAppend(t *testing.T) {
+	tests := []struct {
+		name     string
+		notes    string
+		section  string
+		content  string
+		want     string
+		errorHas string
+	}{
+		{name: "separated by a newline", notes: "likes tea", section: "Notes", content: "has a cat", want: "likes tea\nhas a cat"},
+		{name: "exactly at the limit", notes: "1234567890", section: "Notes", content: "123456789", want: "1234567890\n123456789"},
+		{name: "empty block", section: "Notes", content: "likes tea", want: "likes tea"},
+		{name: "limit counts characters, not bytes", section: "Notes", content: "ünïcödé ünïcödé", want: "ünïcödé ünïcödé"},
+		{name: "over the limit", notes: "1234567890", section: "Notes", content: "1234567890", errorHas: "limited to 20 characters"},
+		{name: "read-only block", section: "Rules", content: "Be rude.", errorHas: "read-only"},
+		{name: "unknown block", section: "Diary", content: "Dear diary", errorHas: "valid sections are"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMemoryTestAgent(t, test.notes)
+			_, err := agent.coreMemoryAppend(context.Background(), test.section, test.content, false)
+			checkMemoryEdit(t, agent, err, test.section, test.want, test.errorHas)
+		})
+	}
+}
+
+func TestCoreMemoryReplace(t *testing.T) {
+	tests := []struct {
+		name       string
+		notes      string
+		section    string
+		oldContent string
+		newContent string
+		want       string
+		errorHas   string
+	}{
+		{name: "replaces the match", notes: "likes tea", section: "Notes", oldContent: "tea", newContent: "coffee", want: "likes coffee"},
+		{name: "removes the match", notes: "likes tea\nhas a cat", section: "Notes", oldContent: "\nhas a cat", want: "likes tea"},
+		{name: "no match", notes: "likes tea", section: "Notes", oldContent: "Tea", newContent: "coffee", errorHas: "was not found"},
+		{name: "several matches", notes: "tea, more tea", section: "Notes", oldContent: "tea", newContent: "coffee", errorHas: "appears 2 times"},
+		{name: "empty old content", notes: "likes tea", section: "Notes", newContent: "coffee", errorHas: "must not be empty"},
+		{name: "over the limit", notes: "likes tea", section: "Notes", oldContent: "tea", newContent: "green tea with honey", errorHas: "limited to 20 characters"},
+		{name: "read-only block", section: "Rules", oldContent: "kind", newContent: "rude", errorHas: "read-only"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newMemoryTestAgent(t, test.notes)
+			_, err := agent.coreMemoryReplace(context.Background(), test.section, test.oldContent, test.newContent, false)
+			checkMemoryEdit(t, agent, err, test.section, test.want, test.errorHas)
+		})
+	}
+}
+
+/*
+Checks that an edit either failed with an error containing errorHas, leaving the block as it was, or left the block containing want
+*/
+func checkMemoryEdit(t *testing.T, agent *Agent, err error, section string, want string, errorHas string) {
+	t.Helper()
+	if errorHas != "" {
+		if err == nil || !strings.Contains(err.Error(), errorHas) {
+			t.Fatalf("the edit returned error %v, want an error containing %q", err, errorHas)
+		}
+		if version := agent.CoreMemory.BlockVersion(section); version != 0 {
+			t.Errorf("the failed edit was recorded as version %d", version)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("the edit returned an error: %v", err)
+	}
+	if got := agent.CoreMemory.Blocks[section].Value(); got != want {
+		t.Errorf("the block contains %q, want %q", got, want)
+	}
+}
+
+func TestMemoryBlocks(t *testing.T) {
+	agent := newMemoryTestAgent(t, "likes tea")
+	sectionEnum := func() []string {
+		return agent.toolMap()["coreMemoryAppend"].InputSchema.Properties["section"].Enum
+	}
+	// read-only blocks are not offered to the memory tools
+	if got := sectionEnum(); strings.Join(got, ",") != "Agent,User,Notes" {
+		t.Errorf("the memory tools offer the sections %v", got)
+	}
+
+	if err := agent.AddMemoryBlock(MemoryBlockConfig{Label: "Notes"}); err == nil {
+		t.Error("added a second block labelled \"Notes\"")
+	}
+	if err := agent.AddMemoryBlock(MemoryBlockConfig{Label: "Tiny", Limit: 3, Value: "too long"}); err == nil {
+		t.Error("added a block whose value is over its limit")
+	}
+	if err := agent.RemoveMemoryBlock("Notes"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sectionEnum(); strings.Join(got, ",") != "Agent,User" {
+		t.Errorf("after removing the Notes block, the memory tools offer the sections %v", got)
+	}
+	if err := agent.RemoveMemoryBlock("Notes"); err == nil {
+		t.Error("removed the Notes block twice")
+	}
+
+	// the program can update read-only blocks, within their limit
+	if err := agent.CoreMemory.SetBlockValue("Rules", "Be kind and brief."); err != nil {
+		t.Fatal(err)
+	}
+	if got := agent.CoreMemory.Blocks["Rules"].Value(); got != "Be kind and brief." {
+		t.Errorf("the Rules block contains %q after SetBlockValue", got)
+	}
+	if err := agent.CoreMemory.SetBlockValue("User", strings.Repeat("a", DEFAULT_BLOCK_SIZE+1)); err == nil {
+		t.Error("SetBlockValue exceeded the limit of the User block")
+	}
+}
+
+func TestCompileSystemPrompt(t *testing.T) {
+	provider := &fakeProvider{responses: []AgentResponse{
+		toolUseResponse("call_1", "coreMemoryAppend", map[string]any{"section": "User", "newContent": "Name: Sam", "requestHeartbeat": true}),
+	}}
+	agent := NewAgentWithProvider("test-model", "A helpful assistant.", "tester", provider)
+	if err := agent.AddMemoryBlock(MemoryBlockConfig{Label: "Rules", Description: "How to behave.", Limit: 100, Value: "Be kind.", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	agent.AddUserMessage("Hi, I'm Sam.")
+	if _, err := agent.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(provider.requests) != 2 {
+		t.Fatalf("the agent sent %d requests, want 2", len(provider.requests))
+	}
+	// the edit made by the first step is visible to the second one
+	before, after := systemText(provider.requests[0]), systemText(provider.requests[1])
+	if strings.Contains(before, "Name: Sam") || !strings.Contains(after, "Name: Sam") {
+		t.Errorf("the system prompts were\n%s\nand\n%s\nwant only the second to contain the edit", before, after)
+	}
+
+	persona, human, rules := strings.Index(after, "<persona"), strings.Index(after, "<human"), strings.Index(after, "<rules")
+	if persona < 0 || human < persona || rules < human {
+		t.Errorf("the blocks are not shown in the order persona, human, rules:\n%s", after)
+	}
+	for _, want := range []string{
+		`<human label="User" characters="`,
+		`<rules label="Rules" characters="8/100" last_edited="`,
+		"read_only=\"true\">\n<description>How to behave.</description>\nBe kind.\n</rules>",
+	} {
+		if !strings.Contains(after, want) {
+			t.Errorf("the system prompt does not contain %q:\n%s", want, after)
+		}
+	}
+	if len(agent.System) != 1 {
+		t.Errorf("compiling the system prompt changed the agent's instructions to %+v", agent.System)
+	}
+}
+
+/*
+Returns the text of the system prompt of a request
+*/
+func systemText(request AgentRequest) string {
+	texts := make([]string, 0, len(request.System))
+	for _, content := range request.System {
+		texts = append(texts, content.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+func TestXMLTagName(t *testing.T) {
+	tests := []struct {
+		sectionName string
+		label       string
+		want        string
+	}{
+		{"persona", "Agent", "persona"},
+		{"Project Notes", "Project Notes", "project_notes"},
+		{"  2024 plans ", "Plans", "block_2024_plans"},
+		{"***", "Todo", "todo"},
+		{"", "", "block_"},
+	}
+	for _, test := range tests {
+		if got := xmlTagName(test.sectionName, test.label); got != test.want {
+			t.Errorf("xmlTagName(%q, %q) = %q, want %q", test.sectionName, test.label, got, test.want)
+		}
+	}
+}
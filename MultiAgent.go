@@ -0,0 +1,368 @@
+/*
+Multi-agent messaging: agents in the same process sending messages to each other, so that one agent can delegate work to another.
+A message is delivered to the receiving agent as an agent_message event and the receiving agent is run in response to it.
+Both sides of the exchange end up in the agents' recall memory: the sender's tool call and its result (with the reply),
+and the receiver's event and the messages it replied with.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest chain of agents messaging each other (A -> B -> C is 2 hops) allowed by an AgentRegistry without MaxHops
+const DEFAULT_MAX_AGENT_HOPS int = 3
+
+// How long sendMessageToAgent waits for a busy agent when the registry does not set a BusyTimeout
+const DEFAULT_AGENT_BUSY_TIMEOUT time.Duration = 30 * time.Second
+
+// The type of the event that delivers a message from another agent
+const USER_EVENT_AGENT_MESSAGE = "agent_message"
+
+/*
+The tools that Register gives an agent. They only work while the agent is registered, so they are not saved with it;
+registering the restored agent gives them back.
+*/
+var agentMessagingTools = map[string]bool{"sendMessageToAgent": true, "sendMessageToAgentAsync": true, "listAgents": true}
+
+/*
+A message from another agent
+*/
+type InterAgentMessage struct {
+	From            string `json:"from"` // the name of the sending agent
+	Message         string `json:"message"`
+	WaitingForReply bool   `json:"waitingForReply"` // whether the sender is waiting for the messages sent with sendMessage in response
+}
+
+func (InterAgentMessage) EventType() string { return USER_EVENT_AGENT_MESSAGE }
+
+func (event InterAgentMessage) validate() error {
+	if event.From == "" || event.Message == "" {
+		return fmt.Errorf("a message from an agent must name the sender and must not be empty")
+	}
+	return nil
+}
+
+type agentChainKey struct{}
+
+/*
+Returns the IDs of the agents that the message being handled passed through, oldest first
+*/
+func agentChainFromContext(ctx context.Context) []string {
+	chain, _ := ctx.Value(agentChainKey{}).([]string)
+	return chain
+}
+
+/*
+An agent that other agents can send messages to
+*/
+type registeredAgent struct {
+	agent *Agent
+	role  string
+	lock  sync.Locker
+}
+
+/*
+The agents in this process that can message each other
+*/
+type AgentRegistry struct {
+	// The longest chain of agents messaging each other; 0 uses DEFAULT_MAX_AGENT_HOPS
+	MaxHops int
+	// How long a synchronous message waits for a busy agent before giving up; 0 uses DEFAULT_AGENT_BUSY_TIMEOUT
+	BusyTimeout time.Duration
+	// Controls the runs of agents that receive a message
+	RunOptions RunOptions
+	/*
+		Called when an agent has handled a message, while its lock is still held, e.g. to save the agent or log errors.
+		Errors of messages sent with sendMessageToAgentAsync, which no one waits for, are logged unless they were passed to it.
+	*/
+	OnDelivered func(agent *Agent, result *RunResult, err error)
+
+	mu     sync.RWMutex
+	agents map[string]*registeredAgent // by ID
+	async  sync.WaitGroup              // asynchronous deliveries in progress
+}
+
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{RunOptions: DefaultRunOptions(), agents: make(map[string]*registeredAgent)}
+}
+
+/*
+Makes the agent reachable by other agents, giving it the tools to message them.
+The role describes what the agent does, for the agents deciding whom to message.
+The lock, if not nil, is held while the agent handles a message, so that it does not overlap other uses of the agent.
+*/
+func (registry *AgentRegistry) Register(agent *Agent, role string, lock sync.Locker) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for id, other := range registry.agents {
+		if id != agent.ID && other.agent.Name == agent.Name {
+			return fmt.Errorf("an agent named %q is already registered", agent.Name)
+		}
+	}
+	if lock == nil {
+		lock = &sync.Mutex{}
+	}
+	registry.agents[agent.ID] = &registeredAgent{agent: agent, role: role, lock: lock}
+
+	for _, create := range []ToolFactory{registry.createSendMessageToAgentTool, registry.createSendMessageToAgentAsyncTool, registry.createListAgentsTool} {
+		tool := create(agent)
+		if _, ok := agent.toolMap()[tool.Name]; !ok {
+			agent.Tools = append(agent.Tools, *tool)
+		}
+	}
+	return nil
+}
+
+/*
+Makes the agent with the given ID unreachable by other agents. The agent keeps its tools.
+*/
+func (registry *AgentRegistry) Unregister(agentID string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.agents, agentID)
+}
+
+/*
+Waits for every asynchronous message to be handled
+*/
+func (registry *AgentRegistry) Wait() {
+	registry.async.Wait()
+}
+
+/*
+Returns the registered agent with the given name or ID, listing the agents other than the sender if there is none
+*/
+func (registry *AgentRegistry) lookup(nameOrID string, sender *Agent) (*registeredAgent, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for _, entry := range registry.agents {
+		if entry.agent.ID == nameOrID || entry.agent.Name == nameOrID {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no agent named %q. %s", nameOrID, registry.directory(sender.ID))
+}
+
+/*
+Describes the agents that can be messaged, other than the one with the given ID
+*/
+func (registry *AgentRegistry) directory(excludeID string) string {
+	lines := make([]string, 0, len(registry.agents))
+	for _, entry := range registry.agents {
+		if entry.agent.ID == excludeID {
+			continue
+		}
+		line := "- " + entry.agent.Name
+		if entry.role != "" {
+			line += ": " + entry.role
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "There are no other agents to message."
+	}
+	sort.Strings(lines)
+	return "The agents you can message are:\n" + strings.Join(lines, "\n")
+}
+
+/*
+Checks that the message may be sent, returning the chain of agents that the receiver's run continues
+*/
+func (registry *AgentRegistry) route(ctx context.Context, sender *Agent, receiver *Agent, wait bool) ([]string, error) {
+	if receiver.ID == sender.ID {
+		return nil, fmt.Errorf("you cannot send a message to yourself")
+	}
+	chain := append(append([]string(nil), agentChainFromContext(ctx)...), sender.ID)
+
+	maxHops := registry.MaxHops
+	if maxHops <= 0 {
+		maxHops = DEFAULT_MAX_AGENT_HOPS
+	}
+	if len(chain) > maxHops {
+		return nil, fmt.Errorf("the message cannot be sent: it would be more than %d hops from the agent that started the conversation", maxHops)
+	}
+	// the agents earlier in the chain are waiting for this one to finish, so they could never handle a message that waits for them
+	if wait {
+		for _, id := range chain {
+			if id == receiver.ID {
+				return nil, fmt.Errorf("the message cannot be sent: %s is already waiting on this conversation, so it cannot handle a message that waits for a reply; use sendMessageToAgentAsync instead", receiver.Name)
+			}
+		}
+	}
+	return chain, nil
+}
+
+/*
+Delivers a message to the receiver and runs it, returning the messages that it sent with sendMessage
+*/
+func (registry *AgentRegistry) deliver(ctx context.Context, chain []string, sender *Agent, receiver *registeredAgent, text string, wait bool) ([]AgentMessage, *RunResult, error) {
+	agent := receiver.agent
+	// the receiver may have been unregistered, e.g. deleted, while the message waited for its lock
+	registry.mu.RLock()
+	registered := registry.agents[agent.ID] == receiver
+	registry.mu.RUnlock()
+	if !registered {
+		return nil, nil, fmt.Errorf("%s is no longer available", agent.Name)
+	}
+	replies := make([]AgentMessage, 0)
+	output := agent.Output
+	if wait {
+		agent.Output = SinkFunc(func(ctx context.Context, message AgentMessage) error {
+			replies = append(replies, message)
+			return nil
+		})
+	} else {
+		agent.Output = SinkFunc(func(ctx context.Context, message AgentMessage) error {
+			return fmt.Errorf("%s is not waiting for a reply; send it one with sendMessageToAgentAsync", sender.Name)
+		})
+	}
+	defer func() { agent.Output = output }()
+
+	ctx = context.WithValue(ctx, agentChainKey{}, chain)
+	event := InterAgentMessage{From: sender.Name, Message: text, WaitingForReply: wait}
+	result, err := agent.HandleEvent(ctx, event, registry.RunOptions)
+	if registry.OnDelivered != nil {
+		registry.OnDelivered(agent, result, err)
+	}
+	return replies, result, err
+}
+
+/*
+Acquires the lock, giving up when the timeout passes or the context is cancelled.
+Returns whether the lock was acquired.
+*/
+func lockWithTimeout(ctx context.Context, lock sync.Locker, timeout time.Duration) bool {
+	acquired := make(chan struct{})
+	go func() {
+		lock.Lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return true
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+	// releasing the lock once it is eventually acquired
+	go func() {
+		<-acquired
+		lock.Unlock()
+	}()
+	return false
+}
+
+/*
+Sends a message to another agent and waits for its reply
+*/
+func (registry *AgentRegistry) sendMessageToAgent(ctx context.Context, sender *Agent, to string, text string) (string, error) {
+	receiver, err := registry.lookup(to, sender)
+	if err != nil {
+		return "", err
+	}
+	chain, err := registry.route(ctx, sender, receiver.agent, true)
+	if err != nil {
+		return "", err
+	}
+
+	timeout := registry.BusyTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_AGENT_BUSY_TIMEOUT
+	}
+	if !lockWithTimeout(ctx, receiver.lock, timeout) {
+		return "", fmt.Errorf("%s is busy; try again later, or use sendMessageToAgentAsync", receiver.agent.Name)
+	}
+	defer receiver.lock.Unlock()
+
+	replies, _, err := registry.deliver(ctx, chain, sender, receiver, text, true)
+	if err != nil && len(replies) == 0 {
+		return "", fmt.Errorf("%s could not handle the message: %w", receiver.agent.Name, err)
+	}
+	if len(replies) == 0 {
+		return fmt.Sprintf("%s did not reply.", receiver.agent.Name), nil
+	}
+	texts := make([]string, 0, len(replies))
+	for _, reply := range replies {
+		texts = append(texts, reply.Text)
+	}
+	return fmt.Sprintf("Reply from %s:\n%s", receiver.agent.Name, strings.Join(texts, "\n")), nil
+}
+
+/*
+Sends a message to another agent without waiting for it to be handled
+*/
+func (registry *AgentRegistry) sendMessageToAgentAsync(ctx context.Context, sender *Agent, to string, text string) (string, error) {
+	receiver, err := registry.lookup(to, sender)
+	if err != nil {
+		return "", err
+	}
+	chain, err := registry.route(ctx, sender, receiver.agent, false)
+	if err != nil {
+		return "", err
+	}
+
+	// the message is handled after the sender's tool call, and possibly its run, has ended
+	ctx = context.WithoutCancel(ctx)
+	registry.async.Add(1)
+	go func() {
+		defer registry.async.Done()
+		receiver.lock.Lock()
+		defer receiver.lock.Unlock()
+		// the receiver was not run, and OnDelivered not called, when the result is nil
+		_, result, err := registry.deliver(ctx, chain, sender, receiver, text, false)
+		if err != nil && (registry.OnDelivered == nil || result == nil) {
+			log.Printf("error delivering a message from %s to %s: %v", sender.Name, receiver.agent.Name, err)
+		}
+	}()
+	return fmt.Sprintf("Message sent to %s.", receiver.agent.Name), nil
+}
+
+type sendMessageToAgentInput struct {
+	Agent   string `json:"agent" description:"The name of the agent to send the message to."`
+	Message string `json:"message" description:"The message to send. Include everything the agent needs to know, since it does not see your conversation."`
+}
+
+func (registry *AgentRegistry) createSendMessageToAgentTool(agent *Agent) *Tool {
+	tool := NewTool("sendMessageToAgent",
+		"Send a message to another agent and wait for its reply, e.g. to delegate a task to an agent that specializes in it or to ask it a question. "+
+			"The reply (the messages the agent sends back with sendMessage) is returned as the result of this call. "+
+			"Use listAgents to find out which agents you can message. "+
+			"The user does not see messages between agents, so tell the user about anything they need to know with sendMessage.",
+		func(ctx context.Context, input sendMessageToAgentInput) (string, error) {
+			return registry.sendMessageToAgent(ctx, agent, input.Agent, input.Message)
+		})
+	tool.Sequential = true
+	return tool
+}
+
+func (registry *AgentRegistry) createSendMessageToAgentAsyncTool(agent *Agent) *Tool {
+	tool := NewTool("sendMessageToAgentAsync",
+		"Send a message to another agent without waiting for it to be handled, e.g. to hand off a task or to pass on information. "+
+			"The call returns as soon as the message is sent, and nothing the agent does in response is returned to you; "+
+			"it may message you back later with sendMessageToAgentAsync. "+
+			"Use listAgents to find out which agents you can message.",
+		func(ctx context.Context, input sendMessageToAgentInput) (string, error) {
+			return registry.sendMessageToAgentAsync(ctx, agent, input.Agent, input.Message)
+		})
+	tool.Sequential = true
+	return tool
+}
+
+type listAgentsInput struct{}
+
+func (registry *AgentRegistry) createListAgentsTool(agent *Agent) *Tool {
+	return NewTool("listAgents",
+		"List the other agents that you can send messages to with sendMessageToAgent and sendMessageToAgentAsync, along with what each of them does.",
+		func(ctx context.Context, input listAgentsInput) (string, error) {
+			registry.mu.RLock()
+			defer registry.mu.RUnlock()
+			return registry.directory(agent.ID), nil
+		})
+}
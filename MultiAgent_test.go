@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Returns a registry with a manager and a helper whose provider replies to every message with the given text
+*/
+func newTestRegistry(t *testing.T, reply string) (*AgentRegistry, *Agent, *Agent) {
+	t.Helper()
+	registry := NewAgentRegistry()
+	manager := NewAgentWithProvider("test-model", "", "manager", &fakeProvider{})
+	helper := NewAgentWithProvider("test-model", "", "helper", &fakeProvider{responses: []AgentResponse{
+		toolUseResponse("call_1", "sendMessage", map[string]any{"message": reply}),
+	}})
+	if err := registry.Register(manager, "Plans the work", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(helper, "Does arithmetic", nil); err != nil {
+		t.Fatal(err)
+	}
+	return registry, manager, helper
+}
+
+func TestAgentRegistryRegister(t *testing.T) {
+	registry, manager, _ := newTestRegistry(t, "4")
+	for _, name := range []string{"sendMessageToAgent", "sendMessageToAgentAsync", "listAgents"} {
+		if _, ok := manager.toolMap()[name]; !ok {
+			t.Errorf("the registered agent has no %s tool", name)
+		}
+	}
+
+	tools := len(manager.Tools)
+	if err := registry.Register(manager, "Plans the work", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(manager.Tools) != tools {
+		t.Errorf("registering the agent again added tools: %d, want %d", len(manager.Tools), tools)
+	}
+
+	impostor := NewAgentWithProvider("test-model", "", "manager", &fakeProvider{})
+	if err := registry.Register(impostor, "", nil); err == nil {
+		t.Errorf("Register accepted a second agent named %q", impostor.Name)
+	}
+
+	if directory := registry.directory(manager.ID); directory != "The agents you can message are:\n- helper: Does arithmetic" {
+		t.Errorf("directory = %q", directory)
+	}
+}
+
+func TestSendMessageToAgent(t *testing.T) {
+	registry, manager, helper := newTestRegistry(t, "4")
+	reply, err := registry.sendMessageToAgent(context.Background(), manager, "helper", "What is 2+2?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Reply from helper:\n4"; reply != want {
+		t.Errorf("sendMessageToAgent = %q, want %q", reply, want)
+	}
+
+	entries := helper.RecallMemory.Entries()
+	if len(entries) == 0 {
+		t.Fatalf("the message was not added to the helper's recall memory")
+	}
+	if eventType := userEventType(messageText(entries[0].Message)); eventType != USER_EVENT_AGENT_MESSAGE {
+		t.Errorf("the first recalled message has type %q, want %q", eventType, USER_EVENT_AGENT_MESSAGE)
+	}
+	if !strings.Contains(messageText(entries[0].Message), `"from":"manager","message":"What is 2+2?","waitingForReply":true`) {
+		t.Errorf("the agent_message event is %q", messageText(entries[0].Message))
+	}
+}
+
+func TestSendMessageToAgentErrors(t *testing.T) {
+	registry, manager, helper := newTestRegistry(t, "4")
+	registry.BusyTimeout = 10 * time.Millisecond
+	tests := []struct {
+		name string
+		ctx  context.Context
+		to   string
+		want string
+	}{
+		{name: "unknown agent", ctx: context.Background(), to: "accountant", want: `there is no agent named "accountant". The agents you can message are:`},
+		{name: "self", ctx: context.Background(), to: "manager", want: "you cannot send a message to yourself"},
+		{name: "cycle", ctx: context.WithValue(context.Background(), agentChainKey{}, []string{helper.ID}), to: "helper", want: "helper is already waiting on this conversation"},
+		{name: "too many hops", ctx: context.WithValue(context.Background(), agentChainKey{}, []string{"a", "b", "c"}), to: "helper", want: "more than 3 hops"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := registry.sendMessageToAgent(test.ctx, manager, test.to, "Hello")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("sendMessageToAgent returned %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	t.Run("busy", func(t *testing.T) {
+		var lock sync.Mutex
+		busy := NewAgentWithProvider("test-model", "", "busy", &fakeProvider{})
+		if err := registry.Register(busy, "", &lock); err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		_, err := registry.sendMessageToAgent(context.Background(), manager, "busy", "Hello")
+		if err == nil || !strings.Contains(err.Error(), "busy is busy") {
+			t.Errorf("sendMessageToAgent returned %v, want a busy error", err)
+		}
+	})
+}
+
+func TestSendMessageToAgentAsync(t *testing.T) {
+	registry, manager, helper := newTestRegistry(t, "4")
+	result, err := registry.sendMessageToAgentAsync(context.Background(), manager, "helper", "Work out 2+2.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Message sent to helper." {
+		t.Errorf("sendMessageToAgentAsync = %q", result)
+	}
+	registry.Wait()
+
+	entries := helper.RecallMemory.Entries()
+	if len(entries) == 0 || !strings.Contains(messageText(entries[0].Message), `"waitingForReply":false`) {
+		t.Fatalf("the helper did not receive the message")
+	}
+	// the reply has nowhere to go, so the sendMessage call fails
+	found := false
+	for _, entry := range entries {
+		for _, content := range entry.Message.Content {
+			if content.Type == "tool_result" && content.IsError && strings.Contains(content.Content, "manager is not waiting for a reply") {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("the helper's reply did not fail")
+	}
+}
+
+func TestRegisteredAgentSaveAndLoad(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, manager, _ := newTestRegistry(t, "4")
+	if err := manager.Save(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load(ctx, "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range state.Tools {
+		if agentMessagingTools[name] {
+			t.Errorf("the messaging tool %s was saved with the agent", name)
+		}
+	}
+
+	// the agent is restored without a registry, and then registered with a new one
+	restored, err := LoadAgent(ctx, store, "manager", RestoreOptions{Provider: &fakeProvider{}})
+	if err != nil {
+		t.Fatalf("restoring the agent without a registry failed: %v", err)
+	}
+	if _, ok := restored.toolMap()["sendMessageToAgent"]; ok {
+		t.Errorf("the agent restored without a registry has the sendMessageToAgent tool")
+	}
+	if err := NewAgentRegistry().Register(restored, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.toolMap()["sendMessageToAgent"]; !ok {
+		t.Errorf("registering the restored agent did not give it the sendMessageToAgent tool")
+	}
+
+	// states saved with the messaging tools are still restored
+	state.Tools = append(state.Tools, "sendMessageToAgent", "listAgents")
+	if _, err := RestoreAgent(ctx, *state, RestoreOptions{Provider: &fakeProvider{}}); err != nil {
+		t.Errorf("restoring a state that includes the messaging tools failed: %v", err)
+	}
+}
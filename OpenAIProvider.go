@@ -0,0 +1,425 @@
+/*
+Provider for OpenAI-compatible chat completions APIs.
+Besides OpenAI itself, this covers local model servers that expose the same API, such as Ollama, vLLM and llama.cpp.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const OPENAI_BASE_URL string = "https://api.openai.com/v1"
+
+type OpenAIProvider struct {
+	/*
+		The base URL of the API, including the version prefix.
+		E.g. "https://api.openai.com/v1", "http://localhost:11434/v1" (Ollama) or "http://localhost:8000/v1" (vLLM)
+	*/
+	BaseURL string
+	// Sent as a bearer token; local servers usually do not require one
+	ApiKey string
+	// The client used to send requests; defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// How failed requests are retried; the zero value disables retries
+	RetryPolicy RetryPolicy
+	// Limits the rate at which requests are sent; nil disables client-side rate limiting
+	RateLimiter *RateLimiter
+}
+
+/*
+Creates a Provider that sends requests to the chat completions API at the given base URL.
+The apiKey argument is optional.
+Failed requests are retried with the DefaultRetryPolicy. No client-side rate limit is applied; set RateLimiter to add one.
+*/
+func NewOpenAIProvider(baseURL string, apiKey ...string) *OpenAIProvider {
+	provider := &OpenAIProvider{BaseURL: baseURL, RetryPolicy: DefaultRetryPolicy()}
+	if len(apiKey) > 0 {
+		provider.ApiKey = apiKey[0]
+	}
+	return provider
+}
+
+type openAIChatRequest struct {
+	Model         string          `json:"model"`
+	Messages      []openAIMessage `json:"messages"`
+	Tools         []openAITool    `json:"tools,omitempty"`
+	ToolChoice    any             `json:"tool_choice,omitempty"`
+	MaxTokens     int             `json:"max_tokens,omitempty"`
+	Temperature   float32         `json:"temperature,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	StreamOptions map[string]bool `json:"stream_options,omitempty"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"` // 'system', 'user', 'assistant' or 'tool'
+	Content    *string          `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"` // only set when streaming
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"` // JSON encoded input parameters
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"` // always "function"
+	Function struct {
+		Name        string      `json:"name"`
+		Description string      `json:"description"`
+		Parameters  InputSchema `json:"parameters"`
+	} `json:"function"`
+}
+
+type openAIChatResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index        int           `json:"index"`
+		Message      openAIMessage `json:"message"`
+		Delta        openAIMessage `json:"delta"` // only set when streaming
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage,omitempty"`
+}
+
+/*
+Translates an AgentRequest into a chat completions request
+*/
+func toOpenAIRequest(reqData AgentRequest) openAIChatRequest {
+	chatRequest := openAIChatRequest{
+		Model:       reqData.Model,
+		MaxTokens:   reqData.MaxTokens,
+		Temperature: reqData.Temperature,
+		Messages:    make([]openAIMessage, 0, len(reqData.Messages)+1),
+	}
+
+	// The system prompt is sent as the first message
+	systemPrompt := make([]string, 0, len(reqData.System))
+	for _, content := range reqData.System {
+		systemPrompt = append(systemPrompt, content.Text)
+	}
+	if len(systemPrompt) > 0 {
+		text := strings.Join(systemPrompt, "\n\n")
+		chatRequest.Messages = append(chatRequest.Messages, openAIMessage{Role: "system", Content: &text})
+	}
+
+	for _, message := range reqData.Messages {
+		chatRequest.Messages = append(chatRequest.Messages, toOpenAIMessages(message)...)
+	}
+
+	for _, tool := range reqData.Tools {
+		openaiTool := openAITool{Type: "function"}
+		openaiTool.Function.Name = tool.Name
+		openaiTool.Function.Description = tool.Description
+		openaiTool.Function.Parameters = tool.InputSchema
+		chatRequest.Tools = append(chatRequest.Tools, openaiTool)
+	}
+
+	switch reqData.ToolChoice["type"] {
+	case "auto":
+		chatRequest.ToolChoice = "auto"
+	case "any":
+		chatRequest.ToolChoice = "required"
+	case "tool":
+		chatRequest.ToolChoice = map[string]any{"type": "function", "function": map[string]string{"name": reqData.ToolChoice["name"]}}
+	}
+
+	return chatRequest
+}
+
+/*
+Translates a single Message into chat completions messages.
+Tool results become separate messages with the 'tool' role, since chat completions does not allow them inside a user message.
+*/
+func toOpenAIMessages(message Message) []openAIMessage {
+	messages := make([]openAIMessage, 0, 1)
+	text := make([]string, 0, len(message.Content))
+	toolCalls := make([]openAIToolCall, 0)
+
+	for _, content := range message.Content {
+		switch content.Type {
+		case "text":
+			text = append(text, content.Text)
+		case "tool_use":
+			arguments, err := json.Marshal(content.Input)
+			if err != nil || content.Input == nil {
+				arguments = []byte("{}")
+			}
+			toolCall := openAIToolCall{ID: content.ID, Type: "function"}
+			toolCall.Function.Name = content.Name
+			toolCall.Function.Arguments = string(arguments)
+			toolCalls = append(toolCalls, toolCall)
+		case "tool_result":
+			result := content.Content
+			if content.IsError && !strings.HasPrefix(result, "Error") {
+				// chat completions has no equivalent of is_error
+				result = "Error: " + result
+			}
+			messages = append(messages, openAIMessage{Role: "tool", Content: &result, ToolCallID: content.ToolUseID})
+		}
+	}
+
+	if len(text) == 0 && len(toolCalls) == 0 {
+		return messages
+	}
+
+	chatMessage := openAIMessage{Role: message.Role}
+	if len(text) > 0 {
+		joined := strings.Join(text, "\n\n")
+		chatMessage.Content = &joined
+	}
+	if len(toolCalls) > 0 {
+		chatMessage.ToolCalls = toolCalls
+	}
+	return append(messages, chatMessage)
+}
+
+/*
+Maps a chat completions finish_reason onto the equivalent Messages API stop_reason
+*/
+func toStopReason(finishReason string) string {
+	switch finishReason {
+	case "stop":
+		return "end_turn"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "length":
+		return "max_tokens"
+	default:
+		return finishReason
+	}
+}
+
+/*
+Parses the input of a tool call from its JSON encoded arguments
+*/
+func parseToolArguments(arguments string) (map[string]any, error) {
+	input := map[string]any{}
+	if strings.TrimSpace(arguments) == "" {
+		return input, nil
+	}
+	if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+		return nil, err
+	}
+	return input, nil
+}
+
+/*
+Translates a chat completions response into an AgentResponse
+*/
+func fromOpenAIResponse(chatResponse openAIChatResponse) (*AgentResponse, error) {
+	response := &AgentResponse{
+		ID:      chatResponse.ID,
+		Model:   chatResponse.Model,
+		Role:    "assistant",
+		Content: []Content{},
+		Usage:   map[string]int{},
+	}
+	if chatResponse.Usage != nil {
+		response.Usage["input_tokens"] = chatResponse.Usage.PromptTokens
+		response.Usage["output_tokens"] = chatResponse.Usage.CompletionTokens
+	}
+	if len(chatResponse.Choices) == 0 {
+		return response, nil
+	}
+
+	choice := chatResponse.Choices[0]
+	response.StopReason = toStopReason(choice.FinishReason)
+	if choice.Message.Content != nil && *choice.Message.Content != "" {
+		response.Content = append(response.Content, Content{Type: "text", Text: *choice.Message.Content})
+	}
+	for i, toolCall := range choice.Message.ToolCalls {
+		id := toolCall.ID
+		if id == "" {
+			// some local servers do not generate IDs for tool calls
+			id = fmt.Sprintf("call_%d", i)
+		}
+		input, err := parseToolArguments(toolCall.Function.Arguments)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input for tool %q: %w", toolCall.Function.Name, err)
+		}
+		response.Content = append(response.Content, Content{Type: "tool_use", ID: id, Name: toolCall.Function.Name, Input: input})
+	}
+	return response, nil
+}
+
+/*
+Sends a request with the given body to the chat completions endpoint, retrying according to the provider's RetryPolicy.
+Returns the response if it was successful; otherwise the error is an *APIError when the API responded with an error.
+*/
+func (provider OpenAIProvider) send(ctx context.Context, body openAIChatRequest) (*http.Response, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request: %w", err)
+	}
+
+	baseURL := provider.BaseURL
+	if baseURL == "" {
+		baseURL = OPENAI_BASE_URL
+	}
+	url := strings.TrimSuffix(baseURL, "/") + "/chat/completions"
+
+	return sendWithRetry(ctx, provider.HTTPClient, provider.RetryPolicy, provider.RateLimiter, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+
+		req.Header.Set("content-type", "application/json")
+		if provider.ApiKey != "" {
+			req.Header.Set("authorization", "Bearer "+provider.ApiKey)
+		}
+		if body.Stream {
+			req.Header.Set("accept", "text/event-stream")
+		}
+		return req, nil
+	})
+}
+
+func (provider OpenAIProvider) Complete(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error) {
+	res, err := provider.send(ctx, toOpenAIRequest(reqData))
+	if err != nil {
+		return nil, statusCodeOf(err), err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error reading response: %w", err)
+	}
+
+	var chatResponse openAIChatResponse
+	if err := json.Unmarshal(resBody, &chatResponse); err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error parsing response: %w", err)
+	}
+
+	response, err := fromOpenAIResponse(chatResponse)
+	if err != nil {
+		return nil, res.StatusCode, err
+	}
+	return response, res.StatusCode, nil
+}
+
+func (provider OpenAIProvider) Stream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error) {
+	chatRequest := toOpenAIRequest(reqData)
+	chatRequest.Stream = true
+	chatRequest.StreamOptions = map[string]bool{"include_usage": true}
+
+	res, err := provider.send(ctx, chatRequest)
+	if err != nil {
+		return nil, statusCodeOf(err), err
+	}
+	defer res.Body.Close()
+
+	acc := newStreamAccumulator(handler)
+	acc.response.Role = "assistant"
+	textIndex := -1
+	toolIndexes := make(map[int]int) // tool call index -> content block index
+
+	// closes every open content block, in order
+	stopBlocks := func() error {
+		for index := range acc.response.Content {
+			_, isOpenToolUse := acc.inputJSON[index]
+			if index == textIndex || isOpenToolUse {
+				if err := acc.stopBlock(index); err != nil {
+					return err
+				}
+			}
+		}
+		textIndex = -1
+		return nil
+	}
+
+	err = readServerSentEvents(res.Body, func(event string, data string) error {
+		if data == "[DONE]" {
+			acc.complete = true
+			return nil
+		}
+
+		var chunk openAIChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("error parsing stream event: %w", err)
+		}
+		if acc.response.ID == "" {
+			acc.response.ID = chunk.ID
+			acc.response.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			acc.response.Usage["input_tokens"] = chunk.Usage.PromptTokens
+			acc.response.Usage["output_tokens"] = chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+
+		choice := chunk.Choices[0]
+		if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+			if textIndex == -1 {
+				textIndex = len(acc.response.Content)
+				acc.startBlock(textIndex, Content{Type: "text"})
+			}
+			acc.appendText(textIndex, *choice.Delta.Content)
+		}
+		for i, toolCall := range choice.Delta.ToolCalls {
+			callIndex := i
+			if toolCall.Index != nil {
+				callIndex = *toolCall.Index
+			}
+			index, ok := toolIndexes[callIndex]
+			if !ok {
+				index = len(acc.response.Content)
+				toolIndexes[callIndex] = index
+				id := toolCall.ID
+				if id == "" {
+					id = fmt.Sprintf("call_%d", callIndex)
+				}
+				acc.startBlock(index, Content{Type: "tool_use", ID: id, Name: toolCall.Function.Name})
+			}
+			acc.appendInputJSON(index, toolCall.Function.Arguments)
+		}
+		if choice.FinishReason != "" {
+			// the usage may follow in a chunk of its own, but the response itself is complete
+			acc.complete = true
+			acc.response.StopReason = toStopReason(choice.FinishReason)
+			return stopBlocks()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error reading stream: %w", err)
+	}
+	// the blocks are still open when the stream ended with [DONE] but no finish_reason; a truncated stream is reported by finish
+	if acc.complete {
+		if err := stopBlocks(); err != nil {
+			return nil, res.StatusCode, err
+		}
+	}
+	response, err := acc.finish()
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("error reading stream: %w", err)
+	}
+	return response, res.StatusCode, nil
+}
+
+/*
+Chat completions APIs have no standard way of counting tokens, so the count is estimated
+*/
+func (provider OpenAIProvider) CountTokens(ctx context.Context, reqData AgentRequest) (int, error) {
+	return estimateTokens(reqData), nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func TestToOpenAIRequest(t *testing.T) {
+	request := AgentRequest{
+		Model:  "local-model",
+		System: []Content{{Type: "text", Text: "Be helpful."}, {Type: "text", Text: "Memory: none"}},
+		Messages: []Message{
+			{Role: "user", Content: []Content{{Type: "text", Text: "What's the weather in Boston and Paris?"}}},
+			{Role: "assistant", Content: []Content{
+				{Type: "text", Text: "Let me check."},
+				{Type: "tool_use", ID: "call_1", Name: "getWeather", Input: map[string]any{"location": "Boston"}},
+				{Type: "tool_use", ID: "call_2", Name: "getWeather", Input: map[string]any{"location": "Paris"}},
+			}},
+			{Role: "user", Content: []Content{
+				{Type: "tool_result", ToolUseID: "call_1", Content: "10"},
+				{Type: "tool_result", ToolUseID: "call_2", Content: "unknown city", IsError: true},
+				{Type: "text", Text: "Thanks!"},
+			}},
+		},
+		Tools:      []Tool{{Name: "getWeather", Description: "Returns the weather.", InputSchema: InputSchema{Type: "object", Properties: map[string]Property{"location": {Type: "string"}}, Required: []string{"location"}}}},
+		ToolChoice: map[string]string{"type": "tool", "name": "getWeather"},
+	}
+
+	toolCall := func(id string, location string) openAIToolCall {
+		call := openAIToolCall{ID: id, Type: "function"}
+		call.Function.Name = "getWeather"
+		call.Function.Arguments = `{"location":"` + location + `"}`
+		return call
+	}
+	want := []openAIMessage{
+		{Role: "system", Content: stringPointer("Be helpful.\n\nMemory: none")},
+		{Role: "user", Content: stringPointer("What's the weather in Boston and Paris?")},
+		{Role: "assistant", Content: stringPointer("Let me check."), ToolCalls: []openAIToolCall{toolCall("call_1", "Boston"), toolCall("call_2", "Paris")}},
+		// tool results come first, as the messages that answer the assistant's tool calls
+		{Role: "tool", Content: stringPointer("10"), ToolCallID: "call_1"},
+		// chat completions has no is_error flag, so the failure is spelled out
+		{Role: "tool", Content: stringPointer("Error: unknown city"), ToolCallID: "call_2"},
+		{Role: "user", Content: stringPointer("Thanks!")},
+	}
+
+	chatRequest := toOpenAIRequest(request)
+	if !reflect.DeepEqual(chatRequest.Messages, want) {
+		got, _ := json.MarshalIndent(chatRequest.Messages, "", "  ")
+		t.Errorf("messages =\n%s", got)
+	}
+	if len(chatRequest.Tools) != 1 || chatRequest.Tools[0].Type != "function" || chatRequest.Tools[0].Function.Name != "getWeather" {
+		t.Errorf("tools = %+v, want the getWeather function", chatRequest.Tools)
+	}
+	if want := map[string]any{"type": "function", "function": map[string]string{"name": "getWeather"}}; !reflect.DeepEqual(chatRequest.ToolChoice, want) {
+		t.Errorf("tool_choice = %v, want %v", chatRequest.ToolChoice, want)
+	}
+}
+
+func TestToOpenAIToolChoice(t *testing.T) {
+	tests := []struct {
+		toolChoice map[string]string
+		want       any
+	}{
+		{nil, nil},
+		{map[string]string{"type": "auto"}, "auto"},
+		{map[string]string{"type": "any"}, "required"},
+	}
+	for _, test := range tests {
+		if got := toOpenAIRequest(AgentRequest{ToolChoice: test.toolChoice}).ToolChoice; got != test.want {
+			t.Errorf("tool_choice for %v = %v, want %v", test.toolChoice, got, test.want)
+		}
+	}
+}
+
+func TestToStopReason(t *testing.T) {
+	tests := map[string]string{
+		"stop":           "end_turn",
+		"tool_calls":     "tool_use",
+		"function_call":  "tool_use",
+		"length":         "max_tokens",
+		"content_filter": "content_filter",
+		"":               "",
+	}
+	for finishReason, want := range tests {
+		if got := toStopReason(finishReason); got != want {
+			t.Errorf("toStopReason(%q) = %q, want %q", finishReason, got, want)
+		}
+	}
+}
+
+/*
+Returns a chat completions server that answers every request with the given body, recording the decoded requests
+*/
+func newOpenAIServer(t *testing.T, contentType string, body string, requests *[]openAIChatRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var chatRequest openAIChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&chatRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if requests != nil {
+			*requests = append(*requests, chatRequest)
+		}
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenAIComplete(t *testing.T) {
+	body := `{
+		"id": "chatcmpl-1",
+		"model": "local-model",
+		"choices": [{
+			"index": 0,
+			"message": {
+				"role": "assistant",
+				"content": "Checking both.",
+				"tool_calls": [
+					{"id": "call_a", "type": "function", "function": {"name": "getWeather", "arguments": "{\"location\": \"Boston\"}"}},
+					{"type": "function", "function": {"name": "getWeather", "arguments": ""}}
+				]
+			},
+			"finish_reason": "tool_calls"
+		}],
+		"usage": {"prompt_tokens": 20, "completion_tokens": 7}
+	}`
+	requests := make([]openAIChatRequest, 0)
+	provider := NewOpenAIProvider(newOpenAIServer(t, "application/json", body, &requests).URL + "/v1")
+
+	response, statusCode, err := provider.Complete(context.Background(), AgentRequest{Model: "local-model", Messages: []Message{{Role: "user", Content: []Content{{Type: "text", Text: "Weather?"}}}}})
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Complete returned status %d, error %v", statusCode, err)
+	}
+	if len(requests) != 1 || requests[0].Stream || len(requests[0].Messages) != 1 {
+		t.Errorf("the server received %+v, want a single non-streamed request with one message", requests)
+	}
+
+	want := &AgentResponse{
+		ID:         "chatcmpl-1",
+		Model:      "local-model",
+		Role:       "assistant",
+		StopReason: "tool_use",
+		Content: []Content{
+			{Type: "text", Text: "Checking both."},
+			{Type: "tool_use", ID: "call_a", Name: "getWeather", Input: map[string]any{"location": "Boston"}},
+			// local servers do not always generate IDs for tool calls
+			{Type: "tool_use", ID: "call_1", Name: "getWeather", Input: map[string]any{}},
+		},
+		Usage: map[string]int{"input_tokens": 20, "output_tokens": 7},
+	}
+	if !reflect.DeepEqual(response, want) {
+		t.Errorf("Complete =\n%+v\nwant\n%+v", response, want)
+	}
+}
+
+func TestParseToolArguments(t *testing.T) {
+	tests := []struct {
+		arguments string
+		want      map[string]any
+		wantErr   bool
+	}{
+		{arguments: `{"location": "Boston", "days": 2}`, want: map[string]any{"location": "Boston", "days": float64(2)}},
+		{arguments: "", want: map[string]any{}},
+		{arguments: "  ", want: map[string]any{}},
+		{arguments: `{"location": "Bos`, wantErr: true},
+		{arguments: `["Boston"]`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.arguments, func(t *testing.T) {
+			input, err := parseToolArguments(test.arguments)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseToolArguments(%q) returned error %v, want error: %v", test.arguments, err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(input, test.want) {
+				t.Errorf("parseToolArguments(%q) = %v, want %v", test.arguments, input, test.want)
+			}
+		})
+	}
+
+	var chatResponse openAIChatResponse
+	body := `{"choices": [{"message": {"role": "assistant", "tool_calls": [{"id": "call_a", "type": "function", "function": {"name": "getWeather", "arguments": "{"}}]}}]}`
+	if err := json.Unmarshal([]byte(body), &chatResponse); err != nil {
+		t.Fatal(err)
+	}
+	response, err := fromOpenAIResponse(chatResponse)
+	if err == nil || !strings.Contains(err.Error(), `invalid input for tool "getWeather"`) {
+		t.Errorf("fromOpenAIResponse = %+v, %v, want an error naming the tool", response, err)
+	}
+}
+
+func TestOpenAIStream(t *testing.T) {
+	chunk := func(data string) string { return "data: " + data + "\n\n" }
+	stream := chunk(`{"id":"chatcmpl-1","model":"local-model","choices":[{"index":0,"delta":{"role":"assistant","content":"Checking"}}]}`) +
+		chunk(`{"id":"chatcmpl-1","model":"local-model","choices":[{"index":0,"delta":{"content":" both."}}]}`) +
+		// the second tool call has no ID and its arguments are interleaved with the first one's
+		chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"getWeather","arguments":""}}]}}]}`) +
+		chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"type":"function","function":{"name":"getWeather","arguments":"{\"location\":"}}]}}]}`) +
+		chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"location\": \"Boston\"}"}}]}}]}`) +
+		chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":" \"Paris\"}"}}]}}]}`) +
+		chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`) +
+		chunk(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":7}}`) +
+		chunk(`[DONE]`)
+	requests := make([]openAIChatRequest, 0)
+	provider := NewOpenAIProvider(newOpenAIServer(t, "text/event-stream", stream, &requests).URL + "/v1")
+
+	blocks := make([]Content, 0)
+	response, _, err := provider.Stream(context.Background(), AgentRequest{Model: "local-model"}, func(event StreamEvent) {
+		if event.Type == STREAM_EVENT_BLOCK_STOP {
+			blocks = append(blocks, *event.Block)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !requests[0].Stream || !requests[0].StreamOptions["include_usage"] {
+		t.Errorf("the server received %+v, want a streamed request that includes usage", requests)
+	}
+
+	want := &AgentResponse{
+		ID:         "chatcmpl-1",
+		Model:      "local-model",
+		Role:       "assistant",
+		StopReason: "tool_use",
+		Content: []Content{
+			{Type: "text", Text: "Checking both."},
+			{Type: "tool_use", ID: "call_a", Name: "getWeather", Input: map[string]any{"location": "Boston"}},
+			{Type: "tool_use", ID: "call_1", Name: "getWeather", Input: map[string]any{"location": "Paris"}},
+		},
+		Usage: map[string]int{"input_tokens": 20, "output_tokens": 7},
+	}
+	if !reflect.DeepEqual(response, want) {
+		t.Errorf("Stream =\n%+v\nwant\n%+v", response, want)
+	}
+	if !reflect.DeepEqual(blocks, want.Content) {
+		t.Errorf("the stream completed the blocks %+v, want %+v", blocks, want.Content)
+	}
+}
+
+func TestOpenAIStreamTruncated(t *testing.T) {
+	chunk := func(data string) string { return "data: " + data + "\n\n" }
+	text := chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`)
+	toolCall := chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"getWeather","arguments":"{\"location\":"}}]}}]}`)
+	finished := chunk(`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`)
+	tests := []struct {
+		name    string
+		stream  string
+		wantErr bool
+	}{
+		{name: "no finish_reason or [DONE]", stream: text, wantErr: true},
+		{name: "cut off in a tool call", stream: text + toolCall, wantErr: true},
+		{name: "cut off in a chunk", stream: text + `data: {"id":"chatcmpl-1","choi`, wantErr: true},
+		{name: "finish_reason without [DONE]", stream: text + finished},
+		{name: "[DONE] without finish_reason", stream: text + chunk(`[DONE]`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := make([]openAIChatRequest, 0)
+			provider := NewOpenAIProvider(newOpenAIServer(t, "text/event-stream", test.stream, &requests).URL + "/v1")
+			response, _, err := provider.Stream(context.Background(), AgentRequest{Model: "local-model"}, nil)
+			if !test.wantErr {
+				if err != nil || len(response.Content) != 1 || response.Content[0].Text != "Hel" {
+					t.Errorf("Stream = %+v, %v; want the text \"Hel\"", response, err)
+				}
+				return
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("Stream = %+v, %v; want an error wrapping %v", response, err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
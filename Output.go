@@ -0,0 +1,189 @@
+/*
+Delivery of the messages that an Agent sends to the user with the sendMessage tool.
+Messages are kept separate from the Agent's inner monologue (the text blocks of its responses) and are passed to an OutputSink,
+so that they can be delivered to whatever front end hosts the Agent.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+A message sent by an Agent to the user
+*/
+type AgentMessage struct {
+	AgentID   string    `json:"agentId"`
+	AgentName string    `json:"agentName"`
+	Text      string    `json:"text"`
+	ToolUseID string    `json:"toolUseId,omitempty"` // the sendMessage tool_use that sent the message
+	Timestamp time.Time `json:"timestamp"`
+}
+
+/*
+Delivers the messages an Agent sends to the user.
+An error is reported back to the Agent as the result of its sendMessage call.
+*/
+type OutputSink interface {
+	Send(ctx context.Context, message AgentMessage) error
+}
+
+/*
+Writes each message to an io.Writer as a line of the form "<agent name>: <text>"
+*/
+type WriterSink struct {
+	Writer io.Writer
+	mu     sync.Mutex
+}
+
+/*
+Returns a sink that prints messages to standard output. Agents without an Output use this sink.
+*/
+func NewStdoutSink() *WriterSink {
+	return &WriterSink{Writer: os.Stdout}
+}
+
+func (sink *WriterSink) Send(ctx context.Context, message AgentMessage) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err := fmt.Fprintf(sink.Writer, "%s: %s\n", message.AgentName, message.Text)
+	return err
+}
+
+/*
+Passes each message to a channel, e.g. to be forwarded to a WebSocket or server-sent event stream.
+Sending blocks until the message is received or the context is cancelled.
+*/
+type ChannelSink chan AgentMessage
+
+func (sink ChannelSink) Send(ctx context.Context, message AgentMessage) error {
+	select {
+	case sink <- message:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Adapts a function to an OutputSink
+*/
+type SinkFunc func(ctx context.Context, message AgentMessage) error
+
+func (sink SinkFunc) Send(ctx context.Context, message AgentMessage) error {
+	return sink(ctx, message)
+}
+
+/*
+Delivers each message to every one of the sinks
+*/
+type MultiSink []OutputSink
+
+func (sinks MultiSink) Send(ctx context.Context, message AgentMessage) error {
+	errs := make([]error, 0)
+	for _, sink := range sinks {
+		if err := sink.Send(ctx, message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/*
+POSTs each message as JSON to a URL.
+Any 2xx response counts as delivered; the message is not retried, so that a failure is reported to the Agent straight away.
+*/
+type WebhookSink struct {
+	URL string
+	// Added to every request, e.g. for authentication
+	Headers http.Header
+	// The client used to send requests; defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Headers: make(http.Header)}
+}
+
+func (sink *WebhookSink) Send(ctx context.Context, message AgentMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range sink.Headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := httpClient(sink.HTTPClient).Do(req)
+	if err != nil {
+		return fmt.Errorf("error delivering message to webhook: %w", err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+/*
+Returns the sink that the Agent's messages are delivered to
+*/
+func (llm *Agent) output() OutputSink {
+	if llm.Output == nil {
+		return NewStdoutSink()
+	}
+	return llm.Output
+}
+
+/*
+Used to send a message back to the user
+*/
+func (llm *Agent) sendMessage(ctx context.Context, text string) (string, error) {
+	message := AgentMessage{
+		AgentID:   llm.ID,
+		AgentName: llm.Name,
+		Text:      text,
+		ToolUseID: ToolUseIDFromContext(ctx),
+		Timestamp: llm.now(),
+	}
+	err := llm.output().Send(ctx, message)
+	if err != nil {
+		return "", fmt.Errorf("the message could not be delivered to the user: %w", err)
+	}
+	llm.emit(AgentEvent{Type: AGENT_EVENT_MESSAGE, ToolUseID: message.ToolUseID, Message: &message})
+	return "Message sent to the user.", nil
+}
+
+type sendMessageInput struct {
+	Message string `json:"message" description:"The message to send to the user, written in the voice of your persona."`
+}
+
+func (llm *Agent) createSendMessageTool() *Tool {
+	tool := NewTool("sendMessage",
+		"Send a message to the user. This is the ONLY way to communicate with the user; they do not see your inner monologue or any of your other function calls. "+
+			"Use it whenever you want to reply to the user, answer a question or tell them something. "+
+			"Each call delivers one message, so you may call it more than once to send several messages in a row.",
+		func(ctx context.Context, input sendMessageInput) (string, error) {
+			return llm.sendMessage(ctx, input.Message)
+		})
+	// messages must reach the user in the order in which they were sent
+	tool.Sequential = true
+	return tool
+}
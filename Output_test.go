@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOutputSinks(t *testing.T) {
+	message := AgentMessage{AgentID: "agent-1", AgentName: "tester", Text: "Hi there!", ToolUseID: "call_1"}
+
+	var out strings.Builder
+	if err := (&WriterSink{Writer: &out}).Send(context.Background(), message); err != nil || out.String() != "tester: Hi there!\n" {
+		t.Errorf("WriterSink wrote %q, error %v", out.String(), err)
+	}
+
+	received := make([]AgentMessage, 0)
+	collect := SinkFunc(func(ctx context.Context, message AgentMessage) error {
+		received = append(received, message)
+		return nil
+	})
+	fail := SinkFunc(func(ctx context.Context, message AgentMessage) error { return errors.New("the socket is closed") })
+	if err := (MultiSink{fail, collect, collect}).Send(context.Background(), message); err == nil || !strings.Contains(err.Error(), "the socket is closed") || len(received) != 2 {
+		t.Errorf("MultiSink delivered %d messages with error %v, want 2 and the error of the failing sink", len(received), err)
+	}
+
+	// a channel nobody receives from gives up when the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := make(ChannelSink).Send(ctx, message); !errors.Is(err, context.Canceled) {
+		t.Errorf("ChannelSink returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantErr    bool
+	}{
+		{"delivered", http.StatusNoContent, false},
+		{"rejected", http.StatusBadGateway, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var received AgentMessage
+			var token string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				token = r.Header.Get("Authorization")
+				json.NewDecoder(r.Body).Decode(&received)
+				w.WriteHeader(test.statusCode)
+			}))
+			defer server.Close()
+
+			sink := NewWebhookSink(server.URL)
+			sink.Headers.Set("Authorization", "Bearer secret")
+			err := sink.Send(context.Background(), AgentMessage{AgentName: "tester", Text: "Hi there!"})
+			if (err != nil) != test.wantErr {
+				t.Errorf("Send returned error %v, want an error: %v", err, test.wantErr)
+			}
+			if received.Text != "Hi there!" || token != "Bearer secret" {
+				t.Errorf("the webhook received %+v with authorization %q", received, token)
+			}
+		})
+	}
+}
+
+func TestSendMessageFailure(t *testing.T) {
+	agent, _ := newTestAgent(&fakeProvider{responses: []AgentResponse{toolUseResponse("call_1", "sendMessage", map[string]any{"message": "Hi there!"})}})
+	agent.Output = SinkFunc(func(ctx context.Context, message AgentMessage) error { return errors.New("the socket is closed") })
+	agent.AddUserMessage("Hello")
+
+	if _, err := agent.Step(context.Background(), DefaultRunOptions()); err != nil {
+		t.Fatal(err)
+	}
+	// the Agent is told that its message did not arrive
+	result := agent.ChatHistory[len(agent.ChatHistory)-1].Content[0]
+	if !result.IsError || !strings.Contains(result.Content, "could not be delivered") {
+		t.Errorf("the result of sendMessage is %+v, want an error saying the message was not delivered", result)
+	}
+}
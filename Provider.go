@@ -0,0 +1,77 @@
+/*
+Abstraction over the LLM APIs that an Agent can be run against
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+/*
+A backend capable of serving requests for an Agent.
+Requests and responses always use the Anthropic Messages API shapes (AgentRequest/AgentResponse); each Provider translates them to and from its own API format.
+*/
+type Provider interface {
+	/*
+		Sends the request and returns the complete response.
+		Returns the Response, the status code of the request, and error, if applicable
+	*/
+	Complete(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error)
+	/*
+		Sends the request, passing each piece of the response to the handler as it is generated.
+		Returns the complete Response once the stream ends, the status code of the request, and error, if applicable
+	*/
+	Stream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error)
+	// Returns the number of input tokens that the request would use
+	CountTokens(ctx context.Context, reqData AgentRequest) (int, error)
+}
+
+/*
+Returns the client to send requests with, falling back to a default client when none was configured
+*/
+func httpClient(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+/*
+Roughly estimates the number of input tokens used by a request, assuming ~4 characters per token.
+Used by Providers whose API has no way of counting tokens.
+*/
+func estimateTokens(reqData AgentRequest) int {
+	chars := 0
+	for _, content := range reqData.System {
+		chars += contentLength(content)
+	}
+	for _, message := range reqData.Messages {
+		for _, content := range message.Content {
+			chars += contentLength(content)
+		}
+	}
+	for _, tool := range reqData.Tools {
+		chars += len(tool.Name) + len(tool.Description)
+		for name, property := range tool.InputSchema.Properties {
+			chars += len(name) + len(property.Description)
+		}
+	}
+	return (chars + 3) / 4
+}
+
+/*
+Returns the number of characters in a single Content block
+*/
+func contentLength(content Content) int {
+	chars := len(content.Text) + len(content.Content) + len(content.Name)
+	for key, value := range content.Input {
+		if str, ok := value.(string); ok {
+			chars += len(key) + len(str)
+		} else {
+			chars += len(key) + 8
+		}
+	}
+	return chars
+}
@@ -0,0 +1,117 @@
+/*
+Client-side rate limiting for requests to LLM APIs
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Requests per minute allowed by the lowest tier of the Anthropic API
+const DEFAULT_REQUESTS_PER_MINUTE int = 50
+const DEFAULT_REQUEST_BURST int = 5
+
+/*
+Token bucket rate limiter.
+The bucket holds up to burst tokens and is refilled at a constant rate; every request takes one token, waiting for one to become available if the bucket is empty.
+*/
+type RateLimiter struct {
+	mu          sync.Mutex
+	rate        float64 // tokens added per second
+	burst       float64
+	tokens      float64
+	last        time.Time // when the bucket was last refilled
+	pausedUntil time.Time // no requests are let through before this time
+}
+
+/*
+Creates a RateLimiter that allows requestsPerMinute requests per minute on average, with bursts of up to burst requests.
+A requestsPerMinute of 0 or less does not limit the rate; the limiter then only holds requests back while it is paused.
+*/
+func NewRateLimiter(requestsPerMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   float64(requestsPerMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+/*
+Blocks until a request may be sent or the context is done
+*/
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := limiter.reserve(time.Now())
+		if delay <= 0 {
+			return nil
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Takes a token if one is available, otherwise returns how long to wait before trying again
+*/
+func (limiter *RateLimiter) reserve(now time.Time) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if now.Before(limiter.pausedUntil) {
+		return limiter.pausedUntil.Sub(now)
+	}
+	if limiter.rate <= 0 {
+		return 0
+	}
+
+	// refilling the bucket for the time elapsed since the last refill
+	limiter.tokens = min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return 0
+	}
+	return time.Duration((1 - limiter.tokens) / limiter.rate * float64(time.Second))
+}
+
+/*
+Stops letting requests through until the given time, e.g. when the API reports that a rate limit was exceeded
+*/
+func (limiter *RateLimiter) pauseUntil(until time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if until.After(limiter.pausedUntil) {
+		limiter.pausedUntil = until
+	}
+}
+
+var sharedRateLimiters = struct {
+	sync.Mutex
+	limiters map[string]*RateLimiter
+}{limiters: make(map[string]*RateLimiter)}
+
+/*
+Returns the RateLimiter shared by every Provider using the given API key, creating it if needed.
+Since the API enforces its rate limits per key, all agents using the same key draw from the same bucket.
+The requestsPerMinute and burst arguments only apply when the limiter is first created.
+*/
+func SharedRateLimiter(apiKey string, requestsPerMinute int, burst int) *RateLimiter {
+	sharedRateLimiters.Lock()
+	defer sharedRateLimiters.Unlock()
+
+	limiter, ok := sharedRateLimiters.limiters[apiKey]
+	if !ok {
+		limiter = NewRateLimiter(requestsPerMinute, burst)
+		sharedRateLimiters.limiters[apiKey] = limiter
+	}
+	return limiter
+}
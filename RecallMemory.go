@@ -0,0 +1,351 @@
+/*
+Recall memory: the complete conversation history of an Agent, stored out of context and searchable through tools
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of results returned per page by the recall memory search tools
+const RECALL_PAGE_SIZE int = 5
+
+/*
+A single Message from the chat history, as stored in recall memory
+*/
+type RecallEntry struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Role      string    `json:"role"`
+	Message   Message   `json:"message"`
+}
+
+/*
+Conversation history -- stored out of context.
+Every Message added to an Agent's ChatHistory is also stored here, so it remains searchable after it has been removed from the context window.
+*/
+type RecallMemory struct {
+	mu      sync.RWMutex
+	entries []RecallEntry
+}
+
+func NewRecallMemory() *RecallMemory {
+	return &RecallMemory{entries: make([]RecallEntry, 0)}
+}
+
+/*
+Stores a message in recall memory
+*/
+func (recall *RecallMemory) Insert(message Message, timestamp time.Time) RecallEntry {
+	recall.mu.Lock()
+	defer recall.mu.Unlock()
+
+	entry := RecallEntry{
+		ID:        len(recall.entries) + 1,
+		Timestamp: timestamp,
+		Role:      message.Role,
+		Message:   message,
+	}
+	recall.entries = append(recall.entries, entry)
+	return entry
+}
+
+/*
+Returns the number of messages stored in recall memory
+*/
+func (recall *RecallMemory) Len() int {
+	recall.mu.RLock()
+	defer recall.mu.RUnlock()
+	return len(recall.entries)
+}
+
+/*
+Returns a copy of every entry stored in recall memory, oldest first
+*/
+func (recall *RecallMemory) Entries() []RecallEntry {
+	recall.mu.RLock()
+	defer recall.mu.RUnlock()
+	return append([]RecallEntry(nil), recall.entries...)
+}
+
+/*
+Loads saved entries into an empty recall memory
+*/
+func (recall *RecallMemory) restore(entries []RecallEntry) {
+	recall.mu.Lock()
+	defer recall.mu.Unlock()
+	recall.entries = append(recall.entries[:0], entries...)
+}
+
+/*
+Returns the given page (starting at 0) of the entries that match the filter, oldest first, along with the total number of matching entries
+*/
+func (recall *RecallMemory) filter(page int, match func(entry RecallEntry) bool) ([]RecallEntry, int) {
+	recall.mu.RLock()
+	defer recall.mu.RUnlock()
+
+	matches := make([]RecallEntry, 0)
+	for _, entry := range recall.entries {
+		if match(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	return paginate(matches, page, RECALL_PAGE_SIZE), len(matches)
+}
+
+/*
+Returns the given page of items, or an empty slice if the page is out of range
+*/
+func paginate[T any](items []T, page int, pageSize int) []T {
+	start := page * pageSize
+	if page < 0 || start >= len(items) {
+		return []T{}
+	}
+	end := min(start+pageSize, len(items))
+	return items[start:end]
+}
+
+/*
+Searches for messages containing every word of the query (case insensitive).
+Returns the given page (starting at 0) of the matching entries, oldest first, along with the total number of matches.
+*/
+func (recall *RecallMemory) Search(query string, page int) ([]RecallEntry, int) {
+	terms := strings.Fields(strings.ToLower(query))
+	return recall.filter(page, func(entry RecallEntry) bool {
+		text := strings.ToLower(messageText(entry.Message))
+		for _, term := range terms {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+/*
+Searches for messages sent between the start and end times (inclusive).
+Returns the given page (starting at 0) of the matching entries, oldest first, along with the total number of matches.
+*/
+func (recall *RecallMemory) SearchDate(start time.Time, end time.Time, page int) ([]RecallEntry, int) {
+	return recall.filter(page, func(entry RecallEntry) bool {
+		return !entry.Timestamp.Before(start) && !entry.Timestamp.After(end)
+	})
+}
+
+/*
+Summary of the contents of recall memory
+*/
+type RecallStats struct {
+	Messages        int            // the number of messages stored
+	MessagesByRole  map[string]int // the number of messages stored per role ('user' or 'assistant')
+	UserMessages    int            // the number of messages written by the user, i.e. excluding tool results, heartbeats and other system messages
+	First           time.Time      // when the oldest message was stored
+	Last            time.Time      // when the newest message was stored
+	LastUserMessage time.Time      // when the newest message written by the user was stored; zero if there is none
+}
+
+/*
+Returns a summary of the contents of recall memory
+*/
+func (recall *RecallMemory) Stats() RecallStats {
+	recall.mu.RLock()
+	defer recall.mu.RUnlock()
+
+	stats := RecallStats{Messages: len(recall.entries), MessagesByRole: make(map[string]int)}
+	for _, entry := range recall.entries {
+		stats.MessagesByRole[entry.Role]++
+		if isUserMessage(entry.Message) {
+			stats.UserMessages++
+			stats.LastUserMessage = entry.Timestamp
+		}
+	}
+	if len(recall.entries) > 0 {
+		stats.First = recall.entries[0].Timestamp
+		stats.Last = recall.entries[len(recall.entries)-1].Timestamp
+	}
+	return stats
+}
+
+/*
+Prefixes of the text of messages that are added to the chat history by the program rather than written by the user
+*/
+var systemMessagePrefixes = []string{"[heartbeat]", "[system]", "[summary]"}
+
+/*
+Whether the message was written by the user, as opposed to being a tool result or a message generated by the program
+*/
+func isUserMessage(message Message) bool {
+	if message.Role != "user" {
+		return false
+	}
+	for _, content := range message.Content {
+		if content.Type != "text" {
+			continue
+		}
+		for _, prefix := range systemMessagePrefixes {
+			if strings.HasPrefix(content.Text, prefix) {
+				return false
+			}
+		}
+		eventType := userEventType(content.Text)
+		return eventType == "" || eventType == USER_EVENT_MESSAGE
+	}
+	return false
+}
+
+/*
+Converts a message into plain text, including its tool calls and tool results
+*/
+func messageText(message Message) string {
+	parts := make([]string, 0, len(message.Content))
+	for _, content := range message.Content {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+		case "tool_use":
+			input, _ := json.Marshal(content.Input)
+			parts = append(parts, fmt.Sprintf("[tool call] %s(%s)", content.Name, string(input)))
+		case "tool_result":
+			parts = append(parts, fmt.Sprintf("[tool result] %s", content.Content))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+/*
+Formats a page of recall memory search results for the Agent
+*/
+func formatRecallResults(entries []RecallEntry, total int, page int) string {
+	if total == 0 {
+		return "No results found."
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("No results on page %d; there are %d results across %d pages (pages start at 0).", page, total, pageCount(total, RECALL_PAGE_SIZE))
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("Showing %d of %d results (page %d; there are %d pages, starting at page 0):\n", len(entries), total, page, pageCount(total, RECALL_PAGE_SIZE)))
+	for _, entry := range entries {
+		builder.WriteString(fmt.Sprintf("[%s] %s: %s\n", entry.Timestamp.Format(time.RFC3339), entry.Role, messageText(entry.Message)))
+	}
+	return builder.String()
+}
+
+/*
+Returns the number of pages needed to show every result
+*/
+func pageCount(total int, pageSize int) int {
+	return (total + pageSize - 1) / pageSize
+}
+
+/*
+Adds a message to the Agent's context and stores it in recall memory
+*/
+func (llm *Agent) addMessageToChatHistory(message Message) {
+	llm.ChatHistory = append(llm.ChatHistory, message)
+	if llm.RecallMemory == nil {
+		llm.RecallMemory = NewRecallMemory()
+	}
+	llm.RecallMemory.Insert(message, llm.now())
+}
+
+/*
+Adds content to the Agent's context as a user message.
+The content is added to the last message when it is from the user, so that user and assistant messages keep alternating;
+it is still stored in recall memory as a message of its own.
+*/
+func (llm *Agent) addUserContentToChatHistory(content Content) {
+	last := len(llm.ChatHistory) - 1
+	if last < 0 || llm.ChatHistory[last].Role != "user" {
+		llm.addMessageToChatHistory(Message{Role: "user", Content: []Content{content}})
+		return
+	}
+	// copying the content, since recall memory shares it with the chat history
+	merged := append(make([]Content, 0, len(llm.ChatHistory[last].Content)+1), llm.ChatHistory[last].Content...)
+	llm.ChatHistory[last].Content = append(merged, content)
+	if llm.RecallMemory == nil {
+		llm.RecallMemory = NewRecallMemory()
+	}
+	llm.RecallMemory.Insert(Message{Role: "user", Content: []Content{content}}, llm.now())
+}
+
+/*
+Adds a text message from the user to the Agent's context
+*/
+func (llm *Agent) AddUserMessage(text string) {
+	llm.addMessageToChatHistory(Message{Role: "user", Content: []Content{{Type: "text", Text: text}}})
+}
+
+/* Recall memory tools */
+
+func (llm *Agent) conversationSearch(ctx context.Context, query string, page int, requestHeartbeat bool) string {
+	requestHeartbeatIf(ctx, requestHeartbeat)
+	if llm.RecallMemory == nil {
+		return formatRecallResults(nil, 0, page)
+	}
+
+	entries, total := llm.RecallMemory.Search(query, page)
+	return formatRecallResults(entries, total, page)
+}
+
+func (llm *Agent) conversationSearchDate(ctx context.Context, startDate string, endDate string, page int, requestHeartbeat bool) (string, error) {
+	requestHeartbeatIf(ctx, requestHeartbeat)
+
+	start, err := time.ParseInLocation(time.DateOnly, startDate, time.Local)
+	if err != nil {
+		return "", fmt.Errorf("invalid startDate \"%s\", expected the format YYYY-MM-DD", startDate)
+	}
+	end, err := time.ParseInLocation(time.DateOnly, endDate, time.Local)
+	if err != nil {
+		return "", fmt.Errorf("invalid endDate \"%s\", expected the format YYYY-MM-DD", endDate)
+	}
+	// the end date is inclusive
+	end = end.AddDate(0, 0, 1).Add(-time.Nanosecond)
+
+	if llm.RecallMemory == nil {
+		return formatRecallResults(nil, 0, page), nil
+	}
+	entries, total := llm.RecallMemory.SearchDate(start, end, page)
+	return formatRecallResults(entries, total, page), nil
+}
+
+type conversationSearchInput struct {
+	Query            string `json:"query" description:"The text to search for. Messages containing every word of the query are returned (case insensitive)."`
+	Page             int    `json:"page,omitempty" default:"0" description:"The page of results to return, starting at 0. Use this to see more results when a search returns more than one page."`
+	RequestHeartbeat bool   `json:"requestHeartbeat" description:"Set to 'true' to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to 'false' to end your execution now."`
+}
+
+func (llm *Agent) createConversationSearchTool() *Tool {
+	return NewTool("conversationSearch",
+		"Search your prior conversation history (recall memory) for messages containing the given text. "+
+			"Recall memory holds every message that you have sent or received, including messages that are no longer visible in your context window. "+
+			"Use this when you need to remember something that was said earlier but can no longer see it. "+
+			fmt.Sprintf("Results are returned oldest first, %d per page, with the time each message was sent.", RECALL_PAGE_SIZE),
+		func(ctx context.Context, input conversationSearchInput) (string, error) {
+			return llm.conversationSearch(ctx, input.Query, input.Page, input.RequestHeartbeat), nil
+		})
+}
+
+type conversationSearchDateInput struct {
+	StartDate        string `json:"startDate" description:"The first day to search, in the format YYYY-MM-DD."`
+	EndDate          string `json:"endDate" description:"The last day to search (inclusive), in the format YYYY-MM-DD."`
+	Page             int    `json:"page,omitempty" default:"0" description:"The page of results to return, starting at 0. Use this to see more results when a search returns more than one page."`
+	RequestHeartbeat bool   `json:"requestHeartbeat" description:"Set to 'true' to continue your execution in a loop (i.e. you will be invoked again), allowing you to think once again. Set to 'false' to end your execution now."`
+}
+
+func (llm *Agent) createConversationSearchDateTool() *Tool {
+	return NewTool("conversationSearchDate",
+		"Search your prior conversation history (recall memory) for messages sent within a range of dates. "+
+			"Recall memory holds every message that you have sent or received, including messages that are no longer visible in your context window. "+
+			"Use this when you need to remember what was discussed at a particular time, e.g. \"last week\". "+
+			fmt.Sprintf("Results are returned oldest first, %d per page, with the time each message was sent.", RECALL_PAGE_SIZE),
+		func(ctx context.Context, input conversationSearchDateInput) (string, error) {
+			return llm.conversationSearchDate(ctx, input.StartDate, input.EndDate, input.Page, input.RequestHeartbeat)
+		})
+}
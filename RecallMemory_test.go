@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Returns the text of each entry
+*/
+func entryTexts(entries []RecallEntry) []string {
+	texts := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		texts = append(texts, messageText(entry.Message))
+	}
+	return texts
+}
+
+func TestRecallMemorySearch(t *testing.T) {
+	recall := NewRecallMemory()
+	now := time.Now()
+	for _, message := range []Message{
+		{Role: "user", Content: []Content{{Type: "text", Text: "My cat is called Miso."}}},
+		{Role: "assistant", Content: []Content{{Type: "text", Text: "Miso is a lovely name for a CAT."}}},
+		{Role: "assistant", Content: []Content{{Type: "tool_use", ID: "call_1", Name: "archivalMemoryInsert", Input: map[string]any{"content": "cat: Miso"}}}},
+		{Role: "user", Content: []Content{{Type: "tool_result", ToolUseID: "call_1", Content: "Inserted the dog's name."}}},
+		{Role: "user", Content: []Content{{Type: "text", Text: "What was my dog called?"}}},
+	} {
+		recall.Insert(message, now)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"miso", []string{"My cat is called Miso.", "Miso is a lovely name for a CAT.", `[tool call] archivalMemoryInsert({"content":"cat: Miso"})`}},
+		{"Cat   MISO", []string{"My cat is called Miso.", "Miso is a lovely name for a CAT.", `[tool call] archivalMemoryInsert({"content":"cat: Miso"})`}},
+		{"dog name", []string{"[tool result] Inserted the dog's name."}},
+		{"called dog", []string{"What was my dog called?"}},
+		{"parrot", []string{}},
+		{"", []string{"My cat is called Miso.", "Miso is a lovely name for a CAT.", `[tool call] archivalMemoryInsert({"content":"cat: Miso"})`, "[tool result] Inserted the dog's name.", "What was my dog called?"}},
+	}
+	for _, test := range tests {
+		entries, total := recall.Search(test.query, 0)
+		if got := entryTexts(entries); !reflect.DeepEqual(got, test.want) || total != len(test.want) {
+			t.Errorf("Search(%q) = %q (%d in total), want %q", test.query, got, total, test.want)
+		}
+	}
+}
+
+func TestRecallMemoryPaging(t *testing.T) {
+	recall := NewRecallMemory()
+	for i := range 2*RECALL_PAGE_SIZE + 2 {
+		recall.Insert(Message{Role: "user", Content: []Content{{Type: "text", Text: fmt.Sprintf("note %d", i)}}}, time.Now())
+	}
+
+	tests := []struct {
+		page  int
+		first string
+		count int
+	}{
+		{0, "note 0", RECALL_PAGE_SIZE},
+		{1, fmt.Sprintf("note %d", RECALL_PAGE_SIZE), RECALL_PAGE_SIZE},
+		{2, fmt.Sprintf("note %d", 2*RECALL_PAGE_SIZE), 2},
+		{3, "", 0},
+		{-1, "", 0},
+	}
+	for _, test := range tests {
+		entries, total := recall.Search("note", test.page)
+		if total != 2*RECALL_PAGE_SIZE+2 || len(entries) != test.count || (test.count > 0 && messageText(entries[0].Message) != test.first) {
+			t.Errorf("page %d = %q (%d in total), want %d entries starting at %q", test.page, entryTexts(entries), total, test.count, test.first)
+		}
+	}
+
+	if got := formatRecallResults(nil, 12, 3); !strings.Contains(got, "12 results across 3 pages") {
+		t.Errorf("the results for a page out of range are %q", got)
+	}
+	if got := formatRecallResults(nil, 0, 0); got != "No results found." {
+		t.Errorf("the results of an empty search are %q", got)
+	}
+}
+
+func TestConversationSearchDate(t *testing.T) {
+	agent := NewAgentWithProvider("test-model", "A helpful assistant.", "tester", &fakeProvider{})
+	agent.RecallMemory = NewRecallMemory()
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)
+	for _, timestamp := range []time.Time{
+		day.Add(-time.Nanosecond),
+		day,
+		day.Add(12 * time.Hour),
+		day.AddDate(0, 0, 1).Add(-time.Nanosecond),
+		day.AddDate(0, 0, 1),
+	} {
+		agent.RecallMemory.Insert(Message{Role: "user", Content: []Content{{Type: "text", Text: timestamp.Format(time.RFC3339Nano)}}}, timestamp)
+	}
+
+	tests := []struct {
+		start, end string
+		total      int
+	}{
+		// the range covers whole days in local time, including the end date
+		{"2026-10-18", "2026-10-18", 3},
+		{"2026-10-17", "2026-10-18", 4},
+		{"2026-10-18", "2026-10-19", 4},
+		{"2026-10-19", "2026-10-20", 1},
+		{"2026-10-20", "2026-10-18", 0},
+	}
+	for _, test := range tests {
+		start, _ := time.ParseInLocation(time.DateOnly, test.start, time.Local)
+		end, _ := time.ParseInLocation(time.DateOnly, test.end, time.Local)
+		if _, total := agent.RecallMemory.SearchDate(start, end.AddDate(0, 0, 1).Add(-time.Nanosecond), 0); total != test.total {
+			t.Errorf("SearchDate from %s to %s matched %d messages, want %d", test.start, test.end, total, test.total)
+		}
+
+		got, err := agent.conversationSearchDate(context.Background(), test.start, test.end, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("of %d results", test.total); test.total > 0 && !strings.Contains(got, want) {
+			t.Errorf("conversationSearchDate(%s, %s) = %q, want %d results", test.start, test.end, got, test.total)
+		}
+	}
+
+	if _, err := agent.conversationSearchDate(context.Background(), "18/10/2026", "2026-10-18", 0, false); err == nil || !strings.Contains(err.Error(), "YYYY-MM-DD") {
+		t.Errorf("conversationSearchDate returned error %v for an invalid date", err)
+	}
+}
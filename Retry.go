@@ -0,0 +1,267 @@
+/*
+Error handling and retries for requests to LLM APIs
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+An error response returned by an LLM API.
+Parsed from the error JSON of the Messages API ({"type": "error", "error": {"type": ..., "message": ...}}), which OpenAI-compatible APIs share the shape of.
+*/
+type APIError struct {
+	StatusCode int
+	/*
+		The type of the error, e.g. "invalid_request_error", "rate_limit_error" or "overloaded_error".
+		See https://docs.anthropic.com/en/api/errors
+	*/
+	Type      string
+	Message   string
+	RequestID string // the request-id header, useful when reporting issues to the API provider
+	/*
+		How long the API asked the client to wait before retrying, taken from the retry-after header
+		or from the reset time of an exhausted anthropic-ratelimit-* limit. Zero when the API gave no indication.
+	*/
+	RetryAfter time.Duration
+}
+
+func (apiErr *APIError) Error() string {
+	if apiErr.Type == "" {
+		return fmt.Sprintf("request failed with status code %d: %s", apiErr.StatusCode, apiErr.Message)
+	}
+	return fmt.Sprintf("request failed with status code %d (%s): %s", apiErr.StatusCode, apiErr.Type, apiErr.Message)
+}
+
+/*
+Whether the request that caused this error may succeed if it is sent again
+*/
+func (apiErr *APIError) Retryable() bool {
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return true
+	}
+	switch apiErr.Type {
+	case "overloaded_error", "rate_limit_error", "api_error":
+		return true
+	}
+	return false
+}
+
+/*
+Creates an APIError from an unsuccessful response and its body
+*/
+func parseAPIError(res *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		RequestID:  res.Header.Get("request-id"),
+		RetryAfter: retryAfterFromHeaders(res.Header, time.Now()),
+	}
+
+	var errorBody struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorBody); err == nil && errorBody.Error.Message != "" {
+		apiErr.Type = errorBody.Error.Type
+		apiErr.Message = errorBody.Error.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
+
+/*
+Headers of the Messages API that describe a rate limit, as pairs of the remaining quota and the time at which the quota is restored
+*/
+var rateLimitHeaders = [][2]string{
+	{"anthropic-ratelimit-requests-remaining", "anthropic-ratelimit-requests-reset"},
+	{"anthropic-ratelimit-tokens-remaining", "anthropic-ratelimit-tokens-reset"},
+	{"anthropic-ratelimit-input-tokens-remaining", "anthropic-ratelimit-input-tokens-reset"},
+	{"anthropic-ratelimit-output-tokens-remaining", "anthropic-ratelimit-output-tokens-reset"},
+}
+
+/*
+Determines how long to wait before retrying from the response headers.
+The retry-after header takes precedence; otherwise, the latest reset time of any exhausted rate limit is used.
+*/
+func retryAfterFromHeaders(header http.Header, now time.Time) time.Duration {
+	if retryAfter := header.Get("retry-after"); retryAfter != "" {
+		if seconds, err := strconv.ParseFloat(retryAfter, 64); err == nil {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return max(date.Sub(now), 0)
+		}
+	}
+
+	var wait time.Duration
+	for _, limit := range rateLimitHeaders {
+		if header.Get(limit[0]) != "0" {
+			continue
+		}
+		reset, err := time.Parse(time.RFC3339, header.Get(limit[1]))
+		if err != nil {
+			continue
+		}
+		wait = max(wait, reset.Sub(now))
+	}
+	return wait
+}
+
+/*
+Controls how failed requests are retried
+*/
+type RetryPolicy struct {
+	MaxRetries int           // the number of times a request is retried after the first attempt; 0 disables retries
+	BaseDelay  time.Duration // the delay before the first retry, doubled for each subsequent retry
+	MaxDelay   time.Duration // the upper bound of the delay between retries
+	// Optional; called before each retry with the retry number (starting at 1), the delay before it and the error that caused it
+	OnRetry func(retry int, delay time.Duration, err error)
+}
+
+const DEFAULT_MAX_RETRIES int = 3
+
+/*
+Returns the RetryPolicy used by Providers created with their New* functions
+*/
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: DEFAULT_MAX_RETRIES,
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   30 * time.Second,
+	}
+}
+
+/*
+Returns how long to wait before the given retry attempt (starting at 0).
+Uses exponential backoff with full jitter, unless the API asked for a specific delay.
+*/
+func (policy RetryPolicy) backoff(attempt int, apiErr *APIError) time.Duration {
+	if apiErr != nil && apiErr.RetryAfter > 0 {
+		// adding a little jitter so that clients sharing a limit do not all retry at once
+		jitter := time.Duration(rand.Int63n(int64(250 * time.Millisecond)))
+		return apiErr.RetryAfter + jitter
+	}
+	return time.Duration(rand.Int63n(int64(policy.maxBackoff(attempt)) + 1))
+}
+
+/*
+Returns the longest delay that backoff picks for the given retry attempt when the API did not ask for a specific delay
+*/
+func (policy RetryPolicy) maxBackoff(attempt int) time.Duration {
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryPolicy().MaxDelay
+	}
+	delay := policy.BaseDelay << attempt
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+/*
+Waits for the given duration, returning early with an error if the context is done first
+*/
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Sends a request, retrying network errors and retryable API errors according to the policy.
+newRequest is called to create the request for every attempt, since a request body can only be read once.
+Each attempt first waits for the rate limiter, if one is provided. The limiter is paused until the limit resets when the API reports that a rate limit was hit,
+or that one is exhausted in the headers of a successful response.
+Returns the response when its status code is 200; any other status code is returned as an *APIError.
+The caller is responsible for closing the body of the returned response.
+*/
+func sendWithRetry(ctx context.Context, client *http.Client, policy RetryPolicy, limiter *RateLimiter, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		var apiErr *APIError
+		res, err := httpClient(client).Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			err = fmt.Errorf("error sending request: %w", err)
+		} else if res.StatusCode == http.StatusOK {
+			// the request that used up a limit succeeded, but the ones after it would not until the limit resets
+			if wait := retryAfterFromHeaders(res.Header, time.Now()); limiter != nil && wait > 0 {
+				limiter.pauseUntil(time.Now().Add(wait))
+			}
+			return res, nil
+		} else {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			apiErr = parseAPIError(res, body)
+
+			if limiter != nil && apiErr.StatusCode == http.StatusTooManyRequests {
+				// when the API does not say how long to wait, the requests sharing the limiter back off as this one does
+				wait := apiErr.RetryAfter
+				if wait <= 0 {
+					wait = policy.maxBackoff(attempt)
+				}
+				limiter.pauseUntil(time.Now().Add(wait))
+			}
+			if !apiErr.Retryable() {
+				return nil, apiErr
+			}
+			err = apiErr
+		}
+
+		if attempt >= policy.MaxRetries {
+			return nil, err
+		}
+
+		delay := policy.backoff(attempt, apiErr)
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt+1, delay, err)
+		}
+		if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+			return nil, sleepErr
+		}
+	}
+}
+
+/*
+Returns the status code to report for an error returned by sendWithRetry, or -1 if no response was received
+*/
+func statusCodeOf(err error) int {
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.StatusCode
+	}
+	return -1
+}
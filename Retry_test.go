@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseAPIError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want APIError
+	}{
+		{
+			name: "messages API error",
+			body: `{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`,
+			want: APIError{StatusCode: 529, Type: "overloaded_error", Message: "Overloaded", RequestID: "req_1"},
+		},
+		{
+			name: "plain text body",
+			body: "  upstream connect error\n",
+			want: APIError{StatusCode: 529, Message: "upstream connect error", RequestID: "req_1"},
+		},
+		{
+			name: "JSON without an error message",
+			body: `{"detail": "Not found"}`,
+			want: APIError{StatusCode: 529, Message: `{"detail": "Not found"}`, RequestID: "req_1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: 529, Header: http.Header{}}
+			res.Header.Set("request-id", "req_1")
+			if got := parseAPIError(res, []byte(test.body)); *got != test.want {
+				t.Errorf("parseAPIError = %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestAPIErrorRetryable(t *testing.T) {
+	tests := []struct {
+		apiErr APIError
+		want   bool
+	}{
+		{APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{APIError{StatusCode: http.StatusInternalServerError}, true},
+		{APIError{StatusCode: http.StatusBadGateway}, true},
+		{APIError{StatusCode: http.StatusServiceUnavailable}, true},
+		{APIError{StatusCode: http.StatusGatewayTimeout}, true},
+		{APIError{StatusCode: 529}, true},
+		{APIError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error"}, false},
+		{APIError{StatusCode: http.StatusUnauthorized, Type: "authentication_error"}, false},
+		{APIError{StatusCode: http.StatusNotFound}, false},
+		// some proxies return the API's error body with a different status code
+		{APIError{StatusCode: http.StatusBadRequest, Type: "overloaded_error"}, true},
+		{APIError{StatusCode: http.StatusBadRequest, Type: "api_error"}, true},
+	}
+	for _, test := range tests {
+		if got := test.apiErr.Retryable(); got != test.want {
+			t.Errorf("Retryable() for %d %q = %v, want %v", test.apiErr.StatusCode, test.apiErr.Type, got, test.want)
+		}
+	}
+}
+
+func TestRetryAfterFromHeaders(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{name: "no headers", want: 0},
+		{name: "seconds", headers: map[string]string{"retry-after": "2"}, want: 2 * time.Second},
+		{name: "fractional seconds", headers: map[string]string{"retry-after": "0.5"}, want: 500 * time.Millisecond},
+		{name: "HTTP date", headers: map[string]string{"retry-after": now.Add(3 * time.Second).Format(http.TimeFormat)}, want: 3 * time.Second},
+		{name: "HTTP date in the past", headers: map[string]string{"retry-after": now.Add(-time.Minute).Format(http.TimeFormat)}, want: 0},
+		{
+			name: "exhausted rate limit",
+			headers: map[string]string{
+				"anthropic-ratelimit-requests-remaining": "0",
+				"anthropic-ratelimit-requests-reset":     now.Add(4 * time.Second).Format(time.RFC3339),
+			},
+			want: 4 * time.Second,
+		},
+		{
+			name: "latest reset of the exhausted limits",
+			headers: map[string]string{
+				"anthropic-ratelimit-requests-remaining":      "0",
+				"anthropic-ratelimit-requests-reset":          now.Add(4 * time.Second).Format(time.RFC3339),
+				"anthropic-ratelimit-input-tokens-remaining":  "0",
+				"anthropic-ratelimit-input-tokens-reset":      now.Add(9 * time.Second).Format(time.RFC3339),
+				"anthropic-ratelimit-output-tokens-remaining": "100",
+				"anthropic-ratelimit-output-tokens-reset":     now.Add(time.Minute).Format(time.RFC3339),
+			},
+			want: 9 * time.Second,
+		},
+		{
+			name: "retry-after takes precedence",
+			headers: map[string]string{
+				"retry-after":                            "1",
+				"anthropic-ratelimit-requests-remaining": "0",
+				"anthropic-ratelimit-requests-reset":     now.Add(time.Minute).Format(time.RFC3339),
+			},
+			want: time.Second,
+		},
+		{
+			name: "invalid reset time",
+			headers: map[string]string{
+				"anthropic-ratelimit-requests-remaining": "0",
+				"anthropic-ratelimit-requests-reset":     "soon",
+			},
+			want: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range test.headers {
+				header.Set(key, value)
+			}
+			if got := retryAfterFromHeaders(header, now); got != test.want {
+				t.Errorf("retryAfterFromHeaders = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		name     string
+		attempt  int
+		apiErr   *APIError
+		min, max time.Duration
+	}{
+		{name: "first retry", attempt: 0, min: 0, max: 100 * time.Millisecond},
+		{name: "doubles for each retry", attempt: 2, min: 0, max: 400 * time.Millisecond},
+		{name: "capped at the maximum delay", attempt: 5, min: 0, max: time.Second},
+		{name: "does not overflow", attempt: 80, min: 0, max: time.Second},
+		{name: "error without a delay", attempt: 0, apiErr: &APIError{StatusCode: 529}, min: 0, max: 100 * time.Millisecond},
+		// the API's delay is respected even when it exceeds the maximum delay
+		{name: "delay asked for by the API", attempt: 0, apiErr: &APIError{StatusCode: 429, RetryAfter: 5 * time.Second}, min: 5 * time.Second, max: 5*time.Second + 250*time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for range 100 {
+				if delay := policy.backoff(test.attempt, test.apiErr); delay < test.min || delay > test.max {
+					t.Fatalf("backoff = %s, want between %s and %s", delay, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+/*
+Returns a server that answers requests with the given handlers in turn, repeating the last one, and the number of requests it received
+*/
+func newRetryServer(t *testing.T, handlers ...http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		handlers[min(n, len(handlers))-1](w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+/*
+Returns a handler that responds with the given status code, headers and body
+*/
+func respond(statusCode int, headers map[string]string, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(statusCode)
+		io.WriteString(w, body)
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+	overloaded := respond(529, nil, `{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`)
+	ok := respond(http.StatusOK, nil, `{}`)
+	tests := []struct {
+		name       string
+		handlers   []http.HandlerFunc
+		maxRetries int
+		statusCode int // of the returned response or error
+		requests   int
+	}{
+		{name: "succeeds", handlers: []http.HandlerFunc{ok}, maxRetries: 3, statusCode: http.StatusOK, requests: 1},
+		{name: "retries retryable errors", handlers: []http.HandlerFunc{overloaded, overloaded, ok}, maxRetries: 3, statusCode: http.StatusOK, requests: 3},
+		{name: "gives up after the last retry", handlers: []http.HandlerFunc{overloaded}, maxRetries: 2, statusCode: 529, requests: 3},
+		{name: "retries disabled", handlers: []http.HandlerFunc{overloaded}, maxRetries: 0, statusCode: 529, requests: 1},
+		{
+			name:       "does not retry other errors",
+			handlers:   []http.HandlerFunc{respond(http.StatusBadRequest, nil, `{"type": "error", "error": {"type": "invalid_request_error", "message": "Bad"}}`)},
+			maxRetries: 3,
+			statusCode: http.StatusBadRequest,
+			requests:   1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newRetryServer(t, test.handlers...)
+			policy := RetryPolicy{MaxRetries: test.maxRetries, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+			res, err := sendWithRetry(context.Background(), nil, policy, nil, func() (*http.Request, error) {
+				return http.NewRequest(http.MethodPost, server.URL, nil)
+			})
+
+			statusCode := statusCodeOf(err)
+			if res != nil {
+				res.Body.Close()
+				statusCode = res.StatusCode
+			}
+			if statusCode != test.statusCode || int(requests.Load()) != test.requests {
+				t.Errorf("sendWithRetry = status %d (error %v) after %d requests, want status %d after %d requests", statusCode, err, requests.Load(), test.statusCode, test.requests)
+			}
+			var apiErr *APIError
+			if test.statusCode != http.StatusOK && !errors.As(err, &apiErr) {
+				t.Errorf("sendWithRetry returned error %v, want an *APIError", err)
+			}
+		})
+	}
+
+	t.Run("pauses the rate limiter", func(t *testing.T) {
+		server, requests := newRetryServer(t, respond(http.StatusTooManyRequests, map[string]string{"retry-after": "0.05"}, `{"type": "error", "error": {"type": "rate_limit_error", "message": "Slow down"}}`), ok)
+		limiter := NewRateLimiter(60000, 10)
+		start := time.Now()
+		res, err := sendWithRetry(context.Background(), nil, RetryPolicy{MaxRetries: 1}, limiter, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodPost, server.URL, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || requests.Load() != 2 {
+			t.Errorf("sent %d requests in %s, want the retry to wait for the 50ms asked for", requests.Load(), elapsed)
+		}
+		if delay := limiter.reserve(start.Add(10 * time.Millisecond)); delay <= 0 {
+			t.Error("the rate limiter was not paused until the rate limit reset")
+		}
+	})
+
+	t.Run("pauses the rate limiter without retry headers", func(t *testing.T) {
+		server, requests := newRetryServer(t, respond(http.StatusTooManyRequests, nil, `{"type": "error", "error": {"type": "rate_limit_error", "message": "Slow down"}}`), ok)
+		limiter := NewRateLimiter(60000, 10)
+		policy := RetryPolicy{MaxRetries: 1, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second}
+		start := time.Now()
+		res, err := sendWithRetry(context.Background(), nil, policy, limiter, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodPost, server.URL, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		// the limiter is paused for the longest backoff of the first retry
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || requests.Load() != 2 {
+			t.Errorf("sent %d requests in %s, want the retry to wait for the limiter's 50ms pause", requests.Load(), elapsed)
+		}
+	})
+
+	t.Run("pauses the rate limiter when a limit is exhausted", func(t *testing.T) {
+		reset := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		headers := map[string]string{"anthropic-ratelimit-requests-remaining": "0", "anthropic-ratelimit-requests-reset": reset}
+		server, _ := newRetryServer(t, respond(http.StatusOK, headers, `{}`))
+		limiter := NewRateLimiter(60000, 10)
+		res, err := sendWithRetry(context.Background(), nil, RetryPolicy{}, limiter, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodPost, server.URL, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if delay := limiter.reserve(time.Now()); delay < 59*time.Minute {
+			t.Errorf("the next request waits %s, want it to wait until the limit resets in an hour", delay)
+		}
+	})
+
+	t.Run("reports retries", func(t *testing.T) {
+		server, _ := newRetryServer(t, overloaded, overloaded, ok)
+		retries := make([]int, 0)
+		policy := RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		policy.OnRetry = func(retry int, delay time.Duration, err error) {
+			if statusCodeOf(err) != 529 || delay > time.Millisecond {
+				t.Errorf("retry %d was reported with delay %s and error %v", retry, delay, err)
+			}
+			retries = append(retries, retry)
+		}
+		res, err := sendWithRetry(context.Background(), nil, policy, nil, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodPost, server.URL, nil)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if !reflect.DeepEqual(retries, []int{1, 2}) {
+			t.Errorf("OnRetry was called for retries %v, want [1 2]", retries)
+		}
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		server, requests := newRetryServer(t, overloaded)
+		ctx, cancel := context.WithCancel(context.Background())
+		policy := RetryPolicy{MaxRetries: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err := sendWithRetry(ctx, nil, policy, nil, func() (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodPost, server.URL, nil)
+		})
+		if !errors.Is(err, context.Canceled) || requests.Load() != 1 {
+			t.Errorf("sendWithRetry returned %v after %d requests, want %v after 1", err, requests.Load(), context.Canceled)
+		}
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	limiter := NewRateLimiter(60, 2)
+	limiter.last = start
+
+	// the burst is let through at once, then requests are spaced by the rate
+	for i, want := range []time.Duration{0, 0, time.Second} {
+		if delay := limiter.reserve(start); delay != want {
+			t.Errorf("request %d waited %s, want %s", i+1, delay, want)
+		}
+	}
+	if delay := limiter.reserve(start.Add(time.Second)); delay != 0 {
+		t.Errorf("a request after the bucket refilled waited %s", delay)
+	}
+
+	limiter.pauseUntil(start.Add(10 * time.Second))
+	limiter.pauseUntil(start.Add(5 * time.Second)) // an earlier pause does not shorten it
+	if delay := limiter.reserve(start.Add(2 * time.Second)); delay != 8*time.Second {
+		t.Errorf("a request while paused waited %s, want 8s", delay)
+	}
+
+	// a rate of 0 does not limit requests, but the limiter can still be paused
+	unlimited := NewRateLimiter(0, 1)
+	for i := range 10 {
+		if delay := unlimited.reserve(start); delay != 0 {
+			t.Fatalf("request %d to an unlimited limiter waited %s", i+1, delay)
+		}
+	}
+	unlimited.pauseUntil(start.Add(time.Second))
+	if delay := unlimited.reserve(start); delay != time.Second {
+		t.Errorf("a request to a paused unlimited limiter waited %s, want 1s", delay)
+	}
+
+	if SharedRateLimiter("key-1", 60, 1) != SharedRateLimiter("key-1", 120, 5) || SharedRateLimiter("key-1", 60, 1) == SharedRateLimiter("key-2", 60, 1) {
+		t.Error("SharedRateLimiter does not return one limiter per API key")
+	}
+}
@@ -0,0 +1,495 @@
+/*
+AgentStore backed by a SQLite database
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go SQLite driver, so that no C toolchain is needed
+)
+
+/*
+Stores Agents in a SQLite database.
+Core memory blocks, recall memory and archival memory are kept in their own tables, so that saving an Agent does not rewrite the recall entries it already saved.
+*/
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema string = `
+CREATE TABLE IF NOT EXISTS agents (
+	id           TEXT PRIMARY KEY,
+	name         TEXT NOT NULL UNIQUE,
+	model        TEXT NOT NULL,
+	system       TEXT NOT NULL,
+	chat_history TEXT NOT NULL,
+	tools        TEXT NOT NULL,
+	created_at   TEXT NOT NULL,
+	updated_at   TEXT NOT NULL,
+	recall_out_of_context INTEGER NOT NULL DEFAULT 0,
+	context_window        TEXT NOT NULL DEFAULT '{}',
+	context_warning_given INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS memory_blocks (
+	agent_id     TEXT NOT NULL,
+	label        TEXT NOT NULL,
+	section_name TEXT NOT NULL,
+	data         TEXT NOT NULL,
+	size_limit   INTEGER NOT NULL DEFAULT 0,
+	read_only    INTEGER NOT NULL DEFAULT 0,
+	description  TEXT NOT NULL DEFAULT '',
+	last_edited  TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (agent_id, label)
+);
+CREATE TABLE IF NOT EXISTS memory_edits (
+	agent_id    TEXT NOT NULL,
+	seq         INTEGER NOT NULL,
+	block       TEXT NOT NULL,
+	version     INTEGER NOT NULL,
+	operation   TEXT NOT NULL,
+	before      TEXT NOT NULL,
+	after       TEXT NOT NULL,
+	tool_use_id TEXT NOT NULL,
+	timestamp   TEXT NOT NULL,
+	PRIMARY KEY (agent_id, seq)
+);
+CREATE TABLE IF NOT EXISTS recall_entries (
+	agent_id  TEXT NOT NULL,
+	id        INTEGER NOT NULL,
+	timestamp TEXT NOT NULL,
+	role      TEXT NOT NULL,
+	message   TEXT NOT NULL,
+	PRIMARY KEY (agent_id, id)
+);
+CREATE TABLE IF NOT EXISTS archival_passages (
+	agent_id  TEXT NOT NULL,
+	id        INTEGER NOT NULL,
+	text      TEXT NOT NULL,
+	tags      TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	vector    TEXT,
+	PRIMARY KEY (agent_id, id)
+);
+`
+
+/*
+Columns that were added to the tables after they were first created.
+Databases created before them are given the columns when they are opened.
+*/
+var sqliteAddedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"agents", "recall_out_of_context", "INTEGER NOT NULL DEFAULT 0"},
+	{"agents", "context_window", "TEXT NOT NULL DEFAULT '{}'"},
+	{"agents", "context_warning_given", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+/*
+Opens (or creates) the SQLite database at the given path and prepares its tables.
+Use ":memory:" for a database that only lasts as long as the store.
+*/
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening agent database: %w", err)
+	}
+	// SQLite allows a single writer at a time; a single connection also keeps ":memory:" databases from being split across connections
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating agent database tables: %w", err)
+	}
+	for _, added := range sqliteAddedColumns {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, added.table, added.column).Scan(&count); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error checking the columns of the %s table: %w", added.table, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, added.table, added.column, added.definition)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error adding the %s column to the %s table: %w", added.column, added.table, err)
+		}
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (store *SQLiteStore) Save(ctx context.Context, state AgentState) error {
+	if state.ID == "" {
+		return fmt.Errorf("cannot save agent %q without an ID", state.Name)
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existingID string
+	err = tx.QueryRowContext(ctx, `SELECT id FROM agents WHERE name = ? AND id <> ?`, state.Name, state.ID).Scan(&existingID)
+	if err == nil {
+		return fmt.Errorf("an agent named %q already exists with ID %s", state.Name, existingID)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	system, err := json.Marshal(state.System)
+	if err != nil {
+		return err
+	}
+	chatHistory, err := json.Marshal(state.ChatHistory)
+	if err != nil {
+		return err
+	}
+	tools, err := json.Marshal(state.Tools)
+	if err != nil {
+		return err
+	}
+	contextWindow, err := json.Marshal(state.ContextWindow)
+	if err != nil {
+		return err
+	}
+	now := formatTime(time.Now())
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO agents (id, name, model, system, chat_history, tools, created_at, updated_at, recall_out_of_context, context_window, context_warning_given)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, model = excluded.model, system = excluded.system,
+			chat_history = excluded.chat_history, tools = excluded.tools, updated_at = excluded.updated_at,
+			recall_out_of_context = excluded.recall_out_of_context, context_window = excluded.context_window,
+			context_warning_given = excluded.context_warning_given`,
+		state.ID, state.Name, state.Model, string(system), string(chatHistory), string(tools), now, now,
+		state.RecallOutOfContext, string(contextWindow), state.ContextWarningGiven)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM memory_blocks WHERE agent_id = ?`, state.ID); err != nil {
+		return err
+	}
+	for _, block := range state.CoreMemory {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO memory_blocks (agent_id, label, section_name, data, size_limit, read_only, description, last_edited)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			state.ID, block.Label, block.SectionName, block.Data, block.Limit, block.ReadOnly, block.Description, formatTime(block.LastEdited))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the edit log, recall memory and archival memory only grow, so only the entries after the last saved one are inserted
+	if _, err := tx.ExecContext(ctx, `DELETE FROM memory_edits WHERE agent_id = ? AND seq > ?`, state.ID, len(state.MemoryEdits)); err != nil {
+		return err
+	}
+	savedEdits, err := lastSavedID(ctx, tx, `SELECT COALESCE(MAX(seq), 0) FROM memory_edits WHERE agent_id = ?`, state.ID)
+	if err != nil {
+		return err
+	}
+	for i, edit := range state.MemoryEdits[savedEdits:] {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO memory_edits (agent_id, seq, block, version, operation, before, after, tool_use_id, timestamp)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			state.ID, savedEdits+i+1, edit.Block, edit.Version, edit.Operation, edit.Before, edit.After, edit.ToolUseID, formatTime(edit.Timestamp))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recall_entries WHERE agent_id = ? AND id > ?`, state.ID, len(state.RecallMemory)); err != nil {
+		return err
+	}
+	savedRecall, err := lastSavedID(ctx, tx, `SELECT COALESCE(MAX(id), 0) FROM recall_entries WHERE agent_id = ?`, state.ID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range state.RecallMemory {
+		if entry.ID <= savedRecall {
+			continue
+		}
+		message, err := json.Marshal(entry.Message)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO recall_entries (agent_id, id, timestamp, role, message) VALUES (?, ?, ?, ?, ?)`,
+			state.ID, entry.ID, formatTime(entry.Timestamp), entry.Role, string(message))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM archival_passages WHERE agent_id = ? AND id > ?`, state.ID, len(state.ArchivalMemory)); err != nil {
+		return err
+	}
+	savedArchival, err := lastSavedID(ctx, tx, `SELECT COALESCE(MAX(id), 0) FROM archival_passages WHERE agent_id = ?`, state.ID)
+	if err != nil {
+		return err
+	}
+	// passages that were saved without an embedding may have been given one since
+	unembedded, err := unembeddedPassages(ctx, tx, state.ID)
+	if err != nil {
+		return err
+	}
+	for _, record := range state.ArchivalMemory {
+		if record.ID <= savedArchival && (record.Vector == nil || !unembedded[record.ID]) {
+			continue
+		}
+		tags, err := json.Marshal(record.Tags)
+		if err != nil {
+			return err
+		}
+		var vector any
+		if record.Vector != nil {
+			encoded, err := json.Marshal(record.Vector)
+			if err != nil {
+				return err
+			}
+			vector = string(encoded)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO archival_passages (agent_id, id, text, tags, timestamp, vector) VALUES (?, ?, ?, ?, ?, ?)`,
+			state.ID, record.ID, record.Text, string(tags), formatTime(record.Timestamp), vector)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+Returns the ID of the last row saved for the agent, given a query for it, or 0 if none was saved
+*/
+func lastSavedID(ctx context.Context, tx *sql.Tx, query string, agentID string) (int, error) {
+	var id int
+	if err := tx.QueryRowContext(ctx, query, agentID).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+/*
+Returns the IDs of the agent's saved passages that have no embedding
+*/
+func unembeddedPassages(ctx context.Context, tx *sql.Tx, agentID string) (map[int]bool, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM archival_passages WHERE agent_id = ? AND vector IS NULL`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+func (store *SQLiteStore) Load(ctx context.Context, idOrName string) (*AgentState, error) {
+	tx, err := store.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var state AgentState
+	var system, chatHistory, tools, contextWindow, createdAt, updatedAt string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, name, model, system, chat_history, tools, created_at, updated_at, recall_out_of_context, context_window, context_warning_given
+		FROM agents WHERE id = ? OR name = ? ORDER BY id = ? DESC LIMIT 1`, idOrName, idOrName, idOrName).
+		Scan(&state.ID, &state.Name, &state.Model, &system, &chatHistory, &tools, &createdAt, &updatedAt,
+			&state.RecallOutOfContext, &contextWindow, &state.ContextWarningGiven)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %q", ErrAgentNotFound, idOrName)
+	} else if err != nil {
+		return nil, err
+	}
+	for _, column := range []struct {
+		data  string
+		value any
+	}{{system, &state.System}, {chatHistory, &state.ChatHistory}, {tools, &state.Tools}, {contextWindow, &state.ContextWindow}} {
+		if err := json.Unmarshal([]byte(column.data), column.value); err != nil {
+			return nil, fmt.Errorf("error parsing agent %q: %w", state.Name, err)
+		}
+	}
+	state.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	state.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+
+	if state.CoreMemory, err = loadMemoryBlocks(ctx, tx, state.ID); err != nil {
+		return nil, err
+	}
+	if state.MemoryEdits, err = loadMemoryEdits(ctx, tx, state.ID); err != nil {
+		return nil, err
+	}
+	if state.RecallMemory, err = loadRecallEntries(ctx, tx, state.ID); err != nil {
+		return nil, err
+	}
+	if state.ArchivalMemory, err = loadArchivalRecords(ctx, tx, state.ID); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func loadMemoryBlocks(ctx context.Context, tx *sql.Tx, agentID string) ([]MemoryBlockState, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT label, section_name, data, size_limit, read_only, description, last_edited FROM memory_blocks
+		WHERE agent_id = ? ORDER BY label`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := make([]MemoryBlockState, 0)
+	for rows.Next() {
+		var block MemoryBlockState
+		var lastEdited string
+		if err := rows.Scan(&block.Label, &block.SectionName, &block.Data, &block.Limit, &block.ReadOnly, &block.Description, &lastEdited); err != nil {
+			return nil, err
+		}
+		block.LastEdited, _ = time.Parse(time.RFC3339Nano, lastEdited)
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
+}
+
+func loadMemoryEdits(ctx context.Context, tx *sql.Tx, agentID string) ([]MemoryEdit, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT block, version, operation, before, after, tool_use_id, timestamp FROM memory_edits
+		WHERE agent_id = ? ORDER BY seq`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := make([]MemoryEdit, 0)
+	for rows.Next() {
+		var edit MemoryEdit
+		var timestamp string
+		if err := rows.Scan(&edit.Block, &edit.Version, &edit.Operation, &edit.Before, &edit.After, &edit.ToolUseID, &timestamp); err != nil {
+			return nil, err
+		}
+		edit.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+func loadRecallEntries(ctx context.Context, tx *sql.Tx, agentID string) ([]RecallEntry, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, timestamp, role, message FROM recall_entries WHERE agent_id = ? ORDER BY id`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]RecallEntry, 0)
+	for rows.Next() {
+		var entry RecallEntry
+		var timestamp, message string
+		if err := rows.Scan(&entry.ID, &timestamp, &entry.Role, &message); err != nil {
+			return nil, err
+		}
+		entry.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+		if err := json.Unmarshal([]byte(message), &entry.Message); err != nil {
+			return nil, fmt.Errorf("error parsing recall entry %d: %w", entry.ID, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func loadArchivalRecords(ctx context.Context, tx *sql.Tx, agentID string) ([]ArchivalRecord, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, text, tags, timestamp, vector FROM archival_passages WHERE agent_id = ? ORDER BY id`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]ArchivalRecord, 0)
+	for rows.Next() {
+		var record ArchivalRecord
+		var tags, timestamp string
+		var vector sql.NullString
+		if err := rows.Scan(&record.ID, &record.Text, &tags, &timestamp, &vector); err != nil {
+			return nil, err
+		}
+		record.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+		if err := json.Unmarshal([]byte(tags), &record.Tags); err != nil {
+			return nil, fmt.Errorf("error parsing tags of passage %d: %w", record.ID, err)
+		}
+		if vector.Valid {
+			if err := json.Unmarshal([]byte(vector.String), &record.Vector); err != nil {
+				return nil, fmt.Errorf("error parsing embedding of passage %d: %w", record.ID, err)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *SQLiteStore) List(ctx context.Context) ([]AgentSummary, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT id, name, model, created_at, updated_at FROM agents ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := make([]AgentSummary, 0)
+	for rows.Next() {
+		var summary AgentSummary
+		var createdAt, updatedAt string
+		if err := rows.Scan(&summary.ID, &summary.Name, &summary.Model, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		summary.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		summary.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+func (store *SQLiteStore) Delete(ctx context.Context, idOrName string) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRowContext(ctx, `SELECT id FROM agents WHERE id = ? OR name = ? ORDER BY id = ? DESC LIMIT 1`, idOrName, idOrName, idOrName).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %q", ErrAgentNotFound, idOrName)
+	} else if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"memory_blocks", "memory_edits", "recall_entries", "archival_passages"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE agent_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM agents WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) Close() error {
+	return store.db.Close()
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,566 @@
+/*
+Timed heartbeats: waking agents on a schedule so that they can think, reflect and organize their memory without any user input
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The source of time for a Scheduler. Replace it in tests to control time.
+*/
+type Clock interface {
+	Now() time.Time
+	// Returns a channel that receives the time once the duration has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+/*
+A Clock that only moves when it is advanced, for tests
+*/
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+type manualWaiter struct {
+	at      time.Time
+	channel chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (clock *ManualClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *ManualClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	channel := make(chan time.Time, 1)
+	if d <= 0 {
+		channel <- clock.now
+		return channel
+	}
+	clock.waiters = append(clock.waiters, manualWaiter{at: clock.now.Add(d), channel: channel})
+	return channel
+}
+
+/*
+Moves the clock forward, firing every After channel whose time has come
+*/
+func (clock *ManualClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	waiting := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if waiter.at.After(clock.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		waiter.channel <- clock.now
+	}
+	clock.waiters = waiting
+}
+
+/*
+Decides when an agent is next woken
+*/
+type Schedule interface {
+	// Returns the first time strictly after the given time at which the agent should be woken, or the zero time if there is none
+	Next(after time.Time) time.Time
+}
+
+/*
+Wakes an agent at a fixed interval
+*/
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+func Every(interval time.Duration) IntervalSchedule {
+	return IntervalSchedule{Interval: interval}
+}
+
+func (schedule IntervalSchedule) Next(after time.Time) time.Time {
+	if schedule.Interval <= 0 {
+		return time.Time{}
+	}
+	return after.Add(schedule.Interval)
+}
+
+// How far ahead a CronSchedule looks for a matching time before giving up
+const CRON_SEARCH_LIMIT time.Duration = 5 * 366 * 24 * time.Hour
+
+/*
+Wakes an agent at the times matched by a cron expression with five fields: minute, hour, day of month, month and day of week.
+Each field is "*", a number, a range ("1-5"), a step ("*\/15", "0-30/10") or a comma separated list of these.
+As in cron, when both the day of month and the day of week are restricted, a day matching either one matches.
+*/
+type CronSchedule struct {
+	Expression string
+	Location   *time.Location // the time zone the expression is evaluated in; nil uses the time zone of the times passed to Next
+
+	minutes, hours, days, months, weekdays uint64 // bit sets of the values matched by each field
+	anyDay, anyWeekday                     bool
+}
+
+/*
+Parses a cron expression, e.g. "0 9 * * 1-5" for 9am on weekdays
+*/
+func ParseCron(expression string) (*CronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields (minute, hour, day of month, month, day of week)", expression)
+	}
+
+	schedule := &CronSchedule{Expression: expression, anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	ranges := []struct {
+		field    *uint64
+		name     string
+		min, max int
+	}{
+		{&schedule.minutes, "minute", 0, 59},
+		{&schedule.hours, "hour", 0, 23},
+		{&schedule.days, "day of month", 1, 31},
+		{&schedule.months, "month", 1, 12},
+		{&schedule.weekdays, "day of week", 0, 7},
+	}
+	for i, r := range ranges {
+		bits, err := parseCronField(fields[i], r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in cron expression %q: %w", r.name, expression, err)
+		}
+		*r.field = bits
+	}
+	// Sunday may be written as 0 or 7
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is not a valid range within %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	day := schedule.days&(1<<t.Day()) != 0
+	weekday := schedule.weekdays&(1<<int(t.Weekday())) != 0
+	switch {
+	case schedule.anyDay && schedule.anyWeekday:
+		return true
+	case schedule.anyDay:
+		return weekday
+	case schedule.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+func (schedule *CronSchedule) Next(after time.Time) time.Time {
+	if schedule.Location != nil {
+		after = after.In(schedule.Location)
+	}
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(CRON_SEARCH_LIMIT)
+
+	for t.Before(limit) {
+		switch {
+		case schedule.months&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !schedule.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case schedule.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case schedule.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+/*
+Parses a schedule given either as an interval (e.g. "30m") or as a cron expression (e.g. "0 9 * * *")
+*/
+func ParseSchedule(value string) (Schedule, error) {
+	if interval, err := time.ParseDuration(value); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("heartbeat interval must be positive")
+		}
+		return Every(interval), nil
+	}
+	return ParseCron(value)
+}
+
+/*
+A daily period during which agents are not woken, e.g. from 22:00 to 07:00.
+Start and End are times of day, as durations since midnight; a period whose End is before its Start runs past midnight.
+*/
+type QuietHours struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location // nil uses the time zone of the times being checked
+}
+
+/*
+Parses quiet hours written as "HH:MM-HH:MM"
+*/
+func ParseQuietHours(value string) (*QuietHours, error) {
+	start, end, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("quiet hours %q must be written as HH:MM-HH:MM", value)
+	}
+	quietHours := &QuietHours{}
+	for _, part := range []struct {
+		text  string
+		value *time.Duration
+	}{{start, &quietHours.Start}, {end, &quietHours.End}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.text))
+		if err != nil {
+			return nil, fmt.Errorf("quiet hours %q must be written as HH:MM-HH:MM", value)
+		}
+		*part.value = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return quietHours, nil
+}
+
+/*
+Whether the time falls within the quiet hours
+*/
+func (quietHours QuietHours) Contains(t time.Time) bool {
+	if quietHours.Location != nil {
+		t = t.In(quietHours.Location)
+	}
+	timeOfDay := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if quietHours.Start <= quietHours.End {
+		return timeOfDay >= quietHours.Start && timeOfDay < quietHours.End
+	}
+	return timeOfDay >= quietHours.Start || timeOfDay < quietHours.End
+}
+
+// Length of a budget period when HeartbeatBudget.Period is not set
+const DEFAULT_BUDGET_PERIOD time.Duration = 24 * time.Hour
+
+/*
+Limits how much an agent may do in timed heartbeats within each period. A limit of 0 means no limit.
+*/
+type HeartbeatBudget struct {
+	MaxRuns  int           // the maximum number of heartbeats per period
+	MaxSteps int           // the maximum number of requests to the model per period, across all heartbeats
+	Period   time.Duration // defaults to DEFAULT_BUDGET_PERIOD
+}
+
+/*
+How a single agent is woken by a Scheduler
+*/
+type HeartbeatOptions struct {
+	Schedule   Schedule
+	QuietHours *QuietHours     // heartbeats that fall within the quiet hours are skipped
+	Budget     HeartbeatBudget // heartbeats are skipped once the budget for the current period is spent
+	RunOptions RunOptions      // controls each heartbeat's run; MaxSteps is lowered to what is left of the budget
+	/*
+		Held while the agent runs, so that a heartbeat does not overlap other uses of the agent (e.g. a conversation with the user).
+		Optional; without it the caller must make sure that the agent is not used elsewhere.
+	*/
+	Lock sync.Locker
+	// Called after every heartbeat, including skipped ones, while the Lock is still held
+	OnHeartbeat func(report HeartbeatReport)
+}
+
+/*
+Possible values for the Skipped field of a HeartbeatReport
+*/
+const (
+	HEARTBEAT_SKIPPED_QUIET_HOURS = "quiet_hours"
+	HEARTBEAT_SKIPPED_BUDGET      = "budget"
+)
+
+/*
+The outcome of a timed heartbeat
+*/
+type HeartbeatReport struct {
+	AgentID string
+	Time    time.Time  // when the heartbeat was due
+	Skipped string     // why the agent was not run, or "" if it was
+	Result  *RunResult // the result of the run, if the agent was run
+	Err     error
+}
+
+type heartbeatJob struct {
+	agent       *Agent
+	options     HeartbeatOptions
+	next        time.Time
+	periodStart time.Time
+	runs        int  // the number of heartbeats run in the current budget period
+	steps       int  // the number of steps taken in the current budget period
+	running     bool // whether a heartbeat of the agent is in progress; guarded by the Scheduler's mu
+}
+
+/*
+Wakes agents according to their schedules, adding a heartbeat message with the current time and running the agent loop
+*/
+type Scheduler struct {
+	Clock   Clock // also given to the agents that are added without a Clock of their own
+	mu      sync.Mutex
+	jobs    map[string]*heartbeatJob // by agent ID
+	wake    chan struct{}            // signals the Run loop that the jobs changed
+	running sync.WaitGroup           // heartbeats in progress
+}
+
+/*
+Creates a Scheduler driven by the given clock; a nil clock uses the system clock
+*/
+func NewScheduler(clock Clock) *Scheduler {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &Scheduler{Clock: clock, jobs: make(map[string]*heartbeatJob), wake: make(chan struct{}, 1)}
+}
+
+/*
+Schedules timed heartbeats for the agent, replacing any schedule it already had.
+Returns an error if the schedule never wakes the agent, e.g. the cron expression "0 0 31 2 *".
+An agent without a Clock is given the Scheduler's, so that the times it records agree with the times of its heartbeats.
+*/
+func (scheduler *Scheduler) Add(agent *Agent, options HeartbeatOptions) error {
+	if options.Schedule == nil {
+		return fmt.Errorf("cannot schedule heartbeats for agent %q without a schedule", agent.Name)
+	}
+	now := scheduler.Clock.Now()
+	next := options.Schedule.Next(now)
+	if next.IsZero() {
+		return fmt.Errorf("cannot schedule heartbeats for agent %q: the schedule never wakes it", agent.Name)
+	}
+	if options.Budget.Period <= 0 {
+		options.Budget.Period = DEFAULT_BUDGET_PERIOD
+	}
+	if agent.Clock == nil {
+		agent.Clock = scheduler.Clock
+	}
+
+	scheduler.mu.Lock()
+	scheduler.jobs[agent.ID] = &heartbeatJob{agent: agent, options: options, next: next, periodStart: now}
+	scheduler.mu.Unlock()
+	scheduler.notify()
+	return nil
+}
+
+/*
+Stops the timed heartbeats of the agent with the given ID
+*/
+func (scheduler *Scheduler) Remove(agentID string) {
+	scheduler.mu.Lock()
+	delete(scheduler.jobs, agentID)
+	scheduler.mu.Unlock()
+	scheduler.notify()
+}
+
+func (scheduler *Scheduler) notify() {
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Returns the time at which the next heartbeat is due, or the zero time if none is scheduled
+*/
+func (scheduler *Scheduler) NextHeartbeat() time.Time {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	var next time.Time
+	for _, job := range scheduler.jobs {
+		if !job.next.IsZero() && (next.IsZero() || job.next.Before(next)) {
+			next = job.next
+		}
+	}
+	return next
+}
+
+/*
+Runs heartbeats as they come due, until the context is cancelled.
+Heartbeats run in the background, so that an agent that is busy does not hold up the heartbeats of the others;
+Run waits for them to finish before returning.
+*/
+func (scheduler *Scheduler) Run(ctx context.Context) error {
+	defer scheduler.running.Wait()
+	for {
+		scheduler.startDue(ctx, nil)
+
+		var timer <-chan time.Time
+		if next := scheduler.NextHeartbeat(); !next.IsZero() {
+			timer = scheduler.Clock.After(next.Sub(scheduler.Clock.Now()))
+		}
+		select {
+		case <-timer:
+		case <-scheduler.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+Runs every heartbeat that is due at the current time, waiting for them to finish.
+Different agents are run concurrently.
+*/
+func (scheduler *Scheduler) RunDue(ctx context.Context) {
+	var wg sync.WaitGroup
+	scheduler.startDue(ctx, &wg)
+	wg.Wait()
+}
+
+/*
+Starts every heartbeat that is due at the current time, adding them to the wait group if it is not nil.
+A heartbeat that comes due while the agent's previous heartbeat is still in progress is skipped.
+*/
+func (scheduler *Scheduler) startDue(ctx context.Context, wg *sync.WaitGroup) {
+	now := scheduler.Clock.Now()
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for _, job := range scheduler.jobs {
+		if job.next.IsZero() || job.next.After(now) {
+			continue
+		}
+		// a heartbeat that was missed (e.g. while the machine was asleep) is only run once
+		job.next = job.options.Schedule.Next(now)
+		if job.running {
+			continue
+		}
+		job.running = true
+		scheduler.running.Add(1)
+		if wg != nil {
+			wg.Add(1)
+		}
+		go func() {
+			defer func() {
+				scheduler.mu.Lock()
+				job.running = false
+				scheduler.mu.Unlock()
+				scheduler.running.Done()
+				if wg != nil {
+					wg.Done()
+				}
+			}()
+			scheduler.runJob(ctx, job, now)
+		}()
+	}
+}
+
+func (scheduler *Scheduler) runJob(ctx context.Context, job *heartbeatJob, now time.Time) {
+	options := job.options
+	if options.Lock != nil {
+		options.Lock.Lock()
+		defer options.Lock.Unlock()
+	}
+	// the agent may have been removed while waiting for the lock
+	scheduler.mu.Lock()
+	removed := scheduler.jobs[job.agent.ID] != job
+	scheduler.mu.Unlock()
+	if removed {
+		return
+	}
+
+	report := HeartbeatReport{AgentID: job.agent.ID, Time: now}
+	defer func() {
+		if options.OnHeartbeat != nil {
+			options.OnHeartbeat(report)
+		}
+	}()
+
+	if options.QuietHours != nil && options.QuietHours.Contains(now) {
+		report.Skipped = HEARTBEAT_SKIPPED_QUIET_HOURS
+		return
+	}
+
+	// starting a new budget period once the current one is over
+	if now.Sub(job.periodStart) >= options.Budget.Period {
+		job.periodStart, job.runs, job.steps = now, 0, 0
+	}
+	budget := options.Budget
+	runOptions := options.RunOptions
+	if runOptions.MaxSteps <= 0 {
+		runOptions.MaxSteps = DEFAULT_MAX_STEPS
+	}
+	if budget.MaxSteps > 0 {
+		runOptions.MaxSteps = min(runOptions.MaxSteps, budget.MaxSteps-job.steps)
+	}
+	if (budget.MaxRuns > 0 && job.runs >= budget.MaxRuns) || runOptions.MaxSteps <= 0 {
+		report.Skipped = HEARTBEAT_SKIPPED_BUDGET
+		return
+	}
+
+	job.agent.addTimedHeartbeatToChatHistory(now)
+	report.Result, report.Err = job.agent.Run(ctx, runOptions)
+	job.runs++
+	job.steps += report.Result.Steps
+}
+
+/*
+Adds a timed heartbeat to the chat history, telling the Agent the current time
+*/
+func (llm *Agent) addTimedHeartbeatToChatHistory(now time.Time) {
+	llm.addUserContentToChatHistory(Content{Type: "text", Text: fmt.Sprintf(
+		"[heartbeat] Timed heartbeat at %s. This is not a message from the user. "+
+			"You may use this time to reflect, organize your memory or follow up on earlier conversations; "+
+			"send the user a message with sendMessage only if you have a good reason to.",
+		now.Format("Monday, 2006-01-02 15:04 MST"))})
+}
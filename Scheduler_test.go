@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	after := time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC) // a Friday
+	tests := []struct {
+		value   string
+		next    time.Time
+		wantErr bool
+	}{
+		{value: "30m", next: after.Add(30 * time.Minute)},
+		{value: "1h30m", next: after.Add(90 * time.Minute)},
+		{value: "0 9 * * *", next: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{value: "*/15 * * * *", next: time.Date(2026, 10, 16, 8, 45, 0, 0, time.UTC)},
+		{value: "0 9 * * 1-5", next: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{value: "0 8 * * 1", next: time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)},
+		{value: "0 0 * * 7", next: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{value: "0 0 1 * *", next: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "0 12 13 * 5", next: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)},
+		{value: "0,30 8-10 * * *", next: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{value: "0 0 29 2 *", next: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{value: "0s", wantErr: true},
+		{value: "-5m", wantErr: true},
+		{value: "0 9 * *", wantErr: true},
+		{value: "60 * * * *", wantErr: true},
+		{value: "* 24 * * *", wantErr: true},
+		{value: "* * 0 * *", wantErr: true},
+		{value: "*/0 * * * *", wantErr: true},
+		{value: "5-1 * * * *", wantErr: true},
+		{value: "tomorrow", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSchedule(%q) succeeded, want an error", test.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSchedule(%q) returned an error: %v", test.value, err)
+			}
+			if next := schedule.Next(after); !next.Equal(test.next) {
+				t.Errorf("Next(%v) = %v, want %v", after, next, test.next)
+			}
+		})
+	}
+}
+
+func TestCronScheduleLocation(t *testing.T) {
+	location := time.FixedZone("UTC+2", 2*60*60)
+	schedule, err := ParseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule.Location = location
+
+	next := schedule.Next(time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC))
+	if want := time.Date(2026, 10, 17, 9, 0, 0, 0, location); !next.Equal(want) {
+		t.Errorf("Next = %v, want %v", next, want)
+	}
+}
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		value   string
+		start   time.Duration
+		end     time.Duration
+		wantErr bool
+	}{
+		{value: "22:00-07:00", start: 22 * time.Hour, end: 7 * time.Hour},
+		{value: "12:30-13:45", start: 12*time.Hour + 30*time.Minute, end: 13*time.Hour + 45*time.Minute},
+		{value: " 09:00 - 17:00 ", start: 9 * time.Hour, end: 17 * time.Hour},
+		{value: "22:00", wantErr: true},
+		{value: "25:00-07:00", wantErr: true},
+		{value: "22:00-7pm", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			quietHours, err := ParseQuietHours(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseQuietHours(%q) succeeded, want an error", test.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseQuietHours(%q) returned an error: %v", test.value, err)
+			}
+			if quietHours.Start != test.start || quietHours.End != test.end {
+				t.Errorf("ParseQuietHours(%q) = %v-%v, want %v-%v", test.value, quietHours.Start, quietHours.End, test.start, test.end)
+			}
+		})
+	}
+}
+
+func TestQuietHoursContains(t *testing.T) {
+	day := func(hour, minute int) time.Time { return time.Date(2026, 10, 16, hour, minute, 0, 0, time.UTC) }
+	overnight := QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}
+	lunch := QuietHours{Start: 12 * time.Hour, End: 13 * time.Hour}
+	tests := []struct {
+		name       string
+		quietHours QuietHours
+		time       time.Time
+		want       bool
+	}{
+		{"overnight before start", overnight, day(21, 59), false},
+		{"overnight at start", overnight, day(22, 0), true},
+		{"overnight after midnight", overnight, day(3, 0), true},
+		{"overnight at end", overnight, day(7, 0), false},
+		{"daytime inside", lunch, day(12, 30), true},
+		{"daytime at end", lunch, day(13, 0), false},
+		{"daytime outside", lunch, day(23, 0), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.quietHours.Contains(test.time); got != test.want {
+				t.Errorf("Contains(%v) = %v, want %v", test.time, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerSkipsBusyAgents(t *testing.T) {
+	clock := NewManualClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	scheduler := NewScheduler(clock)
+
+	busy := NewAgentWithProvider("test-model", "", "busy", &fakeProvider{})
+	idle := NewAgentWithProvider("test-model", "", "idle", &fakeProvider{})
+	var busyLock sync.Mutex
+	busyLock.Lock()
+	reports := make(chan HeartbeatReport, 4)
+	if err := scheduler.Add(busy, HeartbeatOptions{Schedule: Every(time.Minute), Lock: &busyLock}); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Add(idle, HeartbeatOptions{Schedule: Every(time.Minute), OnHeartbeat: func(report HeartbeatReport) { reports <- report }}); err != nil {
+		t.Fatal(err)
+	}
+	if idle.Clock != Clock(clock) {
+		t.Errorf("the agent was not given the scheduler's clock")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- scheduler.Run(ctx) }()
+
+	for i := 1; i <= 2; i++ {
+		clock.Advance(time.Minute)
+		select {
+		case report := <-reports:
+			if report.Err != nil {
+				t.Fatalf("heartbeat %d failed: %v", i, report.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("heartbeat %d of the idle agent was held up by the busy agent", i)
+		}
+	}
+
+	entries, _ := idle.RecallMemory.SearchDate(clock.Now().Add(-time.Hour), clock.Now(), 0)
+	if len(entries) == 0 {
+		t.Errorf("recall memory has no entries dated by the scheduler's clock")
+	}
+
+	busyLock.Unlock()
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("Run returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSchedulerRejectsSchedulesThatNeverWake(t *testing.T) {
+	scheduler := NewScheduler(NewManualClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)))
+	agent := NewAgentWithProvider("test-model", "", "sam", &fakeProvider{})
+
+	// February never has a 31st day
+	schedule, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Add(agent, HeartbeatOptions{Schedule: schedule}); err == nil {
+		t.Errorf("Add accepted a schedule that never wakes the agent")
+	}
+	if next := scheduler.NextHeartbeat(); !next.IsZero() {
+		t.Errorf("NextHeartbeat = %v after the schedule was rejected, want the zero time", next)
+	}
+	if agent.Clock != nil {
+		t.Errorf("the agent was given the scheduler's clock although its schedule was rejected")
+	}
+}
+
+func TestRunDueSkips(t *testing.T) {
+	start := time.Date(2026, 10, 16, 20, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		options HeartbeatOptions
+		want    []string // the Skipped field of each heartbeat, one per hour
+	}{
+		{
+			name:    "quiet hours",
+			options: HeartbeatOptions{Schedule: Every(time.Hour), QuietHours: &QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}},
+			want:    []string{"", HEARTBEAT_SKIPPED_QUIET_HOURS, HEARTBEAT_SKIPPED_QUIET_HOURS},
+		},
+		{
+			name:    "run budget",
+			options: HeartbeatOptions{Schedule: Every(time.Hour), Budget: HeartbeatBudget{MaxRuns: 2, Period: 24 * time.Hour}},
+			want:    []string{"", "", HEARTBEAT_SKIPPED_BUDGET},
+		},
+		{
+			name:    "budget period ends",
+			options: HeartbeatOptions{Schedule: Every(time.Hour), Budget: HeartbeatBudget{MaxRuns: 1, Period: 3 * time.Hour}},
+			want:    []string{"", HEARTBEAT_SKIPPED_BUDGET, ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := NewManualClock(start)
+			scheduler := NewScheduler(clock)
+			agent, _ := newTestAgent(&fakeProvider{})
+
+			skipped := make([]string, 0)
+			options := test.options
+			options.OnHeartbeat = func(report HeartbeatReport) {
+				if report.Err != nil {
+					t.Errorf("heartbeat at %v failed: %v", report.Time, report.Err)
+				}
+				skipped = append(skipped, report.Skipped)
+			}
+			if err := scheduler.Add(agent, options); err != nil {
+				t.Fatal(err)
+			}
+			for range test.want {
+				clock.Advance(time.Hour)
+				scheduler.RunDue(context.Background())
+			}
+			if !reflect.DeepEqual(skipped, test.want) {
+				t.Errorf("heartbeats skipped for %q, want %q", skipped, test.want)
+			}
+		})
+	}
+}
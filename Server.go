@@ -0,0 +1,753 @@
+/*
+REST API for creating agents and talking to them over HTTP, so that they can be used as a service from other languages.
+Agents are kept in an AgentStore and saved after every change.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of recall memory entries per page of chat history, when the request does not specify one
+const DEFAULT_HISTORY_PAGE_SIZE int = 20
+
+// Largest page of chat history that may be requested
+const MAX_HISTORY_PAGE_SIZE int = 100
+
+// Largest request body accepted by the server
+const MAX_REQUEST_BODY_BYTES int64 = 1 << 20
+
+// How often a comment is sent on an idle event stream, so that proxies do not close the connection
+const EVENT_STREAM_KEEPALIVE time.Duration = 15 * time.Second
+
+/*
+Settings of a Server
+*/
+type ServerOptions struct {
+	// Used to restore saved agents; its Provider and ApiKey also serve newly created agents
+	Restore RestoreOptions
+	// The model and persona of new agents, when the request does not specify them
+	Model   string
+	Persona string
+	// Controls every run started by a message; a message may lower MaxSteps
+	RunOptions RunOptions
+	// The number of recent events kept per agent for clients that reconnect to its event stream; 0 uses DEFAULT_EVENT_LOG_SIZE
+	EventLogSize int
+	// When set, every agent the server loads or creates is given timed heartbeats with the Heartbeat options, and saved after each one
+	Scheduler *Scheduler
+	Heartbeat HeartbeatOptions
+	// When set, every agent the server loads or creates can message the others, and is saved after handling a message from one
+	Agents *AgentRegistry
+}
+
+/*
+Serves the agents in a store over HTTP.
+Each agent handles one request at a time; requests to different agents are handled concurrently.
+*/
+type Server struct {
+	store    AgentStore
+	options  ServerOptions
+	mu       sync.Mutex
+	agents   map[string]*serverAgent // agents loaded from the store, by ID
+	creating map[string]bool         // the names of the agents being created, reserved so that two requests cannot create agents with the same name
+	deletes  int                     // the number of agents deleted, so that a load that raced with a delete can be retried
+	closing  chan struct{}           // closed by Close, to end the event streams
+}
+
+type serverAgent struct {
+	mu      sync.Mutex // held while the agent is in use
+	agent   *Agent
+	events  *EventLog
+	deleted bool // set under mu once the agent is deleted, so that requests that were waiting for it do not save it again
+}
+
+/*
+Keeps the agent's recent events, for its event stream
+*/
+func (server *Server) newServerAgent(agent *Agent) *serverAgent {
+	entry := &serverAgent{agent: agent, events: NewEventLog(server.options.EventLogSize)}
+	agent.OnEvent = entry.events.Publish
+
+	if server.options.Scheduler != nil {
+		heartbeat := server.options.Heartbeat
+		heartbeat.Lock = &entry.mu
+		onHeartbeat := heartbeat.OnHeartbeat
+		heartbeat.OnHeartbeat = func(report HeartbeatReport) {
+			if report.Result != nil && !entry.deleted {
+				if err := agent.Save(context.Background(), server.store); err != nil && report.Err == nil {
+					report.Err = fmt.Errorf("error saving agent %q: %w", agent.Name, err)
+				}
+			}
+			if onHeartbeat != nil {
+				onHeartbeat(report)
+			}
+		}
+		if err := server.options.Scheduler.Add(agent, heartbeat); err != nil {
+			log.Print(err)
+		}
+	}
+	if server.options.Agents != nil {
+		// names are unique in the store, so registering cannot fail
+		server.options.Agents.Register(agent, "", &entry.mu)
+	}
+	return entry
+}
+
+/*
+Loads every agent in the store, so that they all receive timed heartbeats without waiting for a request
+*/
+func (server *Server) LoadAll(ctx context.Context) error {
+	summaries, err := server.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, summary := range summaries {
+		if _, err := server.agent(ctx, summary.ID); err != nil {
+			return fmt.Errorf("error loading agent %q: %w", summary.Name, err)
+		}
+	}
+	return nil
+}
+
+func NewServer(store AgentStore, options ServerOptions) *Server {
+	if options.Model == "" {
+		options.Model = DEFAULT_CLI_MODEL
+	}
+	if options.Persona == "" {
+		options.Persona = DEFAULT_CLI_PERSONA
+	}
+	if options.RunOptions.MaxSteps <= 0 {
+		options.RunOptions = DefaultRunOptions()
+	}
+	server := &Server{store: store, options: options, agents: make(map[string]*serverAgent), creating: make(map[string]bool), closing: make(chan struct{})}
+
+	if options.Agents != nil {
+		onDelivered := options.Agents.OnDelivered
+		options.Agents.OnDelivered = func(agent *Agent, result *RunResult, err error) {
+			if err := agent.Save(context.Background(), store); err != nil {
+				log.Printf("error saving agent %q after it handled a message from another agent: %v", agent.Name, err)
+			}
+			if onDelivered != nil {
+				onDelivered(agent, result, err)
+			}
+		}
+	}
+	return server
+}
+
+/*
+Ends every open event stream, so that the HTTP server can shut down without waiting for their clients to disconnect.
+Register it with http.Server.RegisterOnShutdown.
+*/
+func (server *Server) Close() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	select {
+	case <-server.closing:
+	default:
+		close(server.closing)
+	}
+}
+
+/*
+Returns the HTTP handler that serves the API:
+
+	GET    /agents                           list agents
+	POST   /agents                           create an agent
+	GET    /agents/{agent}                   get an agent, with its core memory and tools
+	DELETE /agents/{agent}                   delete an agent
+	POST   /agents/{agent}/messages          send a message and wait for the agent's replies
+	POST   /agents/{agent}/user-events       send an event (a login, a reaction, ...) and wait for the agent's replies
+	GET    /agents/{agent}/memory            list the blocks of core memory
+	POST   /agents/{agent}/memory            add a block to core memory
+	GET    /agents/{agent}/memory/{label}    get a block of core memory
+	PUT    /agents/{agent}/memory/{label}    replace the contents of a block
+	DELETE /agents/{agent}/memory/{label}    remove a block from core memory
+	GET    /agents/{agent}/tools             list the agent's tools
+	GET    /agents/{agent}/history           page through the agent's chat history (?page=0&pageSize=20)
+	GET    /agents/{agent}/events            stream the agent's events as server-sent events
+
+{agent} is the ID or the name of an agent.
+*/
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents", server.listAgents)
+	mux.HandleFunc("POST /agents", server.createAgent)
+	mux.HandleFunc("GET /agents/{agent}", server.withAgent(server.getAgent))
+	mux.HandleFunc("DELETE /agents/{agent}", server.deleteAgent)
+	mux.HandleFunc("POST /agents/{agent}/messages", server.withAgent(server.postMessage))
+	mux.HandleFunc("POST /agents/{agent}/user-events", server.withAgent(server.postUserEvent))
+	mux.HandleFunc("GET /agents/{agent}/memory", server.withAgent(server.listMemory))
+	mux.HandleFunc("POST /agents/{agent}/memory", server.withAgent(server.addMemoryBlock))
+	mux.HandleFunc("GET /agents/{agent}/memory/{label}", server.withAgent(server.getMemoryBlock))
+	mux.HandleFunc("PUT /agents/{agent}/memory/{label}", server.withAgent(server.setMemoryBlock))
+	mux.HandleFunc("DELETE /agents/{agent}/memory/{label}", server.withAgent(server.removeMemoryBlock))
+	mux.HandleFunc("GET /agents/{agent}/tools", server.withAgent(server.listTools))
+	mux.HandleFunc("GET /agents/{agent}/history", server.withAgent(server.getHistory))
+	mux.HandleFunc("GET /agents/{agent}/events", server.streamEvents)
+	return mux
+}
+
+/*
+Returns the agent with the given ID or name, loading it from the store if it is not loaded yet.
+The agent is loaded without holding the server's lock, so that a slow load does not hold up requests to other agents.
+*/
+func (server *Server) agent(ctx context.Context, idOrName string) (*serverAgent, error) {
+	for {
+		server.mu.Lock()
+		entry := server.loadedAgent(idOrName)
+		deletes := server.deletes
+		server.mu.Unlock()
+		if entry != nil {
+			return entry, nil
+		}
+
+		agent, err := LoadAgent(ctx, server.store, idOrName, server.options.Restore)
+		if err != nil {
+			return nil, err
+		}
+
+		server.mu.Lock()
+		if entry := server.loadedAgent(agent.ID); entry != nil {
+			// another request loaded the agent in the meantime
+			server.mu.Unlock()
+			return entry, nil
+		}
+		if server.deletes != deletes {
+			// the agent may have been deleted after it was loaded
+			server.mu.Unlock()
+			continue
+		}
+		entry = server.newServerAgent(agent)
+		server.agents[agent.ID] = entry
+		server.mu.Unlock()
+		return entry, nil
+	}
+}
+
+/*
+Returns the loaded agent with the given ID or name, or nil. The server's lock must be held.
+*/
+func (server *Server) loadedAgent(idOrName string) *serverAgent {
+	for _, entry := range server.agents {
+		if entry.agent.ID == idOrName || entry.agent.Name == idOrName {
+			return entry
+		}
+	}
+	return nil
+}
+
+/*
+Wraps a handler that works on the agent named in the path, holding the agent for the duration of the request
+*/
+func (server *Server) withAgent(handler func(w http.ResponseWriter, r *http.Request, agent *Agent)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, err := server.agent(r.Context(), r.PathValue("agent"))
+		if err != nil {
+			writeError(w, agentErrorStatus(err), err)
+			return
+		}
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		if entry.deleted {
+			writeError(w, http.StatusNotFound, ErrAgentNotFound)
+			return
+		}
+		handler(w, r, entry.agent)
+	}
+}
+
+/*
+Saves the agent, responding with an error if that fails. Returns whether the agent was saved.
+The agent is saved even if the client has gone away, since its state has already changed.
+*/
+func (server *Server) save(w http.ResponseWriter, r *http.Request, agent *Agent) bool {
+	if err := agent.Save(context.WithoutCancel(r.Context()), server.store); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error saving agent %q: %w", agent.Name, err))
+		return false
+	}
+	return true
+}
+
+/*
+An agent as returned by the API
+*/
+type agentResponse struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	CoreMemory []MemoryBlockState `json:"coreMemory"`
+	Tools      []string           `json:"tools"`
+	Messages   int                `json:"messages"` // the number of messages in recall memory
+}
+
+func newAgentResponse(agent *Agent) agentResponse {
+	response := agentResponse{
+		ID:         agent.ID,
+		Name:       agent.Name,
+		Model:      agent.Model,
+		CoreMemory: agent.CoreMemory.snapshot(),
+		Tools:      make([]string, 0, len(agent.Tools)),
+		Messages:   agent.RecallMemory.Len(),
+	}
+	for _, tool := range agent.Tools {
+		response.Tools = append(response.Tools, tool.Name)
+	}
+	return response
+}
+
+/*
+A block of core memory, as sent to the API
+*/
+type memoryBlockRequest struct {
+	Label       string `json:"label"`
+	Description string `json:"description,omitempty"`
+	Limit       int    `json:"limit,omitempty"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+	Value       string `json:"value"`
+}
+
+func (block memoryBlockRequest) config() MemoryBlockConfig {
+	return MemoryBlockConfig{Label: block.Label, Description: block.Description, Limit: block.Limit, ReadOnly: block.ReadOnly, Value: block.Value}
+}
+
+type createAgentRequest struct {
+	Name    string               `json:"name"`
+	Model   string               `json:"model,omitempty"`
+	Persona string               `json:"persona,omitempty"`
+	Human   string               `json:"human,omitempty"`  // the initial contents of the User block
+	Blocks  []memoryBlockRequest `json:"blocks,omitempty"` // additional blocks of core memory
+}
+
+func (server *Server) listAgents(w http.ResponseWriter, r *http.Request) {
+	summaries, err := server.store.List(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func (server *Server) createAgent(w http.ResponseWriter, r *http.Request) {
+	var request createAgentRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.Name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the agent must have a name"))
+		return
+	}
+	if request.Model == "" {
+		request.Model = server.options.Model
+	}
+	if request.Persona == "" {
+		request.Persona = server.options.Persona
+	}
+
+	// reserving the name, so that the store is read and written without holding the server's lock
+	server.mu.Lock()
+	if server.creating[request.Name] || server.loadedAgent(request.Name) != nil {
+		server.mu.Unlock()
+		writeError(w, http.StatusConflict, fmt.Errorf("an agent named %q already exists", request.Name))
+		return
+	}
+	server.creating[request.Name] = true
+	server.mu.Unlock()
+	defer func() {
+		server.mu.Lock()
+		delete(server.creating, request.Name)
+		server.mu.Unlock()
+	}()
+
+	if _, err := server.store.Load(r.Context(), request.Name); err == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("an agent named %q already exists", request.Name))
+		return
+	} else if !errors.Is(err, ErrAgentNotFound) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	agent := NewAgentWithProvider(request.Model, request.Persona, request.Name, server.options.Restore.Provider)
+	agent.ApiKey = server.options.Restore.ApiKey
+	agent.Output = server.options.Restore.Output
+	if request.Human != "" {
+		if err := agent.CoreMemory.SetBlockValue("User", request.Human); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	for _, block := range request.Blocks {
+		if err := agent.AddMemoryBlock(block.config()); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if !server.save(w, r, agent) {
+		return
+	}
+	server.mu.Lock()
+	// a request for the new agent may have loaded it from the store in the meantime
+	if server.loadedAgent(agent.ID) == nil {
+		server.agents[agent.ID] = server.newServerAgent(agent)
+	}
+	server.mu.Unlock()
+	writeJSON(w, http.StatusCreated, newAgentResponse(agent))
+}
+
+func (server *Server) getAgent(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	writeJSON(w, http.StatusOK, newAgentResponse(agent))
+}
+
+func (server *Server) deleteAgent(w http.ResponseWriter, r *http.Request) {
+	entry, err := server.agent(r.Context(), r.PathValue("agent"))
+	if err != nil {
+		writeError(w, agentErrorStatus(err), err)
+		return
+	}
+	// waiting for any request in progress; requests still waiting for the agent see that it was deleted and do not save it again
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.deleted {
+		writeError(w, http.StatusNotFound, ErrAgentNotFound)
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if err := server.store.Delete(r.Context(), entry.agent.ID); err != nil && !errors.Is(err, ErrAgentNotFound) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	entry.deleted = true
+	server.deletes++
+	delete(server.agents, entry.agent.ID)
+	if server.options.Scheduler != nil {
+		server.options.Scheduler.Remove(entry.agent.ID)
+	}
+	if server.options.Agents != nil {
+		server.options.Agents.Unregister(entry.agent.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type messageRequest struct {
+	Message  string `json:"message"`
+	MaxSteps int    `json:"maxSteps,omitempty"` // may lower the server's limit on the number of steps
+}
+
+/*
+The outcome of a run started by a message or an event
+*/
+type runResponse struct {
+	Status     string         `json:"status"` // one of the RUN_STATUS_* constants
+	Steps      int            `json:"steps"`
+	StopReason string         `json:"stopReason,omitempty"`
+	Messages   []AgentMessage `json:"messages"` // the messages the agent sent to the user with sendMessage
+	Error      string         `json:"error,omitempty"`
+}
+
+func (server *Server) postMessage(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	var request messageRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.Message == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the message must not be empty"))
+		return
+	}
+	server.runEvent(w, r, agent, UserMessage{Text: request.Message}, request.MaxSteps)
+}
+
+/*
+The body of a request to send an event: a JSON object with the "type" of the event and its fields, as accepted by ParseUserEvent
+*/
+type userEventRequest struct {
+	MaxSteps int `json:"maxSteps,omitempty"` // may lower the server's limit on the number of steps
+}
+
+func (server *Server) postUserEvent(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	var data json.RawMessage
+	if !readJSON(w, r, &data) {
+		return
+	}
+	var request userEventRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	event, err := ParseUserEvent(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	server.runEvent(w, r, agent, event, request.MaxSteps)
+}
+
+/*
+Runs the agent in response to an event, responding with the outcome of the run
+*/
+func (server *Server) runEvent(w http.ResponseWriter, r *http.Request, agent *Agent, event UserEvent, maxSteps int) {
+	options := server.options.RunOptions
+	if maxSteps > 0 && maxSteps < options.MaxSteps {
+		options.MaxSteps = maxSteps
+	}
+
+	// collecting the messages sent during this run, while still delivering them to the configured Output
+	messages := make([]AgentMessage, 0)
+	var output OutputSink = SinkFunc(func(ctx context.Context, message AgentMessage) error {
+		messages = append(messages, message)
+		return nil
+	})
+	if server.options.Restore.Output != nil {
+		output = MultiSink{output, server.options.Restore.Output}
+	}
+	agent.Output = output
+	defer func() { agent.Output = server.options.Restore.Output }()
+
+	result, runErr := agent.HandleEvent(r.Context(), event, options)
+	if !server.save(w, r, agent) {
+		return
+	}
+
+	response := runResponse{Status: result.Status, Steps: result.Steps, StopReason: result.StopReason, Messages: messages}
+	status := http.StatusOK
+	if runErr != nil {
+		response.Error = runErr.Error()
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, response)
+}
+
+func (server *Server) listMemory(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	writeJSON(w, http.StatusOK, agent.CoreMemory.snapshot())
+}
+
+func (server *Server) addMemoryBlock(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	var request memoryBlockRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if _, ok := agent.CoreMemory.Blocks[request.Label]; ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("section \"%s\" already exists in core memory", request.Label))
+		return
+	}
+	if err := agent.AddMemoryBlock(request.config()); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if server.save(w, r, agent) {
+		writeJSON(w, http.StatusCreated, memoryBlockState(agent, request.Label))
+	}
+}
+
+func (server *Server) getMemoryBlock(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	label := r.PathValue("label")
+	if _, ok := agent.CoreMemory.Blocks[label]; !ok {
+		writeError(w, http.StatusNotFound, agent.CoreMemory.unknownSectionError(label))
+		return
+	}
+	writeJSON(w, http.StatusOK, memoryBlockState(agent, label))
+}
+
+func (server *Server) setMemoryBlock(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	var request struct {
+		Value string `json:"value"`
+	}
+	if !readJSON(w, r, &request) {
+		return
+	}
+	label := r.PathValue("label")
+	if _, ok := agent.CoreMemory.Blocks[label]; !ok {
+		writeError(w, http.StatusNotFound, agent.CoreMemory.unknownSectionError(label))
+		return
+	}
+	if err := agent.CoreMemory.SetBlockValue(label, request.Value); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if server.save(w, r, agent) {
+		writeJSON(w, http.StatusOK, memoryBlockState(agent, label))
+	}
+}
+
+func (server *Server) removeMemoryBlock(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	label := r.PathValue("label")
+	if err := agent.RemoveMemoryBlock(label); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if server.save(w, r, agent) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/*
+Returns the state of a single block of the agent's core memory
+*/
+func memoryBlockState(agent *Agent, label string) MemoryBlockState {
+	for _, block := range agent.CoreMemory.snapshot() {
+		if block.Label == label {
+			return block
+		}
+	}
+	return MemoryBlockState{}
+}
+
+func (server *Server) listTools(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	writeJSON(w, http.StatusOK, agent.Tools)
+}
+
+type historyResponse struct {
+	Entries  []RecallEntry `json:"entries"`
+	Total    int           `json:"total"`
+	Page     int           `json:"page"`
+	PageSize int           `json:"pageSize"`
+	Pages    int           `json:"pages"`
+}
+
+/*
+Responds with a page of the agent's complete chat history, as kept in recall memory, oldest first.
+Pages start at 0.
+*/
+func (server *Server) getHistory(w http.ResponseWriter, r *http.Request, agent *Agent) {
+	page, err := queryInt(r, "page", 0)
+	if err != nil || page < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("page must be a number from 0"))
+		return
+	}
+	pageSize, err := queryInt(r, "pageSize", DEFAULT_HISTORY_PAGE_SIZE)
+	if err != nil || pageSize < 1 || pageSize > MAX_HISTORY_PAGE_SIZE {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("pageSize must be a number from 1 to %d", MAX_HISTORY_PAGE_SIZE))
+		return
+	}
+
+	entries := agent.RecallMemory.Entries()
+	writeJSON(w, http.StatusOK, historyResponse{
+		Entries:  paginate(entries, page, pageSize),
+		Total:    len(entries),
+		Page:     page,
+		PageSize: pageSize,
+		Pages:    pageCount(len(entries), pageSize),
+	})
+}
+
+/*
+Streams the agent's events as server-sent events, each with its ID, its type as the event name and the AgentEvent as JSON data.
+A new client is first sent the recent events that are still kept.
+A client that reconnects with the Last-Event-ID header (or a cursor query parameter holding the last ID it received) is sent the events it missed first;
+if some of those events are no longer kept, a "gap" event reports how many were lost.
+*/
+func (server *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	entry, err := server.agent(r.Context(), r.PathValue("agent"))
+	if err != nil {
+		writeError(w, agentErrorStatus(err), err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	cursorValue := r.Header.Get("Last-Event-ID")
+	if cursorValue == "" {
+		cursorValue = r.URL.Query().Get("cursor")
+	}
+	// new clients are sent the events that are still kept
+	cursor := entry.events.OldestCursor()
+	if cursorValue != "" {
+		if cursor, err = strconv.ParseInt(cursorValue, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid event cursor %q", cursorValue))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		changed := entry.events.Changed()
+		events, missed := entry.events.Since(cursor)
+		if missed > 0 {
+			fmt.Fprintf(w, "event: gap\ndata: {\"missed\":%d}\n\n", missed)
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			cursor = event.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-server.closing:
+			return
+		}
+	}
+}
+
+/*
+Returns the integer value of a query parameter, or the fallback if it is not set
+*/
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+/*
+Decodes the JSON body of the request, responding with an error if it is invalid. Returns whether the body was decoded.
+*/
+func readJSON(w http.ResponseWriter, r *http.Request, value any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY_BYTES)
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+/*
+Returns the status code to respond with for an error returned while looking up an agent
+*/
+func agentErrorStatus(err error) int {
+	if errors.Is(err, ErrAgentNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+A Provider whose requests wait until they are released, so that tests can act while a run is in progress
+*/
+type blockingProvider struct {
+	fakeProvider
+	started chan struct{} // receives a value when a request starts
+	release chan struct{} // requests return once it is closed
+}
+
+func (provider *blockingProvider) Complete(ctx context.Context, reqData AgentRequest) (*AgentResponse, int, error) {
+	provider.started <- struct{}{}
+	<-provider.release
+	return provider.fakeProvider.Complete(ctx, reqData)
+}
+
+func (provider *blockingProvider) Stream(ctx context.Context, reqData AgentRequest, handler StreamHandler) (*AgentResponse, int, error) {
+	return provider.Complete(ctx, reqData)
+}
+
+/*
+Sends a request to the handler and returns the status code of the response
+*/
+func serve(handler http.Handler, method string, path string, body string) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder.Code
+}
+
+/*
+Sends a request to the handler, decodes the JSON response into value and returns the status code of the response
+*/
+func serveJSON(t *testing.T, handler http.Handler, method string, path string, body string, value any) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if err := json.Unmarshal(recorder.Body.Bytes(), value); err != nil {
+		t.Fatalf("%s %s responded with invalid JSON %q: %v", method, path, recorder.Body.String(), err)
+	}
+	return recorder.Code
+}
+
+func TestServerAPI(t *testing.T) {
+	store, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeProvider{responses: []AgentResponse{toolUseResponse("call_1", "sendMessage", map[string]any{"message": "Hi Sam!"})}}
+	delivered := make([]AgentMessage, 0)
+	output := SinkFunc(func(ctx context.Context, message AgentMessage) error {
+		delivered = append(delivered, message)
+		return nil
+	})
+	server := NewServer(store, ServerOptions{Restore: RestoreOptions{Provider: provider, Output: output}, Model: "test-model", RunOptions: DefaultRunOptions()})
+	handler := server.Handler()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/agents", `{"name": "sam", "human": "Name: Sam", "blocks": [{"label": "Project", "limit": 100, "value": "A garden"}]}`, http.StatusCreated},
+		{"POST", "/agents", `{"name": "sam"}`, http.StatusConflict},
+		{"POST", "/agents", `{"model": "test-model"}`, http.StatusBadRequest},
+		{"POST", "/agents", `{"name": `, http.StatusBadRequest},
+		{"GET", "/agents/sam", "", http.StatusOK},
+		{"GET", "/agents/alex", "", http.StatusNotFound},
+		{"POST", "/agents/sam/messages", `{"message": ""}`, http.StatusBadRequest},
+		{"GET", "/agents/sam/memory/Diary", "", http.StatusNotFound},
+		{"PUT", "/agents/sam/memory/Project", `{"value": "A vegetable garden"}`, http.StatusOK},
+		{"PUT", "/agents/sam/memory/Project", `{"value": "` + strings.Repeat("a", 101) + `"}`, http.StatusBadRequest},
+		{"POST", "/agents/sam/memory", `{"label": "Project", "value": ""}`, http.StatusConflict},
+		{"POST", "/agents/sam/memory", `{"label": "Diary", "value": "Dear diary"}`, http.StatusCreated},
+		{"DELETE", "/agents/sam/memory/Diary", "", http.StatusNoContent},
+		{"DELETE", "/agents/sam/memory/Diary", "", http.StatusNotFound},
+		{"GET", "/agents/sam/history?page=-1", "", http.StatusBadRequest},
+		{"GET", "/agents/sam/history?pageSize=0", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if status := serve(handler, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s returned status %d, want %d", test.method, test.path, status, test.status)
+		}
+	}
+
+	var run runResponse
+	if status := serveJSON(t, handler, "POST", "/agents/sam/messages", `{"message": "Hello"}`, &run); status != http.StatusOK {
+		t.Fatalf("sending a message returned status %d: %+v", status, run)
+	}
+	if run.Status != RUN_STATUS_COMPLETED || len(run.Messages) != 1 || run.Messages[0].Text != "Hi Sam!" {
+		t.Errorf("the run returned %+v, want the message \"Hi Sam!\"", run)
+	}
+	// the messages are still delivered to the server's Output
+	if len(delivered) != 1 {
+		t.Errorf("%d messages were delivered to the server's Output, want 1", len(delivered))
+	}
+
+	var block MemoryBlockState
+	if status := serveJSON(t, handler, "GET", "/agents/sam/memory/Project", "", &block); status != http.StatusOK || block.Data != "A vegetable garden" {
+		t.Errorf("getting the Project block returned status %d and %+v", status, block)
+	}
+	var history historyResponse
+	if status := serveJSON(t, handler, "GET", "/agents/sam/history?pageSize=2&page=1", "", &history); status != http.StatusOK || len(history.Entries) != 2 || history.Total != 4 || history.Pages != 2 {
+		t.Errorf("getting the history returned status %d and %+v, want the second page of 2 of 4 messages", status, history)
+	}
+
+	// every change was saved
+	state, err := store.Load(context.Background(), "sam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.RecallMemory) != 4 {
+		t.Errorf("the saved agent has %d messages in recall memory, want 4", len(state.RecallMemory))
+	}
+	for _, block := range state.CoreMemory {
+		if (block.Label == "Project" && block.Data != "A vegetable garden") || (block.Label == "User" && block.Data != "Name: Sam") || block.Label == "Diary" {
+			t.Errorf("the saved agent has the block %+v", block)
+		}
+	}
+
+	var summaries []AgentSummary
+	if status := serveJSON(t, handler, "GET", "/agents", "", &summaries); status != http.StatusOK || len(summaries) != 1 || summaries[0].Name != "sam" {
+		t.Errorf("listing the agents returned status %d and %+v", status, summaries)
+	}
+	if status := serve(handler, "DELETE", "/agents/sam", ""); status != http.StatusNoContent {
+		t.Errorf("deleting the agent returned status %d", status)
+	}
+	if status := serve(handler, "GET", "/agents/sam", ""); status != http.StatusNotFound {
+		t.Errorf("getting the deleted agent returned status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestServerDeleteAgentInUse(t *testing.T) {
+	provider := &blockingProvider{started: make(chan struct{}, 4), release: make(chan struct{})}
+	store, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(store, ServerOptions{Restore: RestoreOptions{Provider: provider, Output: SinkFunc(func(ctx context.Context, message AgentMessage) error { return nil })}, Model: "test-model"})
+	handler := server.Handler()
+
+	if status := serve(handler, "POST", "/agents", `{"name": "sam"}`); status != http.StatusCreated {
+		t.Fatalf("creating the agent returned status %d", status)
+	}
+
+	// a message that is being handled while the agent is deleted, and one that waits for the agent
+	statuses := make(chan int, 2)
+	go func() { statuses <- serve(handler, "POST", "/agents/sam/messages", `{"message": "Hello"}`) }()
+	<-provider.started
+	deleted := make(chan int)
+	go func() { deleted <- serve(handler, "DELETE", "/agents/sam", "") }()
+	go func() { statuses <- serve(handler, "POST", "/agents/sam/messages", `{"message": "Are you there?"}`) }()
+	close(provider.release)
+
+	if status := <-deleted; status != http.StatusNoContent {
+		t.Errorf("deleting the agent returned status %d, want %d", status, http.StatusNoContent)
+	}
+	for range 2 {
+		if status := <-statuses; status != http.StatusOK && status != http.StatusNotFound {
+			t.Errorf("a message to the agent returned status %d", status)
+		}
+	}
+
+	if _, err := store.Load(context.Background(), "sam"); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("the deleted agent was saved again: Load returned %v", err)
+	}
+	if status := serve(handler, "GET", "/agents/sam", ""); status != http.StatusNotFound {
+		t.Errorf("getting the deleted agent returned status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestServerLoadsAgentsOnce(t *testing.T) {
+	store, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.Name = "sam"
+	if err := agent.Save(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(store, ServerOptions{Restore: RestoreOptions{Provider: &fakeProvider{}}})
+
+	entries := make(chan *serverAgent, 8)
+	for range cap(entries) {
+		go func() {
+			entry, err := server.agent(context.Background(), "sam")
+			if err != nil {
+				t.Error(err)
+			}
+			entries <- entry
+		}()
+	}
+	first := <-entries
+	for range cap(entries) - 1 {
+		if entry := <-entries; entry != first {
+			t.Fatalf("concurrent requests loaded the agent more than once")
+		}
+	}
+}
+
+/*
+A store whose saves wait until they are released, so that tests can act while an agent is being saved
+*/
+type blockingStore struct {
+	AgentStore
+	started chan struct{} // receives a value when a save starts
+	release chan struct{} // saves proceed once it is closed
+}
+
+func (store *blockingStore) Save(ctx context.Context, state AgentState) error {
+	store.started <- struct{}{}
+	<-store.release
+	return store.AgentStore.Save(ctx, state)
+}
+
+func TestServerCreateAgentDoesNotBlockOthers(t *testing.T) {
+	jsonStore, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.Name = "sam"
+	if err := agent.Save(context.Background(), jsonStore); err != nil {
+		t.Fatal(err)
+	}
+	store := &blockingStore{AgentStore: jsonStore, started: make(chan struct{}, 1), release: make(chan struct{})}
+	server := NewServer(store, ServerOptions{Restore: RestoreOptions{Provider: &fakeProvider{}}, Model: "test-model"})
+	handler := server.Handler()
+
+	created := make(chan int)
+	go func() { created <- serve(handler, "POST", "/agents", `{"name": "alex"}`) }()
+	<-store.started
+
+	// while the new agent is being saved, other agents can be used and its name stays taken
+	if status := serve(handler, "GET", "/agents/sam", ""); status != http.StatusOK {
+		t.Errorf("getting another agent during the creation returned status %d, want %d", status, http.StatusOK)
+	}
+	if status := serve(handler, "POST", "/agents", `{"name": "alex"}`); status != http.StatusConflict {
+		t.Errorf("creating a second agent with the same name returned status %d, want %d", status, http.StatusConflict)
+	}
+
+	close(store.release)
+	if status := <-created; status != http.StatusCreated {
+		t.Errorf("creating the agent returned status %d, want %d", status, http.StatusCreated)
+	}
+	if status := serve(handler, "POST", "/agents", `{"name": "alex"}`); status != http.StatusConflict {
+		t.Errorf("creating an agent with the name of a created agent returned status %d, want %d", status, http.StatusConflict)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Statistics section of core memory: an overview of what is stored in recall and archival memory,
+which the Agent uses to decide when it is worth searching its out of context memory
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Label of the read-only core memory block that holds the memory statistics
+const STATISTICS_BLOCK_LABEL string = "Statistics"
+
+// Number of archival memory tags listed in the statistics
+const STATISTICS_TOP_TAGS int = 5
+
+/*
+Adds the read-only Statistics block to core memory, if it is not there yet
+*/
+func (llm *Agent) addStatisticsBlock() {
+	if _, ok := llm.CoreMemory.Blocks[STATISTICS_BLOCK_LABEL]; ok {
+		return
+	}
+	llm.CoreMemory.AddBlock(MemoryBlockConfig{
+		Label: STATISTICS_BLOCK_LABEL,
+		Description: "An automatically maintained overview of your out of context memory. " +
+			"Use it to decide whether searching recall memory (conversationSearch) or archival memory (archivalMemorySearch) is likely to find something.",
+		ReadOnly: true,
+	})
+	llm.CoreMemory.Blocks[STATISTICS_BLOCK_LABEL].sectionName = "memory_statistics"
+	llm.updateMemoryStatistics(llm.now())
+}
+
+/*
+Brings the Statistics block up to date with the current contents of recall and archival memory.
+Does nothing if the Agent has no Statistics block.
+*/
+func (llm *Agent) updateMemoryStatistics(now time.Time) {
+	if _, ok := llm.CoreMemory.Blocks[STATISTICS_BLOCK_LABEL]; !ok {
+		return
+	}
+
+	var recall RecallStats
+	if llm.RecallMemory != nil {
+		recall = llm.RecallMemory.Stats()
+	}
+	var archival ArchivalStats
+	if llm.ArchivalMemory != nil {
+		archival = llm.ArchivalMemory.Stats()
+	}
+
+	// not recorded in the edit log, since the block is rewritten before every request;
+	// last_edited only changes with the text, so that it tells the Agent when the statistics last changed
+	block := llm.CoreMemory.Blocks[STATISTICS_BLOCK_LABEL]
+	if text := formatMemoryStatistics(recall, archival, min(llm.recallOutOfContext, recall.Messages), now); text != block.data {
+		block.setData(text, now)
+	}
+}
+
+func formatMemoryStatistics(recall RecallStats, archival ArchivalStats, outOfContext int, now time.Time) string {
+	var builder strings.Builder
+
+	if recall.Messages == 0 {
+		builder.WriteString("Recall memory: no messages yet.\n")
+	} else {
+		builder.WriteString(fmt.Sprintf("Recall memory: %d messages (%d written by the user, %d by you) from %s to %s.",
+			recall.Messages, recall.UserMessages, recall.MessagesByRole["assistant"],
+			recall.First.Format(time.DateOnly), recall.Last.Format(time.DateOnly)))
+		if outOfContext > 0 {
+			builder.WriteString(fmt.Sprintf(" %d of them are no longer in your context window.", outOfContext))
+		}
+		builder.WriteString("\n")
+	}
+
+	if archival.Passages == 0 {
+		builder.WriteString("Archival memory: no passages yet.\n")
+	} else {
+		builder.WriteString(fmt.Sprintf("Archival memory: %d passages inserted from %s to %s.",
+			archival.Passages, archival.First.Format(time.DateOnly), archival.Last.Format(time.DateOnly)))
+		if len(archival.Tags) > 0 {
+			tags := make([]string, 0, STATISTICS_TOP_TAGS)
+			for _, tag := range archival.Tags[:min(len(archival.Tags), STATISTICS_TOP_TAGS)] {
+				tags = append(tags, fmt.Sprintf("%s (%d)", tag.Tag, tag.Count))
+			}
+			builder.WriteString(fmt.Sprintf(" Most common tags: %s.", strings.Join(tags, ", ")))
+		}
+		builder.WriteString("\n")
+	}
+
+	if recall.LastUserMessage.IsZero() {
+		builder.WriteString("The user has not sent a message yet.")
+	} else {
+		builder.WriteString(fmt.Sprintf("Last message from the user: %s (%s).",
+			formatElapsed(now.Sub(recall.LastUserMessage)), recall.LastUserMessage.Format("2006-01-02 15:04")))
+	}
+	return builder.String()
+}
+
+/*
+Describes how long ago something happened, e.g. "3 hours ago"
+*/
+func formatElapsed(elapsed time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return plural(int(elapsed/time.Minute), "minute")
+	case elapsed < 48*time.Hour:
+		return plural(int(elapsed/time.Hour), "hour")
+	default:
+		return plural(int(elapsed/(24*time.Hour)), "day")
+	}
+}
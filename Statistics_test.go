@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatMemoryStatistics(t *testing.T) {
+	now := time.Date(2026, 10, 18, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		recall       RecallStats
+		archival     ArchivalStats
+		outOfContext int
+		want         string
+	}{
+		{
+			name: "empty",
+			want: "Recall memory: no messages yet.\nArchival memory: no passages yet.\nThe user has not sent a message yet.",
+		},
+		{
+			name: "everything in context",
+			recall: RecallStats{
+				Messages: 4, MessagesByRole: map[string]int{"user": 2, "assistant": 2}, UserMessages: 1,
+				First: now.Add(-time.Hour), Last: now, LastUserMessage: now.Add(-30 * time.Second),
+			},
+			want: "Recall memory: 4 messages (1 written by the user, 2 by you) from 2026-10-18 to 2026-10-18.\n" +
+				"Archival memory: no passages yet.\n" +
+				"Last message from the user: just now (2026-10-18 15:29).",
+		},
+		{
+			name: "messages out of context and tags",
+			recall: RecallStats{
+				Messages: 40, MessagesByRole: map[string]int{"user": 22, "assistant": 18}, UserMessages: 15,
+				First: now.AddDate(0, 0, -3), Last: now, LastUserMessage: now.Add(-3 * time.Hour),
+			},
+			archival: ArchivalStats{
+				Passages: 9,
+				Tags:     []TagCount{{"pets", 4}, {"food", 3}, {"work", 2}, {"a", 1}, {"b", 1}, {"c", 1}},
+				First:    now.AddDate(0, 0, -2), Last: now.AddDate(0, 0, -1),
+			},
+			outOfContext: 12,
+			want: "Recall memory: 40 messages (15 written by the user, 18 by you) from 2026-10-15 to 2026-10-18. 12 of them are no longer in your context window.\n" +
+				"Archival memory: 9 passages inserted from 2026-10-16 to 2026-10-17. Most common tags: pets (4), food (3), work (2), a (1), b (1).\n" +
+				"Last message from the user: 3 hours ago (2026-10-18 12:30).",
+		},
+		{
+			name: "passages without tags and no message from the user",
+			recall: RecallStats{
+				Messages: 2, MessagesByRole: map[string]int{"user": 1, "assistant": 1},
+				First: now.AddDate(0, 0, -10), Last: now.AddDate(0, 0, -10),
+			},
+			archival:     ArchivalStats{Passages: 1, Tags: []TagCount{}, First: now, Last: now},
+			outOfContext: 2,
+			want: "Recall memory: 2 messages (0 written by the user, 1 by you) from 2026-10-08 to 2026-10-08. 2 of them are no longer in your context window.\n" +
+				"Archival memory: 1 passages inserted from 2026-10-18 to 2026-10-18.\n" +
+				"The user has not sent a message yet.",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatMemoryStatistics(test.recall, test.archival, test.outOfContext, now); got != test.want {
+				t.Errorf("formatMemoryStatistics =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	tests := map[time.Duration]string{
+		59 * time.Second:    "just now",
+		time.Minute:         "1 minute ago",
+		59 * time.Minute:    "59 minutes ago",
+		time.Hour:           "1 hour ago",
+		47 * time.Hour:      "47 hours ago",
+		48 * time.Hour:      "2 days ago",
+		30 * 24 * time.Hour: "30 days ago",
+	}
+	for elapsed, want := range tests {
+		if got := formatElapsed(elapsed); got != want {
+			t.Errorf("formatElapsed(%s) = %q, want %q", elapsed, got, want)
+		}
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	start := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	recall := NewRecallMemory()
+	for i, message := range []Message{
+		{Role: "user", Content: []Content{{Type: "text", Text: "Hi!"}}},
+		{Role: "assistant", Content: []Content{{Type: "text", Text: "Hello."}}},
+		{Role: "user", Content: []Content{{Type: "tool_result", ToolUseID: "call_1", Content: "ok"}}},
+		{Role: "user", Content: []Content{{Type: "text", Text: "[heartbeat] Continue."}}},
+		{Role: "user", Content: []Content{{Type: "text", Text: "How are you?"}}},
+		{Role: "user", Content: []Content{{Type: "text", Text: "[system] Memory pressure warning."}}},
+	} {
+		recall.Insert(message, start.Add(time.Duration(i)*time.Minute))
+	}
+	want := RecallStats{
+		Messages: 6, MessagesByRole: map[string]int{"user": 5, "assistant": 1}, UserMessages: 2,
+		First: start, Last: start.Add(5 * time.Minute), LastUserMessage: start.Add(4 * time.Minute),
+	}
+	if got := recall.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RecallMemory.Stats = %+v, want %+v", got, want)
+	}
+
+	archival := NewArchivalMemory()
+	for i, tags := range [][]string{{"pets"}, {"food", "pets"}, {"Work"}, nil, {"food", "pets"}} {
+		if _, err := archival.Insert(context.Background(), "A passage.", tags, start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantArchival := ArchivalStats{
+		Passages: 5, Tags: []TagCount{{"pets", 3}, {"food", 2}, {"work", 1}},
+		First: start, Last: start.Add(4 * time.Hour),
+	}
+	if got := archival.Stats(); !reflect.DeepEqual(got, wantArchival) {
+		t.Errorf("ArchivalMemory.Stats = %+v, want %+v", got, wantArchival)
+	}
+}
+
+func TestRecallOutOfContext(t *testing.T) {
+	ctx := context.Background()
+	agent, _ := newTestAgent(&fakeProvider{})
+	respond := func(text string) {
+		agent.addResponseToChatHistory(AgentResponse{Role: "assistant", Content: []Content{{Type: "text", Text: text}}})
+	}
+	// content merged into a user message is stored in recall memory as an entry of its own
+	agent.AddUserMessage("Hello")
+	if err := agent.AddEvent(UserLogin{}); err != nil {
+		t.Fatal(err)
+	}
+	respond("Hi!")
+	agent.AddUserMessage("How are you?")
+	respond("Well, thanks.")
+	agent.AddUserMessage("And now?")
+	agent.addContextWarningToChatHistory(0.8)
+
+	// removing every message up to the last assistant message
+	options := DefaultRunOptions()
+	if err := agent.flushMemory(ctx, options, 1000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.ChatHistory) != 3 {
+		t.Fatalf("the flushed chat history has %d messages, want the summary and the last 2", len(agent.ChatHistory))
+	}
+	if agent.recallOutOfContext != 4 {
+		t.Errorf("%d recall entries are out of context after the first flush, want 4", agent.recallOutOfContext)
+	}
+
+	respond("Still here.")
+	agent.AddUserMessage("Good.")
+	if err := agent.flushMemory(ctx, options, 1000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if agent.recallOutOfContext != 7 {
+		t.Errorf("%d recall entries are out of context after the second flush, want 7", agent.recallOutOfContext)
+	}
+
+	agent.updateMemoryStatistics(agent.now())
+	if text := agent.CoreMemory.Blocks[STATISTICS_BLOCK_LABEL].Value(); !strings.Contains(text, "Recall memory: 9 messages") || !strings.Contains(text, "7 of them are no longer in your context window") {
+		t.Errorf("the statistics are\n%s\nwant 7 of 9 messages out of context", text)
+	}
+
+	restored, err := RestoreAgent(ctx, agent.Snapshot(), RestoreOptions{Provider: &fakeProvider{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.recallOutOfContext != 7 {
+		t.Errorf("the restored agent has %d recall entries out of context, want 7", restored.recallOutOfContext)
+	}
+}
+
+func TestStatisticsLastEdited(t *testing.T) {
+	clock := NewManualClock(time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.Clock = clock
+	block := agent.CoreMemory.Blocks[STATISTICS_BLOCK_LABEL]
+	edited := block.LastEdited()
+
+	// nothing changed, so the statistics were not edited
+	clock.Advance(time.Hour)
+	agent.updateMemoryStatistics(clock.Now())
+	if !block.LastEdited().Equal(edited) {
+		t.Errorf("unchanged statistics were last edited at %v, want %v", block.LastEdited(), edited)
+	}
+
+	if _, err := agent.archivalInsert(context.Background(), "Sam has a cat.", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	agent.updateMemoryStatistics(clock.Now())
+	if !block.LastEdited().Equal(clock.Now()) {
+		t.Errorf("changed statistics were last edited at %v, want %v", block.LastEdited(), clock.Now())
+	}
+}
@@ -0,0 +1,363 @@
+/*
+Persistence of Agents, so that an Agent and its memory outlive the process that created it
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Returned by an AgentStore when no saved Agent has the requested name or ID
+*/
+var ErrAgentNotFound = errors.New("agent not found")
+
+/*
+Storage for the state of Agents.
+Agents are identified by their ID; names must also be unique within a store, so that an Agent can be loaded by either.
+*/
+type AgentStore interface {
+	// Creates or updates the saved state of the Agent with the same ID
+	Save(ctx context.Context, state AgentState) error
+	// Returns the saved state of the Agent with the given ID or name, or ErrAgentNotFound
+	Load(ctx context.Context, idOrName string) (*AgentState, error)
+	// Returns an overview of every saved Agent, sorted by name
+	List(ctx context.Context) ([]AgentSummary, error)
+	// Removes the saved state of the Agent with the given ID or name, or returns ErrAgentNotFound
+	Delete(ctx context.Context, idOrName string) error
+	// Releases any resources held by the store
+	Close() error
+}
+
+/*
+The saved state of a single core memory block
+*/
+type MemoryBlockState struct {
+	Label       string    `json:"label"` // the key of the block in CoreMemory.Blocks, e.g. "User"
+	SectionName string    `json:"sectionName"`
+	Data        string    `json:"data"`
+	Limit       int       `json:"limit,omitempty"`
+	ReadOnly    bool      `json:"readOnly,omitempty"`
+	Description string    `json:"description,omitempty"`
+	LastEdited  time.Time `json:"lastEdited"`
+}
+
+/*
+A passage of archival memory along with its embedding, if one was computed
+*/
+type ArchivalRecord struct {
+	Passage
+	Vector []float32 `json:"vector,omitempty"`
+}
+
+/*
+Everything needed to recreate an Agent.
+Secrets (API keys) and Go values that cannot be serialized (the Provider, tool functions, the Embedder) are not included;
+they are supplied again through RestoreOptions when the Agent is restored.
+*/
+type AgentState struct {
+	ID             string             `json:"id"`
+	Name           string             `json:"name"`
+	Model          string             `json:"model"`
+	System         []Content          `json:"system"`
+	CoreMemory     []MemoryBlockState `json:"coreMemory"`
+	ChatHistory    []Message          `json:"chatHistory"`
+	RecallMemory   []RecallEntry      `json:"recallMemory"`
+	ArchivalMemory []ArchivalRecord   `json:"archivalMemory"`
+	MemoryEdits    []MemoryEdit       `json:"memoryEdits"`
+	Tools          []string           `json:"tools"` // the names of the Agent's tools, in order
+	// How the Agent's context window is managed, and whether the Agent was warned that it is filling up since the last flush
+	ContextWindow       ContextWindowOptions `json:"contextWindow"`
+	ContextWarningGiven bool                 `json:"contextWarningGiven,omitempty"`
+	// The number of recall memory entries whose messages have been removed from the chat history
+	RecallOutOfContext int       `json:"recallOutOfContext"`
+	CreatedAt          time.Time `json:"createdAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+}
+
+/*
+A brief description of a saved Agent, as returned by AgentStore.List
+*/
+type AgentSummary struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (state AgentState) summary() AgentSummary {
+	return AgentSummary{ID: state.ID, Name: state.Name, Model: state.Model, CreatedAt: state.CreatedAt, UpdatedAt: state.UpdatedAt}
+}
+
+/*
+Generates a random ID for a new Agent
+*/
+func newAgentID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return "agent-" + hex.EncodeToString(bytes)
+}
+
+/*
+Captures the current state of the Agent so that it can be saved to an AgentStore
+*/
+func (llm *Agent) Snapshot() AgentState {
+	if llm.ID == "" {
+		llm.ID = newAgentID()
+	}
+
+	state := AgentState{
+		ID:          llm.ID,
+		Name:        llm.Name,
+		Model:       llm.Model,
+		System:      append([]Content(nil), llm.System...),
+		CoreMemory:  llm.CoreMemory.snapshot(),
+		MemoryEdits: llm.CoreMemory.EditLog(""),
+		ChatHistory: append([]Message(nil), llm.ChatHistory...),
+		Tools:       make([]string, 0, len(llm.Tools)),
+
+		ContextWindow:       llm.ContextWindow,
+		ContextWarningGiven: llm.contextWarningGiven,
+		RecallOutOfContext:  llm.recallOutOfContext,
+	}
+	if llm.RecallMemory != nil {
+		state.RecallMemory = llm.RecallMemory.Entries()
+	}
+	if llm.ArchivalMemory != nil {
+		state.ArchivalMemory = llm.ArchivalMemory.records()
+	}
+	for _, tool := range llm.Tools {
+		if agentMessagingTools[tool.Name] {
+			continue
+		}
+		state.Tools = append(state.Tools, tool.Name)
+	}
+	return state
+}
+
+/*
+Saves the current state of the Agent to the store
+*/
+func (llm *Agent) Save(ctx context.Context, store AgentStore) error {
+	return store.Save(ctx, llm.Snapshot())
+}
+
+/*
+Returns the state of the core memory blocks, sorted by label
+*/
+func (coreMemory CoreMemory) snapshot() []MemoryBlockState {
+	blocks := make([]MemoryBlockState, 0, len(coreMemory.Blocks))
+	for label, block := range coreMemory.Blocks {
+		blocks = append(blocks, MemoryBlockState{
+			Label:       label,
+			SectionName: block.sectionName,
+			Data:        block.data,
+			Limit:       block.size,
+			ReadOnly:    block.readOnly,
+			Description: block.description,
+			LastEdited:  block.lastEdited,
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Label < blocks[j].Label })
+	return blocks
+}
+
+/*
+Values needed to restore an Agent that are not part of its saved state
+*/
+type RestoreOptions struct {
+	// The LLM API used to serve the Agent's requests; when nil, the Anthropic API is used with ApiKey
+	Provider Provider
+	ApiKey   string
+	/*
+		Supplies the Agent's tools other than the built-in memory tools.
+		Restoring fails if the Agent had a tool that is neither built in nor registered here.
+	*/
+	Tools *ToolRegistry
+	/*
+		Enables semantic search of archival memory.
+		Passages that were saved without an embedding are embedded when the Agent is restored.
+	*/
+	Embedder Embedder
+	// Where the messages sent with sendMessage are delivered; defaults to standard output
+	Output OutputSink
+	// Receives the restored Agent's events
+	OnEvent func(event AgentEvent)
+}
+
+/*
+Recreates an Agent from its saved state
+*/
+func RestoreAgent(ctx context.Context, state AgentState, options RestoreOptions) (*Agent, error) {
+	agent := &Agent{
+		ID:          state.ID,
+		Name:        state.Name,
+		Model:       state.Model,
+		ApiKey:      options.ApiKey,
+		Provider:    options.Provider,
+		Output:      options.Output,
+		OnEvent:     options.OnEvent,
+		System:      append([]Content(nil), state.System...),
+		ChatHistory: append([]Message(nil), state.ChatHistory...),
+		CoreMemory: CoreMemory{
+			Blocks: make(map[string]*MemoryBlock, len(state.CoreMemory)),
+			edits:  append([]MemoryEdit(nil), state.MemoryEdits...),
+		},
+		RecallMemory:   NewRecallMemory(),
+		ArchivalMemory: NewArchivalMemory(),
+		ContextWindow:  state.ContextWindow,
+
+		contextWarningGiven: state.ContextWarningGiven,
+		recallOutOfContext:  state.RecallOutOfContext,
+	}
+	if agent.ChatHistory == nil {
+		agent.ChatHistory = make([]Message, 0)
+	}
+	agent.CoreMemory.onEdit = agent.emitMemoryEdit
+	agent.CoreMemory.clock = func() time.Time { return agent.now() }
+
+	for _, block := range state.CoreMemory {
+		agent.CoreMemory.Blocks[block.Label] = &MemoryBlock{
+			sectionName: block.SectionName,
+			size:        block.Limit,
+			data:        block.Data,
+			readOnly:    block.ReadOnly,
+			description: block.Description,
+			lastEdited:  block.LastEdited,
+		}
+	}
+	agent.RecallMemory.restore(state.RecallMemory)
+	if options.Embedder != nil {
+		agent.ArchivalMemory = NewArchivalMemoryWithEmbedder(options.Embedder)
+	}
+	if err := agent.ArchivalMemory.restore(ctx, state.ArchivalMemory); err != nil {
+		return nil, fmt.Errorf("error restoring archival memory of agent %q: %w", state.Name, err)
+	}
+
+	missing := make([]string, 0)
+	for _, name := range state.Tools {
+		// older states include the messaging tools, which are given back when the agent is registered with an AgentRegistry
+		if agentMessagingTools[name] {
+			continue
+		}
+		tool, ok := options.Tools.bind(name, agent)
+		if !ok {
+			tool, ok = builtinTools.bind(name, agent)
+		}
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%q", name))
+			continue
+		}
+		agent.Tools = append(agent.Tools, *tool)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("cannot restore agent %q: tools %s are not registered", state.Name, strings.Join(missing, ", "))
+	}
+	agent.refreshMemoryToolSchemas()
+
+	return agent, nil
+}
+
+/*
+Loads the Agent with the given ID or name from the store
+*/
+func LoadAgent(ctx context.Context, store AgentStore, idOrName string, options RestoreOptions) (*Agent, error) {
+	state, err := store.Load(ctx, idOrName)
+	if err != nil {
+		return nil, err
+	}
+	return RestoreAgent(ctx, *state, options)
+}
+
+/*
+Creates a Tool for a specific Agent.
+Tools whose function uses the Agent (such as the memory tools) must be registered as a factory, so that the restored tool acts on the restored Agent.
+*/
+type ToolFactory func(agent *Agent) *Tool
+
+/*
+A set of tools, by name, that can be given to restored Agents
+*/
+type ToolRegistry struct {
+	mu        sync.RWMutex
+	factories map[string]ToolFactory
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{factories: make(map[string]ToolFactory)}
+}
+
+/*
+Registers a tool that does not depend on the Agent using it
+*/
+func (registry *ToolRegistry) Register(tool *Tool) {
+	registry.RegisterFactory(tool.Name, func(agent *Agent) *Tool {
+		copied := *tool
+		return &copied
+	})
+}
+
+/*
+Registers a function that creates the named tool for a given Agent
+*/
+func (registry *ToolRegistry) RegisterFactory(name string, factory ToolFactory) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.factories[name] = factory
+}
+
+/*
+Returns the names of the registered tools, sorted
+*/
+func (registry *ToolRegistry) Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Creates the named tool for the Agent, if it is registered
+*/
+func (registry *ToolRegistry) bind(name string, agent *Agent) (*Tool, bool) {
+	if registry == nil {
+		return nil, false
+	}
+	registry.mu.RLock()
+	factory, ok := registry.factories[name]
+	registry.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return factory(agent), true
+}
+
+/*
+The tools that every Agent can be restored with, without registering them
+*/
+var builtinTools = func() *ToolRegistry {
+	registry := NewToolRegistry()
+	registry.RegisterFactory("sendMessage", (*Agent).createSendMessageTool)
+	registry.RegisterFactory("coreMemoryAppend", (*Agent).createCoreMemoryAppendTool)
+	registry.RegisterFactory("coreMemoryReplace", (*Agent).createCoreMemoryReplaceTool)
+	registry.RegisterFactory("conversationSearch", (*Agent).createConversationSearchTool)
+	registry.RegisterFactory("conversationSearchDate", (*Agent).createConversationSearchDateTool)
+	registry.RegisterFactory("archivalMemoryInsert", (*Agent).createArchivalMemoryInsertTool)
+	registry.RegisterFactory("archivalMemorySearch", (*Agent).createArchivalMemorySearchTool)
+	registry.RegisterFactory("pauseHeartbeats", (*Agent).createPauseHeartbeatsTool)
+	return registry
+}()
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Returns a store of each kind, each empty
+*/
+func testStores(t *testing.T) map[string]AgentStore {
+	jsonStore, err := NewJSONFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteStore, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+	return map[string]AgentStore{"json": jsonStore, "sqlite": sqliteStore}
+}
+
+/*
+Encodes the parts of the state that are saved, with every time in UTC, so that states can be compared
+*/
+func encodeState(t *testing.T, state AgentState) string {
+	state.CreatedAt, state.UpdatedAt = time.Time{}, time.Time{}
+	blocks := make([]MemoryBlockState, len(state.CoreMemory))
+	for i, block := range state.CoreMemory {
+		block.LastEdited = block.LastEdited.UTC()
+		blocks[i] = block
+	}
+	state.CoreMemory = blocks
+	edits := make([]MemoryEdit, len(state.MemoryEdits))
+	for i, edit := range state.MemoryEdits {
+		edit.Timestamp = edit.Timestamp.UTC()
+		edits[i] = edit
+	}
+	state.MemoryEdits = edits
+	entries := make([]RecallEntry, len(state.RecallMemory))
+	for i, entry := range state.RecallMemory {
+		entry.Timestamp = entry.Timestamp.UTC()
+		entries[i] = entry
+	}
+	state.RecallMemory = entries
+	records := make([]ArchivalRecord, len(state.ArchivalMemory))
+	for i, record := range state.ArchivalMemory {
+		record.Timestamp = record.Timestamp.UTC()
+		records[i] = record
+	}
+	state.ArchivalMemory = records
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+/*
+Returns an Agent with something in every kind of memory
+*/
+func newStoredTestAgent(t *testing.T, name string) *Agent {
+	ctx := context.Background()
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.Name = name
+	agent.Clock = NewManualClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+	agent.ContextWindow = ContextWindowOptions{Size: 50000, FlushThreshold: 0.8, ExactTokenCount: true}
+	agent.contextWarningGiven = true
+	agent.AddUserMessage("Hi, I'm Sam.")
+	if _, err := agent.coreMemoryAppend(ctx, "User", "Name: Sam", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.archivalInsert(ctx, "Sam has a cat named Miso.", []string{"pets"}, false); err != nil {
+		t.Fatal(err)
+	}
+	return agent
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			agent := newStoredTestAgent(t, "sam-assistant")
+			if err := agent.Save(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+
+			// saving again after more was added to every kind of memory
+			agent.AddUserMessage("I moved to Lisbon.")
+			if _, err := agent.coreMemoryReplace(ctx, "User", "Name: Sam", "Name: Sam, lives in Lisbon", false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := agent.archivalInsert(ctx, "Sam moved to Lisbon.", nil, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := agent.Save(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, idOrName := range []string{agent.ID, agent.Name} {
+				state, err := store.Load(ctx, idOrName)
+				if err != nil {
+					t.Fatalf("Load(%q) returned an error: %v", idOrName, err)
+				}
+				if got, want := encodeState(t, *state), encodeState(t, agent.Snapshot()); got != want {
+					t.Errorf("Load(%q) =\n%s\nwant\n%s", idOrName, got, want)
+				}
+				if state.CreatedAt.IsZero() || state.UpdatedAt.Before(state.CreatedAt) {
+					t.Errorf("Load(%q) was created at %v and updated at %v", idOrName, state.CreatedAt, state.UpdatedAt)
+				}
+			}
+
+			restored, err := LoadAgent(ctx, store, agent.Name, RestoreOptions{Provider: &fakeProvider{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := encodeState(t, restored.Snapshot()), encodeState(t, agent.Snapshot()); got != want {
+				t.Errorf("the restored agent =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestStoreSavesEmbeddingsAddedOnRestore(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			agent := newStoredTestAgent(t, "sam-assistant")
+			if err := agent.Save(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+
+			// the passage saved without an embedding is embedded when the agent is restored with an Embedder
+			restored, err := LoadAgent(ctx, store, agent.ID, RestoreOptions{Provider: &fakeProvider{}, Embedder: NewHashEmbedder(32)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := restored.Save(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := store.Load(ctx, agent.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.ArchivalMemory) != 1 || len(state.ArchivalMemory[0].Vector) != 32 {
+				t.Errorf("the saved passages are %+v, want one passage with a 32 dimensional embedding", state.ArchivalMemory)
+			}
+		})
+	}
+}
+
+func TestStoreNames(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first := newStoredTestAgent(t, "assistant")
+			second := newStoredTestAgent(t, "assistant")
+			if err := first.Save(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+			if err := second.Save(ctx, store); err == nil {
+				t.Fatalf("saved a second agent named %q", second.Name)
+			}
+
+			// renaming the first agent frees its name
+			first.Name = "renamed"
+			if err := first.Save(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+			if err := second.Save(ctx, store); err != nil {
+				t.Fatalf("could not save an agent under the name that was freed: %v", err)
+			}
+
+			summaries, err := store.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(summaries) != 2 || summaries[0].Name != "assistant" || summaries[1].Name != "renamed" {
+				t.Errorf("List = %+v, want agents named \"assistant\" and \"renamed\"", summaries)
+			}
+
+			if err := store.Delete(ctx, "renamed"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Load(ctx, first.ID); !errors.Is(err, ErrAgentNotFound) {
+				t.Errorf("Load after Delete returned %v, want %v", err, ErrAgentNotFound)
+			}
+			if err := store.Delete(ctx, "renamed"); !errors.Is(err, ErrAgentNotFound) {
+				t.Errorf("deleting a deleted agent returned %v, want %v", err, ErrAgentNotFound)
+			}
+		})
+	}
+}
+
+func TestRestoreAgentTools(t *testing.T) {
+	ctx := context.Background()
+	weather := &Tool{Name: "getWeather", Description: "Returns the weather.", InputSchema: InputSchema{Type: "object"}, Function: func(ctx context.Context, args ...any) (any, error) {
+		return "sunny", nil
+	}}
+	agent := NewAgentWithProvider("test-model", "A helpful assistant.", "forecaster", &fakeProvider{})
+	agent.Tools = append(agent.Tools, *weather)
+	state := agent.Snapshot()
+
+	if _, err := RestoreAgent(ctx, state, RestoreOptions{Provider: &fakeProvider{}}); err == nil || !strings.Contains(err.Error(), `"getWeather"`) {
+		t.Errorf("restoring without the getWeather tool returned error %v, want an error naming it", err)
+	}
+
+	registry := NewToolRegistry()
+	registry.Register(weather)
+	restored, err := RestoreAgent(ctx, state, RestoreOptions{Provider: &fakeProvider{}, Tools: registry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(restored.Tools))
+	for _, tool := range restored.Tools {
+		names = append(names, tool.Name)
+	}
+	if !reflect.DeepEqual(names, state.Tools) {
+		t.Errorf("the restored agent has the tools %v, want %v", names, state.Tools)
+	}
+	if output, err := restored.toolMap()["getWeather"].Function(ctx); output != "sunny" || err != nil {
+		t.Errorf("the restored getWeather tool returned %v, %v", output, err)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Streaming support for model responses via server-sent events
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+Possible values for the Type of a StreamEvent
+*/
+const (
+	STREAM_EVENT_TEXT           = "text"           // a piece of text was generated for a text block
+	STREAM_EVENT_TOOL_USE_START = "tool_use_start" // the model started a tool_use block
+	STREAM_EVENT_TOOL_INPUT     = "tool_input"     // a piece of the (partial) JSON input for a tool_use block was generated
+	STREAM_EVENT_BLOCK_STOP     = "block_stop"     // a content block is complete
+	STREAM_EVENT_MESSAGE_STOP   = "message_stop"   // the response is complete
+)
+
+/*
+An incremental piece of a streamed response, emitted to a StreamHandler as it arrives
+*/
+type StreamEvent struct {
+	Type        string
+	Index       int    // the index of the content block that this event belongs to
+	Text        string // the text delta, for STREAM_EVENT_TEXT events
+	PartialJSON string // the partial tool input, for STREAM_EVENT_TOOL_INPUT events
+	ToolUseID   string // the ID of the tool_use block, for tool_use events
+	ToolName    string // the name of the tool being called, for tool_use events
+	/*
+		The completed content block, for STREAM_EVENT_BLOCK_STOP events.
+		For tool_use blocks, the Input field contains the fully parsed input.
+	*/
+	Block *Content
+	// The completed response, for STREAM_EVENT_MESSAGE_STOP events
+	Response *AgentResponse
+}
+
+/*
+Callback that receives each StreamEvent of a streamed response
+*/
+type StreamHandler func(event StreamEvent)
+
+/*
+Builds a complete AgentResponse out of the incremental pieces of a streamed response
+*/
+type streamAccumulator struct {
+	response  AgentResponse
+	inputJSON map[int]*strings.Builder // partial tool_use input, keyed by content block index
+	handler   StreamHandler
+	complete  bool // whether the stream signalled the end of the response
+}
+
+func newStreamAccumulator(handler StreamHandler) *streamAccumulator {
+	return &streamAccumulator{
+		response:  AgentResponse{Content: []Content{}, Usage: map[string]int{}},
+		inputJSON: make(map[int]*strings.Builder),
+		handler:   handler,
+	}
+}
+
+func (acc *streamAccumulator) emit(event StreamEvent) {
+	if acc.handler != nil {
+		acc.handler(event)
+	}
+}
+
+func (acc *streamAccumulator) startBlock(index int, block Content) {
+	for len(acc.response.Content) <= index {
+		acc.response.Content = append(acc.response.Content, Content{})
+	}
+	acc.response.Content[index] = block
+
+	if block.Type == "tool_use" {
+		acc.inputJSON[index] = &strings.Builder{}
+		acc.emit(StreamEvent{Type: STREAM_EVENT_TOOL_USE_START, Index: index, ToolUseID: block.ID, ToolName: block.Name})
+	} else if block.Type == "text" && block.Text != "" {
+		acc.emit(StreamEvent{Type: STREAM_EVENT_TEXT, Index: index, Text: block.Text})
+	}
+}
+
+func (acc *streamAccumulator) appendText(index int, text string) {
+	if index >= len(acc.response.Content) {
+		acc.startBlock(index, Content{Type: "text"})
+	}
+	acc.response.Content[index].Text += text
+	acc.emit(StreamEvent{Type: STREAM_EVENT_TEXT, Index: index, Text: text})
+}
+
+func (acc *streamAccumulator) appendInputJSON(index int, partialJSON string) {
+	builder, ok := acc.inputJSON[index]
+	if !ok {
+		return
+	}
+	builder.WriteString(partialJSON)
+	block := acc.response.Content[index]
+	acc.emit(StreamEvent{Type: STREAM_EVENT_TOOL_INPUT, Index: index, PartialJSON: partialJSON, ToolUseID: block.ID, ToolName: block.Name})
+}
+
+func (acc *streamAccumulator) stopBlock(index int) error {
+	if index >= len(acc.response.Content) {
+		return nil
+	}
+	block := &acc.response.Content[index]
+
+	if builder, ok := acc.inputJSON[index]; ok {
+		delete(acc.inputJSON, index)
+		block.Input = map[string]any{}
+		if builder.Len() > 0 {
+			if err := json.Unmarshal([]byte(builder.String()), &block.Input); err != nil {
+				return fmt.Errorf("invalid input for tool %q: %w", block.Name, err)
+			}
+		}
+	}
+
+	completed := *block
+	acc.emit(StreamEvent{Type: STREAM_EVENT_BLOCK_STOP, Index: index, ToolUseID: block.ID, ToolName: block.Name, Block: &completed})
+	return nil
+}
+
+/*
+Returns the accumulated response, or io.ErrUnexpectedEOF if the stream ended without signalling the end of the response
+*/
+func (acc *streamAccumulator) finish() (*AgentResponse, error) {
+	if !acc.complete {
+		return nil, fmt.Errorf("the stream ended before the response was complete: %w", io.ErrUnexpectedEOF)
+	}
+	// closing any blocks that the stream did not explicitly stop
+	for index := range acc.inputJSON {
+		acc.stopBlock(index)
+	}
+	response := acc.response
+	acc.emit(StreamEvent{Type: STREAM_EVENT_MESSAGE_STOP, Response: &response})
+	return &response, nil
+}
+
+/*
+Reads server-sent events from the reader, calling onEvent with the event name and data of each event.
+Stops at the end of the stream or when onEvent returns an error.
+An event that is cut off by the end of the stream (one not followed by a blank line) is not dispatched; io.ErrUnexpectedEOF is returned instead.
+*/
+func readServerSentEvents(reader io.Reader, onEvent func(event string, data string) error) error {
+	bufReader := bufio.NewReader(reader)
+	var event string
+	var data strings.Builder
+
+	dispatch := func() error {
+		if data.Len() == 0 {
+			event = ""
+			return nil
+		}
+		err := onEvent(event, data.String())
+		event = ""
+		data.Reset()
+		return err
+	}
+
+	for {
+		line, err := bufReader.ReadString('\n')
+		if err == io.EOF {
+			if line != "" || data.Len() > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			if dispatchErr := dispatch(); dispatchErr != nil {
+				return dispatchErr
+			}
+		case strings.HasPrefix(line, ":"):
+			// comment line, used by servers as a keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteString("\n")
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+Formats a single server-sent event
+*/
+func sse(event string, data string) string {
+	return "event: " + event + "\ndata: " + data + "\n\n"
+}
+
+func TestReadServerSentEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string // "<event>|<data>" for every dispatched event
+	}{
+		{name: "named events", stream: "event: a\ndata: 1\n\nevent: b\ndata: 2\n\n", want: []string{"a|1", "b|2"}},
+		{name: "unnamed event", stream: "data: {}\n\n", want: []string{"|{}"}},
+		{name: "multi-line data", stream: "data: one\ndata: two\n\n", want: []string{"|one\ntwo"}},
+		{name: "comments and CRLF line endings", stream: ": keep-alive\r\nevent: a\r\ndata: 1\r\n\r\n", want: []string{"a|1"}},
+		{name: "no space after the colon", stream: "event:a\ndata:1\n\n", want: []string{"a|1"}},
+		{name: "events without data are skipped", stream: "event: a\n\nevent: b\ndata: 2\n\n", want: []string{"b|2"}},
+		{name: "empty stream", stream: "", want: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make([]string, 0)
+			err := readServerSentEvents(strings.NewReader(test.stream), func(event string, data string) error {
+				got = append(got, event+"|"+data)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readServerSentEvents dispatched %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// events cut off by the end of the stream are not dispatched
+	truncated := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{name: "no blank line after the last event", stream: "data: 1\n\nevent: a\ndata: 2\n", want: []string{"|1"}},
+		{name: "cut off in a data line", stream: "data: 1\n\ndata: {\"type\":", want: []string{"|1"}},
+		{name: "cut off in an event line", stream: "data: 1\n\neve", want: []string{"|1"}},
+	}
+	for _, test := range truncated {
+		t.Run(test.name, func(t *testing.T) {
+			got := make([]string, 0)
+			err := readServerSentEvents(strings.NewReader(test.stream), func(event string, data string) error {
+				got = append(got, event+"|"+data)
+				return nil
+			})
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("readServerSentEvents returned %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readServerSentEvents dispatched %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("stops at an error", func(t *testing.T) {
+		stop := errors.New("stop")
+		calls := 0
+		err := readServerSentEvents(strings.NewReader("data: 1\n\ndata: 2\n\n"), func(event string, data string) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("readServerSentEvents returned %v after %d events, want %v after 1", err, calls, stop)
+		}
+	})
+}
+
+/*
+A streamed response with a text block followed by a tool_use block whose input arrives in several pieces
+*/
+var streamedToolUse = sse("message_start", `{"type":"message_start","message":{"id":"msg_1","model":"test-model","role":"assistant","content":[],"usage":{"input_tokens":10}}}`) +
+	sse("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`) +
+	sse("ping", `{"type":"ping"}`) +
+	sse("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me "}}`) +
+	sse("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check."}}`) +
+	sse("content_block_stop", `{"type":"content_block_stop","index":0}`) +
+	sse("content_block_start", `{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"echo","input":{}}}`) +
+	sse("content_block_delta", `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":""}}`) +
+	sse("content_block_delta", `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"te"}}`) +
+	sse("content_block_delta", `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"xt\": \"hi\"}"}}`) +
+	sse("content_block_stop", `{"type":"content_block_stop","index":1}`) +
+	sse("message_delta", `{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":12}}`) +
+	sse("message_stop", `{"type":"message_stop"}`)
+
+/*
+Returns a server that answers every request with the given body as a stream of server-sent events
+*/
+func newStreamServer(t *testing.T, stream string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, stream)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+/*
+Streams a request from an AnthropicProvider whose requests are answered with the given server-sent events
+*/
+func streamFrom(t *testing.T, stream string) (*AgentResponse, []StreamEvent, error) {
+	provider := AnthropicProvider{BaseURL: newStreamServer(t, stream).URL}
+	request := AgentRequest{Model: "test-model", Messages: []Message{{Role: "user", Content: []Content{{Type: "text", Text: "Hello"}}}}}
+
+	events := make([]StreamEvent, 0)
+	response, _, err := provider.Stream(context.Background(), request, func(event StreamEvent) {
+		events = append(events, event)
+	})
+	return response, events, err
+}
+
+func TestStreamAccumulatesResponse(t *testing.T) {
+	response, events, err := streamFrom(t, streamedToolUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ID != "msg_1" || response.StopReason != "tool_use" || response.Usage["input_tokens"] != 10 || response.Usage["output_tokens"] != 12 {
+		t.Errorf("response = %+v, want msg_1 stopping for tool_use with 10 input and 12 output tokens", response)
+	}
+	if len(response.Content) != 2 || response.Content[0].Text != "Let me check." {
+		t.Fatalf("response content = %+v, want the text \"Let me check.\" and a tool_use block", response.Content)
+	}
+	if toolUse := response.Content[1]; toolUse.ID != "toolu_1" || toolUse.Name != "echo" || !reflect.DeepEqual(toolUse.Input, map[string]any{"text": "hi"}) {
+		t.Errorf("tool_use block = %+v, want echo called with {\"text\": \"hi\"}", toolUse)
+	}
+
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	want := []string{
+		STREAM_EVENT_TEXT, STREAM_EVENT_TEXT, STREAM_EVENT_BLOCK_STOP,
+		STREAM_EVENT_TOOL_USE_START, STREAM_EVENT_TOOL_INPUT, STREAM_EVENT_TOOL_INPUT, STREAM_EVENT_TOOL_INPUT, STREAM_EVENT_BLOCK_STOP,
+		STREAM_EVENT_MESSAGE_STOP,
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("emitted events %v, want %v", types, want)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	start := sse("message_start", `{"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[]}}`) +
+		sse("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`) +
+		sse("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`)
+	tests := []struct {
+		name     string
+		stream   string
+		errorHas string
+		is       error // an error that the returned error wraps, if any
+	}{
+		{
+			name:     "error event during the stream",
+			stream:   start + sse("error", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			errorHas: "Overloaded",
+		},
+		{
+			name:     "no message_stop",
+			stream:   strings.TrimSuffix(streamedToolUse, sse("message_stop", `{"type":"message_stop"}`)),
+			errorHas: "the stream ended before the response was complete",
+			is:       io.ErrUnexpectedEOF,
+		},
+		{
+			name:     "cut off in a text block",
+			stream:   start,
+			errorHas: "the stream ended before the response was complete",
+			is:       io.ErrUnexpectedEOF,
+		},
+		{
+			name:     "cut off in an event",
+			stream:   streamedToolUse[:strings.Index(streamedToolUse, `"partial_json":"{\"te"`)],
+			errorHas: "unexpected EOF",
+			is:       io.ErrUnexpectedEOF,
+		},
+		{
+			name: "invalid tool input",
+			stream: sse("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"echo","input":{}}}`) +
+				sse("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"text\": "}}`) +
+				sse("content_block_stop", `{"type":"content_block_stop","index":0}`),
+			errorHas: "invalid input",
+		},
+		{
+			name:     "invalid event data",
+			stream:   start + sse("content_block_delta", `{"type":`),
+			errorHas: "error parsing stream event",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, events, err := streamFrom(t, test.stream)
+			if err == nil || !strings.Contains(err.Error(), test.errorHas) {
+				t.Errorf("streaming returned %+v with error %v, want an error containing %q", response, err, test.errorHas)
+			}
+			if test.is != nil && !errors.Is(err, test.is) {
+				t.Errorf("streaming returned error %v, want it to wrap %v", err, test.is)
+			}
+			for _, event := range events {
+				if event.Type == STREAM_EVENT_MESSAGE_STOP {
+					t.Errorf("a stream that failed emitted %s", STREAM_EVENT_MESSAGE_STOP)
+				}
+			}
+		})
+	}
+
+	// errors reported by the API after the stream has started can be retried like any other API error
+	_, _, err := streamFrom(t, start+sse("error", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != "overloaded_error" || !apiErr.Retryable() {
+		t.Errorf("an error event was returned as %v, want a retryable *APIError", err)
+	}
+}
+
+func TestStreamAccumulatorSplitInput(t *testing.T) {
+	// tool input split in the middle of keys, escape sequences and multi-byte characters, with two tool_use blocks interleaved
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[]}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"note","input":{}}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_2","name":"note","input":{}}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"te"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"text\": \"caf\\u00"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"xt\": \"say \\"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"e9 ☕\"}"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"\"hi\\\"\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"}}`,
+		`{"type":"message_stop"}`,
+	}
+	acc := newStreamAccumulator(nil)
+	for _, data := range events {
+		if err := acc.applyMessagesEvent(data); err != nil {
+			t.Fatalf("applying %s: %v", data, err)
+		}
+	}
+	response, err := acc.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Content{
+		{Type: "tool_use", ID: "toolu_1", Name: "note", Input: map[string]any{"text": `say "hi"`}},
+		{Type: "tool_use", ID: "toolu_2", Name: "note", Input: map[string]any{"text": "café ☕"}},
+	}
+	if !reflect.DeepEqual(response.Content, want) {
+		t.Errorf("the accumulated content is %+v, want %+v", response.Content, want)
+	}
+
+	// a stream that ends in the middle of a tool_use block
+	acc = newStreamAccumulator(nil)
+	for _, data := range events[:6] {
+		if err := acc.applyMessagesEvent(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if response, err := acc.finish(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("finish = %+v, %v; want %v", response, err, io.ErrUnexpectedEOF)
+	}
+}
@@ -3,10 +3,24 @@
 //
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type Property struct {
-	Type        string   `json:"type"`           // the data type of this property (parameter)
-	Description string   `json:"description"`    // a brief description of what this property (parameter) represents
-	Enum        []string `json:"enum:omitempty"` // possible values for Enum type input parameters
+	Type        string    `json:"type,omitempty"`    // the data type of this property (parameter); omitted to accept any type
+	Description string    `json:"description"`       // a brief description of what this property (parameter) represents
+	Enum        []string  `json:"enum,omitempty"`    // possible values for Enum type input parameters
+	Default     any       `json:"default,omitempty"` // value passed to the function when an optional property is omitted by the model
+	Items       *Property `json:"items,omitempty"`   // the type of the elements of "array" type input parameters
 }
 
 type InputSchema struct {
@@ -16,16 +30,22 @@ type InputSchema struct {
 		Properties (parameters) that this tool takes as input.
 		Keys are the names of the tools.
 		Values are Property structs, which denote the type and description for the tool, as well as enumerated values, if applicable.
-		Ensure that the Properties are listed in the order in which the function calls them.
-		For example, if a function `f` takes in `a` and `b` as parameters and should be called in the form `f(a,b)`,
-		then `a` should be listed before `b` in this field.
+		Since this is a map, the order in which the Properties are listed has no effect; see the Order and Required fields for how arguments are ordered.
 	*/
 	Properties map[string]Property `json:"properties"` // properties (parameters) that this tool takes as input
 	/*
 		Names of properties that are mandatory input parameters.
-		In Go, all function parameters are required when calling a function. Therefore, this field should contain the names of every parameter in the function, i.e. every key from the Properties field.
+		Unless Order is set, the Function receives its arguments in the order listed here.
+		For example, if a function `f` takes in `a` and `b` as parameters and should be called in the form `f(a,b)`,
+		then `a` should be listed before `b` in this field.
 	*/
 	Required []string `json:"required"`
+	/*
+		Names of every property, in the order in which the Function takes them as arguments.
+		Only needs to be set when the tool has optional properties that are not in Required.
+		When omitted, the Required properties are passed first, followed by any optional properties sorted by name.
+	*/
+	Order []string `json:"-"`
 }
 
 type Tool struct {
@@ -81,9 +101,22 @@ type Tool struct {
 	Description string      `json:"description"`
 	InputSchema InputSchema `json:"input_schema"` // defining what the tool uses as input
 	/*
-		Defines the function to be executed for the model's tool calls
+		Defines the function to be executed for the model's tool calls.
+		Returns the result of the call, which is sent back to the model as JSON text (strings are sent as is),
+		or an error, which is sent back as a tool_result with is_error set so that the model can recover.
+	*/
+	Function func(context.Context, ...any) (any, error) `json:"-"`
+	/*
+		Set to true when the tool is not safe to run concurrently, e.g. because it edits the Agent's memory.
+		Sequential tools requested in the same response are run one at a time, in the order in which the model requested them.
+		A Sequential tool is always waited for, even once its context is done, so that it never overlaps the next tool or step.
+	*/
+	Sequential bool `json:"-"`
+	/*
+		The maximum amount of time that a single call to this tool may take, overriding the ToolTimeout of the RunOptions.
+		The context passed to the Function is cancelled once the deadline passes; Functions must return promptly when it is.
 	*/
-	Function func(...any) any `json:"-"`
+	Timeout time.Duration `json:"-"`
 	// Function1P func(any) any                     `json:"-"`
 	// Function2P func(any, any) any                `json:"-"`
 	// Function3P func(any, any, any) any           `json:"-"`
@@ -124,77 +157,393 @@ type Tool struct {
 // }
 
 /*
-Gets the result (output) of a single function call as specified by the Agent
+Creates a map containing every tool (function) and it's name for efficient lookup
 */
-func getSingleToolOutput(content Content, llm Agent) (any, bool) {
-	if content.Type != "tool_use" {
-		return nil, false
+func (llm Agent) toolMap() map[string]Tool {
+	toolMap := make(map[string]Tool, len(llm.Tools))
+	for _, tool := range llm.Tools {
+		toolMap[tool.Name] = tool
 	}
+	return toolMap
+}
 
-	// Getting the slice of Tools provided to the Agent in the initial request
-	tools := llm.Tools
-	// Creating a map containing every tool (function) and it's name for efficient lookup
-	toolMap := make(map[string]Tool)
-	for _, tool := range tools {
-		toolMap[tool.Name] = tool
+/*
+Gets the result (output) of a single function call as specified by the Agent
+*/
+func getSingleToolOutput(ctx context.Context, content Content, llm Agent) (any, error) {
+	return getToolOutput(ctx, content, llm.toolMap())
+}
+
+/*
+Gets the result (output) of a single function call, looking the tool up in the given map of tools
+*/
+func getToolOutput(ctx context.Context, content Content, toolMap map[string]Tool) (any, error) {
+	if content.Type != "tool_use" {
+		return nil, fmt.Errorf("content block of type \"%s\" is not a tool call", content.Type)
 	}
 
 	tool, ok := toolMap[content.Name]
 	if !ok {
-		return nil, false
+		return nil, fmt.Errorf("tool \"%s\" does not exist", content.Name)
+	}
+	// Binding the input parameters to the function's arguments by name
+	values, err := bindToolArguments(tool.InputSchema, content.Input)
+	if err != nil {
+		return nil, err
 	}
-	// Map that represents the name of each input parameter and the value to pass in for that parameter for this function call
-	funcParams := content.Input
 
-	// Creating a slice of function parameter values from the given input parameters map
-	values := make([]any, 0, len(funcParams))
-	for _, value := range funcParams {
-		values = append(values, value)
+	// Applying the tool's deadline, if any
+	if tool.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tool.Timeout)
+		defer cancel()
 	}
 
-	return tool.Function(values...), true
+	return callToolFunction(ctx, tool, values)
+}
 
-	/*
-		Calling the function with the appropriate number of parameters
-	*/
-	// switch numParams {
-	// case 1:
-	// 	return tool.Function1P(values[0]), true
-	// case 2:
-	// 	return tool.Function2P(values[0], values[1]), true
-	// case 3:
-	// 	return tool.Function3P(values[0], values[1], values[2]), true
-	// case 4:
-	// 	return tool.Function4P(values[0], values[1], values[2], values[3]), true
-	// case 5:
-	// 	return tool.Function5P(values[0], values[1], values[2], values[3], values[4]), true
-	// default:
-	// 	return nil, false
-	// }
+/*
+Calls the tool's Function with the given arguments, converting a panic inside the tool into an error.
+When the context is done, returns straight away for concurrent tools, even if the Function does not respect the cancellation.
+Sequential tools are waited for, since they may still change the Agent's state; their actual outcome is returned.
+*/
+func callToolFunction(ctx context.Context, tool Tool, values []any) (any, error) {
+	if tool.Function == nil {
+		return nil, fmt.Errorf("tool \"%s\" has no function", tool.Name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("tool \"%s\" was not run: %w", tool.Name, err)
+	}
+
+	type toolOutput struct {
+		output any
+		err    error
+	}
+	done := make(chan toolOutput, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- toolOutput{nil, fmt.Errorf("tool \"%s\" panicked: %v", tool.Name, r)}
+			}
+		}()
+		output, err := tool.Function(ctx, values...)
+		done <- toolOutput{output, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.output, result.err
+	case <-ctx.Done():
+		if tool.Sequential {
+			result := <-done
+			return result.output, result.err
+		}
+		return nil, fmt.Errorf("tool \"%s\" did not finish: %w", tool.Name, ctx.Err())
+	}
+}
+
+/*
+What a single tool call asks of the agent loop, once every tool in the step has finished
+*/
+const (
+	HEARTBEAT_NOT_REQUESTED int32 = iota
+	HEARTBEAT_REQUESTED           // run the Agent again after this step
+	HEARTBEAT_PAUSED              // do not run the Agent again for a heartbeat, even if another tool in the step requested one
+)
+
+type heartbeatRequestKey struct{}
+
+/*
+Returns a copy of the context through which the tool being executed can request a heartbeat, along with the request it records
+*/
+func contextWithHeartbeatRequest(ctx context.Context) (context.Context, *atomic.Int32) {
+	request := &atomic.Int32{}
+	return context.WithValue(ctx, heartbeatRequestKey{}, request), request
 }
 
 /*
-Adds the result of executing a given tool to the Agent's context.
+Records the heartbeat request of the tool call that the context belongs to.
+Each tool call keeps its own request, so that tools running concurrently do not overwrite each other's.
 */
-func (llm *Agent) addToolResultToChatHistory(content Content) {
-	messageToAppend := Message{Role: "user", Content: []Content{}}
+func setHeartbeatRequest(ctx context.Context, state int32) {
+	if request, ok := ctx.Value(heartbeatRequestKey{}).(*atomic.Int32); ok {
+		request.Store(state)
+	}
+}
+
+/*
+Records that the tool call requested a heartbeat, if requested is true
+*/
+func requestHeartbeatIf(ctx context.Context, requested bool) {
+	if requested {
+		setHeartbeatRequest(ctx, HEARTBEAT_REQUESTED)
+	}
+}
+
+/*
+Combines the heartbeat requests of the tool calls of a single step: a pause wins over any request
+*/
+func combineHeartbeatRequests(requests []int32) bool {
+	requested := false
+	for _, request := range requests {
+		switch request {
+		case HEARTBEAT_PAUSED:
+			return false
+		case HEARTBEAT_REQUESTED:
+			requested = true
+		}
+	}
+	return requested
+}
+
+/*
+Converts the output of a tool into the text sent back to the model.
+Strings are sent as is; any other value is serialized to JSON.
+*/
+func formatToolOutput(output any) (string, error) {
+	switch v := output.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+
+	encoded, err := json.Marshal(output)
+	if err != nil {
+		return "", fmt.Errorf("unable to serialize tool output: %w", err)
+	}
+	return string(encoded), nil
+}
+
+/*
+Executes a single tool_use block and creates the tool_result block to send back to the model, along with the call's heartbeat request.
+Errors returned by the tool are reported in the tool_result with IsError set.
+*/
+func executeToolCall(ctx context.Context, content Content, toolMap map[string]Tool) (Content, int32) {
+	// the tool_use block's ID is the ID that the tool_result must refer back to
+	result := Content{Type: "tool_result", ToolUseID: content.ID}
 
 	// Retrieving the output from the function call
-	output, ok := getSingleToolOutput(content, *llm)
-	if !ok {
-		// Handle the case where the assertion fails
-		output = "Error: Unable to retrieve tool output"
+	ctx, heartbeat := contextWithHeartbeatRequest(contextWithToolUseID(ctx, content.ID))
+	output, err := getToolOutput(ctx, content, toolMap)
+	if err == nil {
+		result.Content, err = formatToolOutput(output)
+	}
+	if err != nil {
+		result.Content = fmt.Sprintf("Error: %v", err)
+		result.IsError = true
+	}
+
+	return result, heartbeat.Load()
+}
+
+/*
+Executes every given tool_use block and returns the corresponding tool_result blocks, in the same order,
+along with whether the tools requested a heartbeat.
+Up to MaxParallelTools tools are run concurrently. Tools marked as Sequential are run one at a time, in the order in which they were requested.
+Every tool_use block always receives a tool_result, even when the context is cancelled, so that the chat history stays valid.
+*/
+func (llm *Agent) executeToolCalls(ctx context.Context, toolUses []Content, options RunOptions) ([]Content, bool) {
+	toolMap := llm.toolMap()
+	results := make([]Content, len(toolUses))
+	heartbeats := make([]int32, len(toolUses))
+
+	// Applying the default deadline to tools that do not set their own
+	for name, tool := range toolMap {
+		if tool.Timeout == 0 {
+			tool.Timeout = options.ToolTimeout
+			toolMap[name] = tool
+		}
+	}
+
+	maxParallel := options.MaxParallelTools
+	if maxParallel <= 1 {
+		for i, content := range toolUses {
+			results[i], heartbeats[i] = llm.executeTool(ctx, content, toolMap)
+		}
+		return results, combineHeartbeatRequests(heartbeats)
+	}
+
+	// limits the number of tools running at the same time
+	workers := make(chan struct{}, maxParallel)
+	run := func(i int) {
+		workers <- struct{}{}
+		results[i], heartbeats[i] = llm.executeTool(ctx, toolUses[i], toolMap)
+		<-workers
+	}
+
+	var wg sync.WaitGroup
+	sequential := make([]int, 0)
+	for i, content := range toolUses {
+		if tool, ok := toolMap[content.Name]; ok && tool.Sequential {
+			sequential = append(sequential, i)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(i)
+		}()
+	}
+
+	// the sequential tools share a single goroutine so that they keep their original order
+	if len(sequential) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, i := range sequential {
+				run(i)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return results, combineHeartbeatRequests(heartbeats)
+}
+
+/*
+Executes a single tool_use block, reporting its start and end as events
+*/
+func (llm *Agent) executeTool(ctx context.Context, content Content, toolMap map[string]Tool) (Content, int32) {
+	llm.emit(AgentEvent{Type: AGENT_EVENT_TOOL_USE_START, ToolUseID: content.ID, ToolName: content.Name, Input: content.Input})
+	result, heartbeat := executeToolCall(ctx, content, toolMap)
+	llm.emit(AgentEvent{Type: AGENT_EVENT_TOOL_USE_END, ToolUseID: content.ID, ToolName: content.Name, Result: result.Content, IsError: result.IsError})
+	return result, heartbeat
+}
+
+/*
+Adds the results of executing the tools requested in a single response to the Agent's context.
+All of the tool_result blocks are combined into a single user message, as expected by the Messages API.
+*/
+func (llm *Agent) addToolResultsToChatHistory(results []Content) {
+	if len(results) == 0 {
+		return
 	}
-	strOutput := output.(string) // perform type assertion
 
 	// Creating the message
-	messageToAppend.Content = append(messageToAppend.Content, Content{
-		Type:      "tool_result",
-		ToolUseID: content.ToolUseID,
-		Name:      content.Name,
-		Content:   strOutput,
-	})
+	messageToAppend := Message{Role: "user", Content: results}
 
 	// Adding the message to the request
-	llm.ChatHistory = append(llm.ChatHistory, messageToAppend)
+	llm.addMessageToChatHistory(messageToAppend)
+}
+
+/*
+Returns the names of the schema's properties in the order in which they are passed to the tool's Function
+*/
+func (schema InputSchema) parameterOrder() []string {
+	if len(schema.Order) > 0 {
+		return schema.Order
+	}
+
+	order := make([]string, 0, len(schema.Properties))
+	required := make(map[string]bool, len(schema.Required))
+	for _, name := range schema.Required {
+		required[name] = true
+		order = append(order, name)
+	}
+
+	optional := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		if !required[name] {
+			optional = append(optional, name)
+		}
+	}
+	sort.Strings(optional)
+
+	return append(order, optional...)
+}
+
+/*
+Creates the positional argument slice for a tool's Function from the input parameters provided by the model.
+Arguments are bound by name in the order given by the schema, omitted optional parameters are replaced by their Default value (or nil),
+and each value is converted to the type declared by its Property.
+*/
+func bindToolArguments(schema InputSchema, input map[string]any) ([]any, error) {
+	required := make(map[string]bool, len(schema.Required))
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+
+	order := schema.parameterOrder()
+	values := make([]any, 0, len(order))
+	for _, name := range order {
+		property := schema.Properties[name]
+
+		value, ok := input[name]
+		if !ok || value == nil {
+			if required[name] {
+				return nil, fmt.Errorf("missing required parameter \"%s\"", name)
+			}
+			value = property.Default
+			if value == nil {
+				values = append(values, nil)
+				continue
+			}
+		}
+
+		coerced, err := coerceArgument(property.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for parameter \"%s\": %w", name, err)
+		}
+		values = append(values, coerced)
+	}
+
+	return values, nil
+}
+
+/*
+Converts a value decoded from JSON into the Go type that corresponds to the given JSON schema type.
+Integers become int, numbers become float64 and booleans become bool; string representations of these types are parsed.
+*/
+func coerceArgument(schemaType string, value any) (any, error) {
+	switch schemaType {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case float64, int, bool:
+			return fmt.Sprint(v), nil
+		}
+	case "integer":
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("expected an integer, got %v", v)
+			}
+			return int(v), nil
+		case string:
+			return strconv.Atoi(v)
+		}
+	case "number":
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case "array":
+		if v, ok := value.([]any); ok {
+			return v, nil
+		}
+	case "object":
+		if v, ok := value.(map[string]any); ok {
+			return v, nil
+		}
+	default:
+		return value, nil
+	}
+	return nil, fmt.Errorf("expected a value of type %s, got %T", schemaType, value)
 }
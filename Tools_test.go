@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBindToolArguments(t *testing.T) {
+	schema := InputSchema{
+		Type: "object",
+		Properties: map[string]Property{
+			"query":   {Type: "string"},
+			"page":    {Type: "integer", Default: 0},
+			"limit":   {Type: "number"},
+			"verbose": {Type: "boolean", Default: false},
+			"tags":    {Type: "array", Items: &Property{Type: "string"}},
+		},
+		Required: []string{"query"},
+	}
+	ordered := schema
+	ordered.Order = []string{"page", "query", "limit", "tags", "verbose"}
+
+	tests := []struct {
+		name    string
+		schema  InputSchema
+		input   map[string]any
+		want    []any
+		wantErr bool
+	}{
+		{
+			name:   "required first, then optional by name, with defaults",
+			schema: schema,
+			input:  map[string]any{"query": "tea"},
+			want:   []any{"tea", nil, 0, nil, false},
+		},
+		{
+			name:   "explicit order",
+			schema: ordered,
+			input:  map[string]any{"query": "tea", "page": float64(2)},
+			want:   []any{2, "tea", nil, nil, false},
+		},
+		{
+			name:   "values from JSON are converted to the declared types",
+			schema: schema,
+			input:  map[string]any{"query": float64(42), "page": float64(3), "limit": float64(2.5), "verbose": true, "tags": []any{"a"}},
+			want:   []any{"42", 2.5, 3, []any{"a"}, true},
+		},
+		{
+			name:   "strings are parsed",
+			schema: schema,
+			input:  map[string]any{"query": "tea", "page": "4", "limit": "0.5", "verbose": "true"},
+			want:   []any{"tea", 0.5, 4, nil, true},
+		},
+		{
+			name:   "null is treated as omitted",
+			schema: schema,
+			input:  map[string]any{"query": "tea", "page": nil},
+			want:   []any{"tea", nil, 0, nil, false},
+		},
+		{
+			name:    "missing required parameter",
+			schema:  schema,
+			input:   map[string]any{"page": float64(1)},
+			wantErr: true,
+		},
+		{
+			name:    "fractional integer",
+			schema:  schema,
+			input:   map[string]any{"query": "tea", "page": float64(1.5)},
+			wantErr: true,
+		},
+		{
+			name:    "unparseable boolean",
+			schema:  schema,
+			input:   map[string]any{"query": "tea", "verbose": "maybe"},
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			schema:  schema,
+			input:   map[string]any{"query": "tea", "tags": "a,b"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := bindToolArguments(test.schema, test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("bindToolArguments(%v) = %v, want an error", test.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bindToolArguments(%v) returned an error: %v", test.input, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("bindToolArguments(%v) = %#v, want %#v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExecuteToolCall(t *testing.T) {
+	schema := InputSchema{Type: "object", Properties: map[string]Property{"text": {Type: "string"}}, Required: []string{"text"}}
+	tool := func(name string, function func(ctx context.Context, args ...any) (any, error)) Tool {
+		return Tool{Name: name, InputSchema: schema, Function: function}
+	}
+	agent, _ := newTestAgent(&fakeProvider{})
+	agent.Tools = append(agent.Tools,
+		tool("upper", func(ctx context.Context, args ...any) (any, error) { return strings.ToUpper(args[0].(string)), nil }),
+		tool("length", func(ctx context.Context, args ...any) (any, error) {
+			return map[string]int{"length": len(args[0].(string))}, nil
+		}),
+		tool("fail", func(ctx context.Context, args ...any) (any, error) { return nil, errors.New("the service is down") }),
+		tool("panic", func(ctx context.Context, args ...any) (any, error) { panic("index out of range") }),
+		tool("channel", func(ctx context.Context, args ...any) (any, error) { return make(chan int), nil }),
+		Tool{Name: "empty", InputSchema: schema},
+	)
+
+	tests := []struct {
+		name    string
+		tool    string
+		input   map[string]any
+		want    string
+		isError bool
+	}{
+		{name: "string output", tool: "upper", input: map[string]any{"text": "hi"}, want: "HI"},
+		{name: "output encoded as JSON", tool: "length", input: map[string]any{"text": "hi"}, want: `{"length":2}`},
+		{name: "error", tool: "fail", input: map[string]any{"text": "hi"}, want: "Error: the service is down", isError: true},
+		{name: "panic", tool: "panic", input: map[string]any{"text": "hi"}, want: `Error: tool "panic" panicked: index out of range`, isError: true},
+		{name: "output that cannot be encoded", tool: "channel", input: map[string]any{"text": "hi"}, want: "Error: unable to serialize tool output", isError: true},
+		{name: "missing argument", tool: "upper", input: map[string]any{}, want: `Error: missing required parameter "text"`, isError: true},
+		{name: "unknown tool", tool: "lower", input: map[string]any{"text": "hi"}, want: `Error: tool "lower" does not exist`, isError: true},
+		{name: "no function", tool: "empty", input: map[string]any{"text": "hi"}, want: `Error: tool "empty" has no function`, isError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, _ := executeToolCall(context.Background(), Content{Type: "tool_use", ID: "call_1", Name: test.tool, Input: test.input}, agent.toolMap())
+			if result.Type != "tool_result" || result.ToolUseID != "call_1" || !strings.HasPrefix(result.Content, test.want) || result.IsError != test.isError {
+				t.Errorf("executeToolCall = %+v, want a result for call_1 starting with %q, is_error %v", result, test.want, test.isError)
+			}
+		})
+	}
+}
+
+func TestStepRunsToolsConcurrently(t *testing.T) {
+	schema := InputSchema{Type: "object", Properties: map[string]Property{"text": {Type: "string"}}, Required: []string{"text"}}
+	// every call to meet waits for the other one, so they only return if they run at the same time
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	meet := Tool{Name: "meet", InputSchema: schema, Function: func(ctx context.Context, args ...any) (any, error) {
+		arrived.Done()
+		met := make(chan struct{})
+		go func() {
+			arrived.Wait()
+			close(met)
+		}()
+		select {
+		case <-met:
+			return "met " + args[0].(string), nil
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("the other call never started")
+		}
+	}}
+	notes := make([]string, 0)
+	note := Tool{Name: "note", InputSchema: schema, Sequential: true, Function: func(ctx context.Context, args ...any) (any, error) {
+		notes = append(notes, args[0].(string))
+		return "noted " + args[0].(string), nil
+	}}
+
+	toolUse := func(id string, name string, text string) Content {
+		return Content{Type: "tool_use", ID: id, Name: name, Input: map[string]any{"text": text}}
+	}
+	response := AgentResponse{Role: "assistant", StopReason: "tool_use", Content: []Content{
+		toolUse("call_1", "note", "a"), toolUse("call_2", "meet", "x"), toolUse("call_3", "note", "b"), toolUse("call_4", "meet", "y"), toolUse("call_5", "note", "c"),
+	}}
+	agent, _ := newTestAgent(&fakeProvider{responses: []AgentResponse{response}})
+	agent.Tools = append(agent.Tools, meet, note)
+	agent.AddUserMessage("Hello")
+
+	if _, err := agent.Step(context.Background(), DefaultRunOptions()); err != nil {
+		t.Fatal(err)
+	}
+	// the results are sent back in a single message, in the order of the tool calls
+	last := agent.ChatHistory[len(agent.ChatHistory)-1]
+	want := []string{"noted a", "met x", "noted b", "met y", "noted c"}
+	if len(last.Content) != len(want) {
+		t.Fatalf("the last message has %d blocks, want the %d tool results", len(last.Content), len(want))
+	}
+	for i, result := range last.Content {
+		if id := fmt.Sprintf("call_%d", i+1); result.ToolUseID != id || result.Content != want[i] {
+			t.Errorf("result %d = %+v, want %q for %s", i, result, want[i], id)
+		}
+	}
+	if !reflect.DeepEqual(notes, []string{"a", "b", "c"}) {
+		t.Errorf("the sequential tool ran in the order %v, want [a b c]", notes)
+	}
+}
+
+func TestToolTimeout(t *testing.T) {
+	// a tool that ignores its context, one that respects it and a sequential one that ignores it
+	release := make(chan struct{})
+	defer close(release)
+	stuck := Tool{Name: "stuck", InputSchema: InputSchema{Type: "object"}, Function: func(ctx context.Context, args ...any) (any, error) {
+		<-release
+		return "finished", nil
+	}}
+	wait := Tool{Name: "wait", InputSchema: InputSchema{Type: "object"}, Timeout: 10 * time.Millisecond, Function: func(ctx context.Context, args ...any) (any, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+	slow := Tool{Name: "slow", InputSchema: InputSchema{Type: "object"}, Sequential: true, Timeout: 10 * time.Millisecond, Function: func(ctx context.Context, args ...any) (any, error) {
+		time.Sleep(40 * time.Millisecond)
+		return "finished", nil
+	}}
+	agent, _ := newTestAgent(&fakeProvider{responses: []AgentResponse{{Role: "assistant", StopReason: "tool_use", Content: []Content{
+		{Type: "tool_use", ID: "call_1", Name: "stuck", Input: map[string]any{}},
+		{Type: "tool_use", ID: "call_2", Name: "wait", Input: map[string]any{}},
+		{Type: "tool_use", ID: "call_3", Name: "slow", Input: map[string]any{}},
+	}}}})
+	agent.Tools = append(agent.Tools, stuck, wait, slow)
+	agent.AddUserMessage("Hello")
+
+	options := DefaultRunOptions()
+	options.ToolTimeout = 20 * time.Millisecond
+	if _, err := agent.Step(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	results := agent.ChatHistory[len(agent.ChatHistory)-1].Content
+	if len(results) != 3 {
+		t.Fatalf("the step returned %d tool results, want 3", len(results))
+	}
+	// the sequential tool is waited for, so its actual outcome is returned
+	if result := results[2]; result.IsError || result.Content != "finished" {
+		t.Errorf("result for %s = %+v, want the output of the sequential tool", result.ToolUseID, result)
+	}
+	for _, result := range results[:2] {
+		if !result.IsError || !strings.Contains(result.Content, context.DeadlineExceeded.Error()) {
+			t.Errorf("result for %s = %+v, want a deadline error", result.ToolUseID, result)
+		}
+	}
+}
+
+func TestStepHeartbeatRequests(t *testing.T) {
+	search := func(id string, name string, heartbeat bool) Content {
+		return Content{Type: "tool_use", ID: id, Name: name, Input: map[string]any{"query": "tea", "requestHeartbeat": heartbeat}}
+	}
+	pause := Content{Type: "tool_use", ID: "call_pause", Name: "pauseHeartbeats", Input: map[string]any{}}
+	tests := []struct {
+		name     string
+		toolUses []Content
+		want     bool
+	}{
+		{"no requests", []Content{search("call_1", "conversationSearch", false), search("call_2", "archivalMemorySearch", false)}, false},
+		{"one parallel search requests a heartbeat", []Content{search("call_1", "conversationSearch", false), search("call_2", "archivalMemorySearch", true)}, true},
+		{"a pause wins over requests", []Content{search("call_1", "conversationSearch", true), pause, search("call_2", "archivalMemorySearch", true)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := AgentResponse{Role: "assistant", StopReason: "tool_use", Content: test.toolUses}
+			agent, _ := newTestAgent(&fakeProvider{responses: []AgentResponse{response}})
+			if _, ok := agent.toolMap()["pauseHeartbeats"]; !ok {
+				agent.Tools = append(agent.Tools, *agent.createPauseHeartbeatsTool())
+			}
+			agent.AddUserMessage("What do I like to drink?")
+
+			step, err := agent.Step(context.Background(), DefaultRunOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if step.ToolCalls != len(test.toolUses) || agent.HeartbeatState != test.want {
+				t.Errorf("Step ran %d tool calls with heartbeat %v, want %d with heartbeat %v", step.ToolCalls, agent.HeartbeatState, len(test.toolUses), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Typed tool registration.
+Generates a tool's InputSchema from a Go struct so that tools can be written as ordinary typed functions.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+Creates a Tool from a typed function.
+The InputSchema is generated from the fields of the In struct, using the following struct tags:
+  - json: the name of the parameter (fields tagged "-" are skipped). Fields tagged omitempty are optional.
+  - description: a description of what the parameter represents
+  - enum: comma separated list of the possible values of the parameter
+  - required: "true" or "false", overriding whether the parameter is required
+  - default: the value used when an optional parameter is omitted
+
+The input provided by the model is decoded into In before the function is called.
+
+Example:
+
+	type getStockPriceInput struct {
+		Ticker string `json:"ticker" description:"The stock ticker symbol, e.g. AAPL for Apple Inc."`
+	}
+
+	tool := NewTool("get_stock_price", "Retrieves the current stock price for a given ticker symbol...",
+		func(ctx context.Context, input getStockPriceInput) (float64, error) {
+			return lookupPrice(input.Ticker)
+		})
+*/
+func NewTool[In any, Out any](name string, description string, function func(context.Context, In) (Out, error)) *Tool {
+	inputType := reflect.TypeFor[In]()
+	schema, err := schemaFromStruct(inputType)
+	if err != nil {
+		panic(fmt.Sprintf("NewTool %s: %v", name, err))
+	}
+	order := schema.Order
+
+	return &Tool{
+		Name:        name,
+		Description: description,
+		InputSchema: schema,
+		Function: func(ctx context.Context, args ...any) (any, error) {
+			// Rebuilding the input parameters from the positional arguments
+			input := make(map[string]any, len(order))
+			for i, paramName := range order {
+				if i < len(args) && args[i] != nil {
+					input[paramName] = args[i]
+				}
+			}
+
+			typedInput, err := decodeToolInput[In](input)
+			if err != nil {
+				return nil, err
+			}
+
+			output, err := function(ctx, typedInput)
+			if err != nil {
+				return nil, err
+			}
+			return output, nil
+		},
+	}
+}
+
+/*
+Decodes the input parameters of a tool call into the tool's input struct
+*/
+func decodeToolInput[In any](input map[string]any) (In, error) {
+	var typedInput In
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return typedInput, err
+	}
+	if err := json.Unmarshal(encoded, &typedInput); err != nil {
+		return typedInput, fmt.Errorf("invalid input: %w", err)
+	}
+	return typedInput, nil
+}
+
+/*
+Generates an InputSchema from the fields of a struct type.
+The Order of the schema follows the order in which the fields are declared.
+*/
+func schemaFromStruct(structType reflect.Type) (InputSchema, error) {
+	for structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return InputSchema{}, fmt.Errorf("tool input must be a struct, got %s", structType)
+	}
+
+	schema := InputSchema{
+		Type:       "object",
+		Properties: map[string]Property{},
+		Required:   []string{},
+		Order:      []string{},
+	}
+	if err := addStructFields(&schema, structType); err != nil {
+		return InputSchema{}, err
+	}
+	return schema, nil
+}
+
+/*
+Adds a Property to the schema for every exported field of the struct type, including the fields of embedded structs
+*/
+func addStructFields(schema *InputSchema, structType reflect.Type) error {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		jsonTag := field.Tag.Get("json")
+		if jsonTag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(jsonTag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			if err := addStructFields(schema, field.Type); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property, err := propertyFromType(field.Type)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		property.Description = field.Tag.Get("description")
+		if enum := field.Tag.Get("enum"); enum != "" {
+			property.Enum = strings.Split(enum, ",")
+		}
+		if defaultValue, ok := field.Tag.Lookup("default"); ok {
+			property.Default, err = parseDefault(property.Type, defaultValue)
+			if err != nil {
+				return fmt.Errorf("field %s: invalid default: %w", field.Name, err)
+			}
+		}
+
+		// Fields are required unless they are marked as omitempty or are pointers
+		required := !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer
+		if requiredTag, ok := field.Tag.Lookup("required"); ok {
+			required = requiredTag == "true"
+		}
+
+		schema.Properties[name] = property
+		schema.Order = append(schema.Order, name)
+		if required {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return nil
+}
+
+/*
+Returns the Property describing the JSON schema type of a Go type
+*/
+func propertyFromType(fieldType reflect.Type) (Property, error) {
+	switch fieldType.Kind() {
+	case reflect.Pointer:
+		return propertyFromType(fieldType.Elem())
+	case reflect.String:
+		return Property{Type: "string"}, nil
+	case reflect.Bool:
+		return Property{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Property{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return Property{Type: "number"}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := propertyFromType(fieldType.Elem())
+		if err != nil {
+			return Property{}, err
+		}
+		return Property{Type: "array", Items: &items}, nil
+	case reflect.Map, reflect.Struct:
+		return Property{Type: "object"}, nil
+	case reflect.Interface:
+		// any type of value is accepted
+		return Property{}, nil
+	default:
+		return Property{}, fmt.Errorf("unsupported type %s", fieldType)
+	}
+}
+
+/*
+Parses the value of a default struct tag into the type of the property
+*/
+func parseDefault(schemaType string, value string) (any, error) {
+	switch schemaType {
+	case "integer":
+		return strconv.Atoi(value)
+	case "number":
+		return strconv.ParseFloat(value, 64)
+	case "boolean":
+		return strconv.ParseBool(value)
+	default:
+		return value, nil
+	}
+}
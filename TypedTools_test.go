@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type SearchScope struct {
+	Source string `json:"source" description:"Where to search"`
+}
+
+type searchInput struct {
+	Query   string         `json:"query" description:"What to search for"`
+	Page    int            `json:"page,omitempty" default:"2"`
+	Limit   *float64       `json:"limit"`
+	Mode    string         `json:"mode" enum:"fast,thorough" required:"false" default:"fast"`
+	Verbose bool           `json:"verbose,omitempty" required:"true"`
+	Tags    []string       `json:"tags,omitempty"`
+	Options map[string]any `json:"options,omitempty"`
+	Secret  string         `json:"-"`
+	hidden  string
+	SearchScope
+	Untagged int
+}
+
+func TestSchemaFromStruct(t *testing.T) {
+	schema, err := schemaFromStruct(reflect.TypeFor[searchInput]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InputSchema{
+		Type: "object",
+		Properties: map[string]Property{
+			"query":    {Type: "string", Description: "What to search for"},
+			"page":     {Type: "integer", Default: 2},
+			"limit":    {Type: "number"},
+			"mode":     {Type: "string", Enum: []string{"fast", "thorough"}, Default: "fast"},
+			"verbose":  {Type: "boolean"},
+			"tags":     {Type: "array", Items: &Property{Type: "string"}},
+			"options":  {Type: "object"},
+			"source":   {Type: "string", Description: "Where to search"},
+			"Untagged": {Type: "integer"},
+		},
+		Required: []string{"query", "verbose", "source", "Untagged"},
+		Order:    []string{"query", "page", "limit", "mode", "verbose", "tags", "options", "source", "Untagged"},
+	}
+	if !reflect.DeepEqual(schema, want) {
+		got, _ := json.MarshalIndent(schema, "", "  ")
+		t.Errorf("schemaFromStruct =\n%s\norder %v", got, schema.Order)
+	}
+}
+
+func TestSchemaFromStructErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      reflect.Type
+		errorHas string
+	}{
+		{"not a struct", reflect.TypeFor[string](), "must be a struct"},
+		{"unsupported field type", reflect.TypeFor[struct {
+			Done chan bool `json:"done"`
+		}](), "unsupported type"},
+		{"invalid default", reflect.TypeFor[struct {
+			Page int `json:"page" default:"first"`
+		}](), "invalid default"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := schemaFromStruct(test.typ); err == nil || !strings.Contains(err.Error(), test.errorHas) {
+				t.Errorf("schemaFromStruct returned error %v, want an error containing %q", err, test.errorHas)
+			}
+		})
+	}
+
+	t.Run("NewTool panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("NewTool did not panic for an unsupported input type")
+			}
+		}()
+		NewTool("wait", "Waits.", func(ctx context.Context, input struct {
+			Done chan bool `json:"done"`
+		}) (string, error) {
+			return "", nil
+		})
+	})
+}
+
+func TestNewToolDecodesArguments(t *testing.T) {
+	var received searchInput
+	tool := NewTool("search", "Searches.", func(ctx context.Context, input searchInput) (string, error) {
+		received = input
+		return "found", nil
+	})
+
+	// the input as decoded from the model's tool_use block
+	var input map[string]any
+	if err := json.Unmarshal([]byte(`{"query": "tea", "limit": 2.5, "verbose": true, "tags": ["green"], "source": "notes", "Untagged": 3}`), &input); err != nil {
+		t.Fatal(err)
+	}
+	args, err := bindToolArguments(tool.InputSchema, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := tool.Function(context.Background(), args...); output != "found" || err != nil {
+		t.Fatalf("the tool returned %v, %v", output, err)
+	}
+
+	limit := 2.5
+	want := searchInput{Query: "tea", Page: 2, Limit: &limit, Mode: "fast", Verbose: true, Tags: []string{"green"}, SearchScope: SearchScope{Source: "notes"}, Untagged: 3}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("the tool received %+v, want %+v", received, want)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+User events: the things that happen in the host application (the user sending a message, logging in, reacting to a message, ...)
+that an Agent is run in response to.
+Each event is added to the chat history as a JSON object in a text block, with its type and the time at which it happened, e.g.
+
+	{"type":"login","time":"2026-10-18T09:30:00Z","lastLogin":"2026-10-17T18:02:11Z"}
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Possible types of a UserEvent
+*/
+const (
+	USER_EVENT_MESSAGE       = "user_message"  // the user sent a message
+	USER_EVENT_LOGIN         = "login"         // the user logged in or opened the application
+	USER_EVENT_REACTION      = "reaction"      // the user reacted to a message from the Agent
+	USER_EVENT_SYSTEM_ALERT  = "system_alert"  // the host application has something to tell the Agent
+	USER_EVENT_TOOL_CALLBACK = "tool_callback" // a long-running tool or external job finished
+)
+
+/*
+An event that an Agent can be run in response to
+*/
+type UserEvent interface {
+	// One of the USER_EVENT_* constants
+	EventType() string
+	// Returns an error if a required field is missing
+	validate() error
+}
+
+/*
+A message written by the user
+*/
+type UserMessage struct {
+	Text string `json:"message"`
+	Name string `json:"name,omitempty"` // the name of the user, when the Agent talks to more than one person
+}
+
+func (UserMessage) EventType() string { return USER_EVENT_MESSAGE }
+
+func (event UserMessage) validate() error {
+	if event.Text == "" {
+		return fmt.Errorf("the message must not be empty")
+	}
+	return nil
+}
+
+/*
+The user logged in
+*/
+type UserLogin struct {
+	LastLogin *time.Time `json:"lastLogin,omitempty"` // when the user last logged in before this, if known
+}
+
+func (UserLogin) EventType() string { return USER_EVENT_LOGIN }
+
+func (UserLogin) validate() error { return nil }
+
+/*
+The user reacted to one of the Agent's messages, e.g. by liking it
+*/
+type Reaction struct {
+	Reaction  string `json:"reaction"`            // e.g. "like" or an emoji
+	Message   string `json:"message,omitempty"`   // the text of the message that was reacted to
+	MessageID string `json:"messageId,omitempty"` // the ToolUseID of the AgentMessage that was reacted to
+}
+
+func (Reaction) EventType() string { return USER_EVENT_REACTION }
+
+func (event Reaction) validate() error {
+	if event.Reaction == "" {
+		return fmt.Errorf("the reaction must not be empty")
+	}
+	return nil
+}
+
+/*
+A notice from the host application rather than from the user, e.g. that the user's subscription is about to expire
+*/
+type SystemAlert struct {
+	Message string `json:"message"`
+}
+
+func (SystemAlert) EventType() string { return USER_EVENT_SYSTEM_ALERT }
+
+func (event SystemAlert) validate() error {
+	if event.Message == "" {
+		return fmt.Errorf("the alert message must not be empty")
+	}
+	return nil
+}
+
+/*
+The result of work that finished after the tool call that started it returned, e.g. a background job or a webhook from another service
+*/
+type ToolCallback struct {
+	Tool      string `json:"tool"`
+	ToolUseID string `json:"toolUseId,omitempty"` // the tool call that started the work, if any
+	Result    string `json:"result"`
+	IsError   bool   `json:"isError,omitempty"`
+}
+
+func (ToolCallback) EventType() string { return USER_EVENT_TOOL_CALLBACK }
+
+func (event ToolCallback) validate() error {
+	if event.Tool == "" {
+		return fmt.Errorf("the tool callback must name a tool")
+	}
+	return nil
+}
+
+/*
+Formats an event as the JSON object that is shown to the Agent, with the type and the time first
+*/
+func formatUserEvent(event UserEvent, now time.Time) (string, error) {
+	header, err := json.Marshal(struct {
+		Type string `json:"type"`
+		Time string `json:"time"`
+	}{event.EventType(), now.Format(time.RFC3339)})
+	if err != nil {
+		return "", err
+	}
+	fields, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("error encoding %s event: %w", event.EventType(), err)
+	}
+	if string(fields) == "{}" {
+		return string(header), nil
+	}
+	return string(header[:len(header)-1]) + "," + string(fields[1:]), nil
+}
+
+/*
+Returns the type of the event in a text block formatted by formatUserEvent, or "" if the text is not an event
+*/
+func userEventType(text string) string {
+	if !strings.HasPrefix(text, "{") {
+		return ""
+	}
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal([]byte(text), &envelope); err != nil {
+		return ""
+	}
+	return envelope.Type
+}
+
+/*
+Decodes an event from a JSON object with a "type" field and the fields of that type of event
+*/
+func ParseUserEvent(data []byte) (UserEvent, error) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+
+	var event UserEvent
+	var err error
+	switch envelope.Type {
+	case USER_EVENT_MESSAGE:
+		event, err = decodeUserEvent[UserMessage](data)
+	case USER_EVENT_LOGIN:
+		event, err = decodeUserEvent[UserLogin](data)
+	case USER_EVENT_REACTION:
+		event, err = decodeUserEvent[Reaction](data)
+	case USER_EVENT_SYSTEM_ALERT:
+		event, err = decodeUserEvent[SystemAlert](data)
+	case USER_EVENT_TOOL_CALLBACK:
+		event, err = decodeUserEvent[ToolCallback](data)
+	default:
+		return nil, fmt.Errorf("unknown event type %q", envelope.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s event: %w", envelope.Type, err)
+	}
+	if err := event.validate(); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func decodeUserEvent[T UserEvent](data []byte) (UserEvent, error) {
+	var event T
+	err := json.Unmarshal(data, &event)
+	return event, err
+}
+
+/*
+Adds an event to the Agent's context without running the Agent
+*/
+func (llm *Agent) AddEvent(event UserEvent) error {
+	if err := event.validate(); err != nil {
+		return err
+	}
+	text, err := formatUserEvent(event, llm.now())
+	if err != nil {
+		return err
+	}
+	llm.addUserContentToChatHistory(Content{Type: "text", Text: text})
+	return nil
+}
+
+/*
+Adds an event to the Agent's context and runs the agent loop in response to it
+*/
+func (llm *Agent) HandleEvent(ctx context.Context, event UserEvent, options ...RunOptions) (*RunResult, error) {
+	if err := llm.AddEvent(event); err != nil {
+		return &RunResult{Status: RUN_STATUS_ERROR, Responses: make([]AgentResponse, 0)}, err
+	}
+	return llm.Run(ctx, options...)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserEventRoundTrip(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	lastLogin := time.Date(2026, 10, 17, 18, 2, 11, 0, time.UTC)
+	tests := []struct {
+		event UserEvent
+		want  string
+	}{
+		{
+			event: UserMessage{Text: "Hello", Name: "Sam"},
+			want:  `{"type":"user_message","time":"2026-10-18T09:30:00Z","message":"Hello","name":"Sam"}`,
+		},
+		{
+			event: UserLogin{LastLogin: &lastLogin},
+			want:  `{"type":"login","time":"2026-10-18T09:30:00Z","lastLogin":"2026-10-17T18:02:11Z"}`,
+		},
+		{
+			event: UserLogin{},
+			want:  `{"type":"login","time":"2026-10-18T09:30:00Z"}`,
+		},
+		{
+			event: Reaction{Reaction: "👍", Message: "Good morning!", MessageID: "toolu_1"},
+			want:  `{"type":"reaction","time":"2026-10-18T09:30:00Z","reaction":"👍","message":"Good morning!","messageId":"toolu_1"}`,
+		},
+		{
+			event: SystemAlert{Message: "The subscription expires tomorrow."},
+			want:  `{"type":"system_alert","time":"2026-10-18T09:30:00Z","message":"The subscription expires tomorrow."}`,
+		},
+		{
+			event: ToolCallback{Tool: "render", ToolUseID: "toolu_2", Result: "timed out", IsError: true},
+			want:  `{"type":"tool_callback","time":"2026-10-18T09:30:00Z","tool":"render","toolUseId":"toolu_2","result":"timed out","isError":true}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			text, err := formatUserEvent(test.event, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.want {
+				t.Errorf("formatUserEvent = %s, want %s", text, test.want)
+			}
+			if eventType := userEventType(text); eventType != test.event.EventType() {
+				t.Errorf("userEventType = %q, want %q", eventType, test.event.EventType())
+			}
+
+			event, err := ParseUserEvent([]byte(text))
+			if err != nil {
+				t.Fatalf("ParseUserEvent returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(event, test.event) {
+				t.Errorf("ParseUserEvent = %#v, want %#v", event, test.event)
+			}
+		})
+	}
+}
+
+func TestParseUserEventErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{data: `{"type":"dance"}`, want: `unknown event type "dance"`},
+		{data: `{"message":"Hello"}`, want: `unknown event type ""`},
+		{data: `not json`, want: "invalid event"},
+		{data: `{"type":"user_message","message":5}`, want: "invalid user_message event"},
+		{data: `{"type":"user_message"}`, want: "the message must not be empty"},
+		{data: `{"type":"reaction","message":"Hi"}`, want: "the reaction must not be empty"},
+		{data: `{"type":"system_alert"}`, want: "the alert message must not be empty"},
+		{data: `{"type":"tool_callback","result":"done"}`, want: "the tool callback must name a tool"},
+	}
+	for _, test := range tests {
+		t.Run(test.data, func(t *testing.T) {
+			event, err := ParseUserEvent([]byte(test.data))
+			if err == nil {
+				t.Fatalf("ParseUserEvent(%s) = %#v, want an error", test.data, event)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ParseUserEvent(%s) returned %q, want it to contain %q", test.data, err, test.want)
+			}
+		})
+	}
+}
+
+func TestUserEventType(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: `{"type":"login","time":"2026-10-18T09:30:00Z"}`, want: USER_EVENT_LOGIN},
+		{text: "Hello", want: ""},
+		{text: "{not json", want: ""},
+		{text: `{"message":"no type"}`, want: ""},
+	}
+	for _, test := range tests {
+		if got := userEventType(test.text); got != test.want {
+			t.Errorf("userEventType(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestAddEvent(t *testing.T) {
+	agent, _ := newTestAgent(&fakeProvider{})
+	if err := agent.AddEvent(SystemAlert{}); err == nil {
+		t.Fatalf("AddEvent accepted an empty alert")
+	}
+	if agent.RecallMemory.Len() != 0 {
+		t.Errorf("an invalid event was added to recall memory")
+	}
+
+	if err := agent.AddEvent(UserLogin{}); err != nil {
+		t.Fatal(err)
+	}
+	entries := agent.RecallMemory.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("recall memory has %d entries, want 1", len(entries))
+	}
+	if eventType := userEventType(messageText(entries[0].Message)); eventType != USER_EVENT_LOGIN {
+		t.Errorf("the recalled event has type %q, want %q", eventType, USER_EVENT_LOGIN)
+	}
+	if isUserMessage(entries[0].Message) {
+		t.Errorf("a login event should not count as a message from the user")
+	}
+
+	// the message is merged into the same user turn as the login, and still recalled on its own
+	if err := agent.AddEvent(UserMessage{Text: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	entries = agent.RecallMemory.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("recall memory has %d entries, want 2", len(entries))
+	}
+	if !isUserMessage(entries[1].Message) {
+		t.Errorf("the user_message event should count as a message from the user")
+	}
+}
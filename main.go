@@ -17,212 +17,32 @@ package main
 
 import (
 	"fmt"
+	"os"
 )
 
-// func getWeather(location string) float32 {
-//     if location == "San Francisco, CA" {
-//         return 24.0
-//     } else if location == "Boston, MA" {
-//         return 10.0
-//     } else if location == "New York City, NY" {
-//         return 8.0
-// 		}
-//	  return 5.0
-// }
-
-/*
-TODO:
-Add logic for redefining a function in the variadic parameter format
-*/
-func getWeather(location string) float32 {
-	switch location {
-	case "San Francisco, CA":
-		return float32(24.0)
-	case "Boston, MA":
-		return float32(10.0)
-	case "New York City, NY":
-		return float32(8.0)
-	default:
-		return float32(5.0)
-	}
-}
-
-func getWeatherVariadic(args ...any) any {
-	if len(args) == 0 {
-		return "Error: No location provided"
-	}
-
-	location, ok := args[0].(string)
-	if !ok {
-		return "Error: Invalid location type"
-	}
-
-	return getWeather(location)
-}
-
 func main() {
-	// hasSystemPrompt := false
-	// hasMemory := true
-
-	// // Replace w actual values
-	// systemPrompt := ""
-	// memory := CoreMemory{}
-	const DEFAULT_MAX_TOKENS int = 2048
-
-	agent, ok := NewAgent("claude-3-haiku-20240307", "Assistant", "firstAgent", ANTHROPIC_API_KEY)
-	if !ok {
-		fmt.Println("Error when initializing agent")
-		return
+	if len(os.Args) < 2 {
+		printUsage(os.Stderr)
+		os.Exit(2)
 	}
 
-	// todo: add a helper method for this
-	agent.Tools = append(agent.Tools, Tool{Name: "getWeather",
-		Description: "A function that returns the weather (in degrees Celsius) for a given location.",
-		InputSchema: InputSchema{
-			Type: "object",
-			Properties: map[string]Property{
-				"location": {Type: "string", Description: `The geographic location to check the weather for. 
-														The format should be the name of the city followed by the abbreviated name of the state that the city belongs to.
-														In other words, the format should be "<CITY_NAME>, <STATE>".
-														For example, to check the weather in Boston, Massachussetts, this parameter would be "Boston, MA".`,
-				},
-			},
-			Required: []string{"location"},
-		},
-		Function: getWeatherVariadic,
-	})
-
-	// todo: add a helper method for this
-	agent.ChatHistory = append(agent.ChatHistory, Message{Role: "user",
-		Content: []Content{
-			{Type: "text", Text: "What is the weather in New York City?"},
-		}})
-
-	// llm := Agent{
-	// 	ApiKey: ANTHROPIC_API_KEY,
-	// 	Model:  "claude-3-haiku-20240307",
-	// 	// System: []Content{
-	// 	// 	{Type: "text", Text: "You are a helpful AI assistant designed to answer user questions."},
-	// 	// },
-	// 	ChatHistory: []Message{
-	// 		{Role: "user",
-	// 			Content: []Content{
-	// 				{Type: "text", Text: "What is the weather in New York City?"},
-	// 			}},
-	// 	},
-	// 	Tools: []Tool{
-	// 		{Name: "getWeather",
-	// 			Description: "A function that returns the weather (in degrees Celsius) for a given location.",
-	// 			InputSchema: InputSchema{
-	// 				Type: "object",
-	// 				Properties: map[string]Property{
-	// 					"location": {Type: "string", Description: `The geographic location to check the weather for.
-	// 																The format should be the name of the city followed by the abbreviated name of the state that the city belongs to.
-	// 																In other words, the format should be "<CITY_NAME>, <STATE>".
-	// 																For example, to check the weather in Boston, Massachussetts, this parameter would be "Boston, MA".`,
-	// 					},
-	// 				},
-	// 				Required: []string{"location"},
-	// 			},
-	// 			Function: getWeatherVariadic,
-	// 		},
-	// 	},
-	// }
-
-	// if hasSystemPrompt {
-	// 	llm.System = append(llm.System, Content{Type: "text", Text: systemPrompt})
-	// }
-	// if hasMemory {
-	//llm.CoreMemory = memory
-	//llm.System = append(llm.System, Content{Type: "text", Text: "You are a helpful AI agent with access to a core memory. You can add new information to your core memory by calling the `coreMemorySave` function."})
-	// llm.Tools = append(llm.Tools,
-	// 	// Core memory save Tool
-	// 	Tool{
-	// 		Name:        "coreMemoryAppend",
-	// 		Description: "Save important information about you (the agent) or the human you are chatting with.",
-	// 		InputSchema: InputSchema{
-	// 			Type: "object",
-	// 			Properties: map[string]Property{
-	// 				"agentMem": {
-	// 					Type:        "boolean",
-	// 					Description: "Must be either `true` to save information about yourself (the agent), or `false` to save information about the user.",
-	// 				},
-	// 				"newMemory": {
-	// 					Type:        "string",
-	// 					Description: "CoreMemory to save in the section",
-	// 				},
-	// 			},
-	// 			Required: []string{"agentMem", "newMemory"},
-	// 		},
-	// 		// Wrapper function
-	// 		Function: llm.coreMemoryAppendVariadic,
-	// 		// Function: func(agentMema any, memorya any) any {
-	// 		// 	//args := params.(map[string]any)
-	// 		// 	agentMem := params["agentMem"].(bool)
-	// 		// 	memory := params["memory"].(string)
-	// 		// 	return memoryBlock.coreMemorySave(agentMem, memory)
-	// 		// },
-	// 	},
-	// )
-	// llm.System = append(llm.System, Content{Type: "text", Text: fmt.Sprintf("MEMORY:\n%+v", memory)}) // provide string representation of MemoryBlock struct
-	// }
-
-	// request := AgentRequest{
-	// 	Model:  llm.Model,
-	// 	System: llm.System,
-	// 	// System: []Content{
-	// 	// 	{Type: "text", Text: "You are a helpful AI assistant designed to answer user questions."},
-	// 	// },
-
-	// 	Messages: llm.ChatHistory,
-
-	// 	MaxTokens: 1024,
-	// 	Tools:     llm.Tools,
-	// }
-
-	request := *agent.NewAgentRequest(DEFAULT_MAX_TOKENS, 0)
-
-	response, statusCode, err := agent.call(request)
-
-	if statusCode < 200 || statusCode >= 300 {
-		fmt.Println("Error with HTTP request to Agent")
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage(os.Stdout)
 		return
 	}
-
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-	}
-
-	// Agent's initial output
-	fmt.Println(response.getOutput())
-	fmt.Println("---------")
-
-	// Adding Agent response to chat history
-	agent.addResponseToChatHistory(*response)
-
-	// Checking each Content block returned in the response
-	for _, content := range response.Content {
-		// only looking for tool_use Content blocks
-		if content.Type != "tool_use" {
+	for _, cmd := range commands {
+		if cmd.name != name {
 			continue
 		}
-		// Adding tool call result to chat history
-		agent.addToolResultToChatHistory(content)
-	}
-
-	fmt.Println(agent.ChatHistory)
-
-	response1, statusCode1, err1 := agent.call(request)
-
-	if statusCode1 < 200 || statusCode >= 300 {
-		fmt.Println("Error with HTTP request to Agent")
+		if err := cmd.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	if err1 != nil {
-		fmt.Printf("Error: %v\n", err)
-	}
-
-	fmt.Println(response1.getOutput())
-
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	os.Exit(2)
 }